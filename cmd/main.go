@@ -1,40 +1,246 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	HLSDownloader "github.com/cristiancll/HLSDownloader/pkg"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-func handleArgs() (string, string, int, bool, error) {
-	var URL string
-	flag.StringVar(&URL, "url", "", "A http url of the HLS stream/m3u8 file to be downloaded")
-	if URL == "" {
-		flag.StringVar(&URL, "u", "", "Target url")
+// http3Transport returns the RoundTripper of the -http3 requests. This module does not depend on
+// a QUIC implementation: a build wanting HTTP/3 adds a file to this package registering one from
+// its init function, e.g. the http3.RoundTripper of github.com/quic-go/quic-go.
+var http3Transport func() http.RoundTripper
+
+type args struct {
+	// info probes the playlist instead of downloading it
+	info    bool
+	URL     string
+	baseURL string
+	output  string
+	workers int
+	debug   bool
+	quality string
+
+	logLevel string
+
+	minHeight    int
+	maxHeight    int
+	maxBandwidth uint
+	codecs       string
+	allVariants  bool
+
+	noAudio       bool
+	muxAudio      bool
+	audioLanguage string
+
+	subtitles        bool
+	subtitleLanguage string
+	subtitleFormat   string
+
+	live bool
+
+	tolerateMissing bool
+	skipFailed      bool
+	maxFailures     int
+	split           bool
+
+	from        string
+	to          string
+	ignoreStart bool
+	clipStart   time.Duration
+	clipEnd     time.Duration
+
+	iframes bool
+
+	skipAds bool
+
+	closedCaptions bool
+	timedMetadata  bool
+	reportFile     bool
+
+	propagateQuery string
+	userAgent      string
+	basicAuth      string
+	digestAuth     string
+	proxy          string
+	http3          bool
+
+	strict    bool
+	resume    bool
+	stateFile string
+	overwrite string
+
+	timeouts  HLSDownloader.Timeouts
+	transport HLSDownloader.TransportOptions
+	tls       HLSDownloader.TLSOptions
+	tlsMin    string
+	resolve   string
+	dnsServer string
+	dnsCache  time.Duration
+	rateLimit string
+	delay     string
+	readAhead int
+	memory    string
+	memLimit  string
+	diskCheck string
+	verifyTS  bool
+	mirrors   string
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	keepPartial bool
+
+	contentKeys string
+	archive     bool
+	keepSegs    string
+	keepPadding bool
+	ivStrategy  string
+	keyFile     string
+	keystore    string
+}
+
+func handleArgs() (*args, error) {
+	a := &args{}
+	// "info" prints the description of the playlist as JSON, e.g. hlsdownloader info -u URL
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		a.info = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.StringVar(&a.URL, "url", "", "A http url, file:// URI or local path of the HLS stream/m3u8 file to be downloaded")
+	if a.URL == "" {
+		flag.StringVar(&a.URL, "u", "", "Target url")
+	}
+
+	flag.StringVar(&a.baseURL, "base-url", "", "The url relative segment URIs of a local playlist are resolved against")
+
+	flag.StringVar(&a.output, "output", "", "The path to the folder or the output file itself that the m3u8 will be saved, - to write the stream to stdout")
+	if a.output == "" {
+		flag.StringVar(&a.output, "o", "", "Path or Output file")
 	}
 
-	var output string
-	flag.StringVar(&output, "output", "", "The path to the folder or the output file itself that the m3u8 will be saved")
-	if output == "" {
-		flag.StringVar(&output, "o", "", "Path or Output file")
+	flag.IntVar(&a.workers, "workers", 5, "The number of workers to be used simultaneously to download the file (default 5)")
+	if a.workers == 5 {
+		flag.IntVar(&a.workers, "w", 5, "Total Workers")
 	}
+	flag.IntVar(&a.readAhead, "read-ahead", 0, "Segments downloaded past the next one to append to the output (default twice the workers)")
 
-	var workers int
-	flag.IntVar(&workers, "workers", 5, "The number of workers to be used simultaneously to download the file (default 5)")
-	if workers == 5 {
-		flag.IntVar(&workers, "w", 5, "Total Workers")
+	flag.StringVar(&a.quality, "quality", "highest", "Variant picked from a master playlist: highest or lowest bandwidth")
+	if a.quality == "highest" {
+		flag.StringVar(&a.quality, "q", "highest", "Variant quality (highest|lowest)")
 	}
 
+	flag.IntVar(&a.minHeight, "min-height", 0, "Only pick variants of at least this height")
+	flag.IntVar(&a.maxHeight, "max-height", 0, "Only pick variants of at most this height")
+	flag.UintVar(&a.maxBandwidth, "max-bandwidth", 0, "Only pick variants of at most this bandwidth (bits per second)")
+	flag.StringVar(&a.codecs, "codecs", "", "Comma separated codec prefixes the picked variant must carry (e.g. hvc1,mp4a)")
+
+	flag.BoolVar(&a.allVariants, "all-variants", false, "Download every variant of a master playlist into its own file")
+
+	flag.BoolVar(&a.noAudio, "no-audio", false, "Do not download the alternate audio rendition of a master playlist")
+	flag.BoolVar(&a.muxAudio, "mux", false, "Mux the alternate audio rendition into the output when both are fragmented MP4 (CMAF)")
+	flag.StringVar(&a.audioLanguage, "audio-lang", "", "Preferred language of the alternate audio rendition")
+
+	flag.BoolVar(&a.subtitles, "subs", false, "Download the WebVTT subtitle rendition into a sidecar file")
+	flag.StringVar(&a.subtitleLanguage, "subs-lang", "", "Preferred language of the subtitle rendition")
+	flag.StringVar(&a.subtitleFormat, "subs-format", "vtt", "Format of the subtitle sidecar file (vtt|srt)")
+
+	flag.BoolVar(&a.live, "live", false, "Record a live playlist until it ends or Ctrl-C is pressed")
+
+	flag.BoolVar(&a.tolerateMissing, "tolerate-missing", false, "Skip segments the server answers with 404/410 instead of failing")
+	flag.BoolVar(&a.skipFailed, "skip-failed", false, "Skip the segments failing after every retry instead of aborting the download")
+	flag.IntVar(&a.maxFailures, "max-failures", 0, "Abort once this many segments in a row were skipped because they failed (0 for no limit)")
+
+	flag.BoolVar(&a.split, "split", false, "Split the output into numbered files at every discontinuity")
+
+	flag.StringVar(&a.from, "from", "", "Only download from this wall-clock time (RFC3339), matched against EXT-X-PROGRAM-DATE-TIME")
+	flag.StringVar(&a.to, "to", "", "Only download until this wall-clock time (RFC3339), matched against EXT-X-PROGRAM-DATE-TIME")
+
+	flag.DurationVar(&a.clipStart, "clip-start", 0, "Only download from this offset of the playlist, e.g. 1h2m, summing the segment durations")
+	flag.DurationVar(&a.clipEnd, "clip-end", 0, "Only download until this offset of the playlist (0 for the end)")
+
+	flag.BoolVar(&a.ignoreStart, "ignore-start", false, "Start at the first segment even when the playlist has an EXT-X-START offset")
+
+	flag.BoolVar(&a.iframes, "iframes", false, "Download the I-frame only (trick play) variant of a master playlist")
+
+	flag.BoolVar(&a.skipAds, "skip-ads", false, "Leave the segments of detected ad breaks (CUE-OUT/CUE-IN, SCTE-35 DATERANGE) out of the output")
+
+	flag.BoolVar(&a.closedCaptions, "cc", false, "Extract the CEA-608 closed captions embedded in the video into a sidecar file (format set by -subs-format), CEA-708 is not supported")
+
+	flag.BoolVar(&a.timedMetadata, "id3", false, "Write the ID3 timed metadata of the stream into a <output>.id3.json sidecar file")
+	flag.BoolVar(&a.reportFile, "report", false, "Write a JSON report of the segments, their sizes, checksums, timings, retries and keys into a <output>.report.json sidecar file")
+
+	flag.StringVar(&a.userAgent, "user-agent", "", "User-Agent of the playlist, segment and key requests (default a desktop browser one)")
+	flag.StringVar(&a.basicAuth, "basic-auth", "", "Credentials (user:password) of the HTTP basic authentication of every request")
+	flag.StringVar(&a.digestAuth, "digest-auth", "", "Credentials (user:password) of the HTTP digest authentication of every request")
+	flag.StringVar(&a.proxy, "proxy", "", "Proxy of the requests (http://, https:// or socks5:// url), HTTP_PROXY and NO_PROXY are honored by default")
+	flag.BoolVar(&a.http3, "http3", false, "Request over HTTP/3 (QUIC), falling back to HTTP/1.1 and HTTP/2, needs a build registering an HTTP/3 transport")
+	flag.StringVar(&a.propagateQuery, "propagate-query", "", "Comma separated query parameters of the url (or * for all) added to every segment and key request")
+
+	flag.StringVar(&a.contentKeys, "key", "", "Comma separated KID:KEY hexadecimal content keys (or a single KEY) decrypting cenc/cbcs fragmented MP4 segments")
+
+	flag.BoolVar(&a.archive, "archive", false, "Store the segments as served (still encrypted) with their keys and a rewritten playlist instead of joining them")
+	flag.StringVar(&a.keepSegs, "keep-segments", "", "Directory the segments are kept in, as served, once joined into the output")
+
+	flag.StringVar(&a.keyFile, "key-file", "", "File holding the AES-128 key (raw or hexadecimal) used instead of fetching the key URIs")
+	flag.StringVar(&a.keystore, "keystore", "", "JSON file mapping key URIs to hexadecimal keys used instead of fetching them")
+	flag.BoolVar(&a.keepPadding, "no-unpad", false, "Keep the padding of the last block of AES-128 segments, for encoders that do not pad it")
+	flag.StringVar(&a.ivStrategy, "iv", "sequence", "IV of AES-128 segments without an IV attribute: sequence (media sequence number), zero or offset (position in the playlist)")
+
+	flag.BoolVar(&a.strict, "strict", false, "Fail on playlist syntax errors instead of skipping the invalid lines")
+	flag.DurationVar(&a.timeouts.Connect, "connect-timeout", 0, "Timeout of establishing a connection, e.g. 10s (0 for none)")
+	flag.DurationVar(&a.timeouts.ResponseHeader, "header-timeout", 0, "Timeout of waiting for the response headers of a request (0 for none)")
+	flag.DurationVar(&a.timeouts.Segment, "segment-timeout", 0, "Timeout of the whole download of a segment, which is retried when it expires (0 for none)")
+	flag.DurationVar(&a.timeouts.Stall, "stall-timeout", 0, "Retry a segment whose transfer receives no data for that long (0 for none)")
+	flag.IntVar(&a.transport.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0, "Idle connections kept per host (default the number of workers)")
+	flag.IntVar(&a.transport.MaxConnsPerHost, "max-conns-per-host", 0, "Maximum connections per host (0 for no limit)")
+	flag.BoolVar(&a.transport.ForceAttemptHTTP2, "force-http2", false, "Attempt HTTP/2 even with a custom dialer")
+	flag.DurationVar(&a.transport.KeepAlive, "keep-alive", 0, "Period of the TCP keep-alive probes of the connections (default 30s)")
+	flag.DurationVar(&a.transport.IdleConnTimeout, "idle-conn-timeout", 0, "Close the connections idle for that long (default 90s)")
+	flag.BoolVar(&a.transport.DisableKeepAlives, "no-keep-alive", false, "Use a new connection for every request")
+	flag.BoolVar(&a.tls.InsecureSkipVerify, "insecure", false, "Accept any TLS certificate and host name, for testing only")
+	flag.StringVar(&a.tls.CAFile, "ca-file", "", "PEM bundle of certificate authorities trusted in addition to the system ones")
+	flag.StringVar(&a.tls.CertFile, "cert", "", "PEM client certificate sent to the servers requiring mutual TLS, with -cert-key")
+	flag.StringVar(&a.tls.KeyFile, "cert-key", "", "PEM key of the client certificate of -cert")
+	flag.StringVar(&a.tlsMin, "tls-min", "", "Lowest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&a.resolve, "resolve", "", "Comma separated host:port:address entries connecting to address instead of resolving host, like curl (* as port for any)")
+	flag.StringVar(&a.dnsServer, "dns-server", "", "DNS server (ip or ip:port) resolving the host names instead of the system resolver")
+	flag.DurationVar(&a.dnsCache, "dns-cache", 0, "Keep the resolved addresses for that long (0 for no cache)")
+
+	flag.StringVar(&a.rateLimit, "rate-limit", "", "Maximum download rate in bytes per second shared by every worker, e.g. 500K or 2M")
+	flag.IntVar(&a.breakerThreshold, "breaker-threshold", 0, "Stop requesting a host for the breaker cooldown once this many requests in a row failed on it (0 for never)")
+	flag.DurationVar(&a.breakerCooldown, "breaker-cooldown", 30*time.Second, "How long a failing host is not requested")
+	flag.StringVar(&a.mirrors, "mirrors", "", "Comma separated base URLs serving the same segments, tried in turn for the segments failing on their own URL")
+	flag.BoolVar(&a.verifyTS, "verify-ts", false, "Download again the transport stream segments that are not made of whole packets starting with the sync byte")
+	flag.StringVar(&a.diskCheck, "disk-check", "warn", "What to do when the estimated size exceeds the free disk space: warn, refuse or off")
+	flag.StringVar(&a.memory, "memory", "", "Keep the segments in memory up to this size instead of a temp dir, e.g. 256M")
+	flag.StringVar(&a.memLimit, "memory-limit", "", "Bound the memory of the segments buffered, verified and decrypted, e.g. 64M")
+	flag.StringVar(&a.delay, "delay", "", "Delay of every worker between two segment requests, fixed (1s) or random within a range (500ms-2s)")
+
+	flag.StringVar(&a.overwrite, "overwrite", "rename", "What to do when the output already exists: rename (numbered name), error, overwrite or resume")
+	flag.BoolVar(&a.resume, "resume", false, "Save a checkpoint while downloading and resume an interrupted download of the same url and output")
+	flag.BoolVar(&a.keepPartial, "keep-partial", true, "Join the segments downloaded so far into the output when the download is aborted with Ctrl-C")
+	flag.StringVar(&a.stateFile, "state-file", "", "JSON file the progress of the download (segment status, sizes and key references) is written to")
+
 	helpCmd := flag.Bool("help", false, "Show this help menu with all the available options")
 	hCmd := flag.Bool("h", false, "Show help")
 
-	var debug bool
-	flag.BoolVar(&debug, "debug", false, "Enable debug logs")
-	if debug == false {
-		flag.BoolVar(&debug, "d", false, "Enable debug logs")
+	flag.BoolVar(&a.debug, "debug", false, "Enable debug logs")
+	if a.debug == false {
+		flag.BoolVar(&a.debug, "d", false, "Enable debug logs")
 	}
+	flag.StringVar(&a.logLevel, "log-level", "debug", "Lowest level of the logs enabled by -debug: debug, info, warn or error")
 
 	flag.Parse()
 
@@ -43,38 +249,589 @@ func handleArgs() (string, string, int, bool, error) {
 		os.Exit(0)
 	}
 
-	if URL == "" {
-		return "", "", 0, false, errors.New("No url specified")
+	if a.URL == "" {
+		return nil, errors.New("No url specified")
+	}
+	return a, nil
+}
+
+// showProgress renders the stats of the download on stderr every second until the returned
+// function is called
+func showProgress(stats func() HLSDownloader.Stats) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s := stats()
+				if s.Elapsed == 0 {
+					continue
+				}
+				eta := "--"
+				if s.ETA > 0 {
+					eta = s.ETA.Round(time.Second).String()
+				}
+				var busy float64
+				for _, w := range s.Workers {
+					busy += w
+				}
+				if len(s.Workers) > 0 {
+					busy /= float64(len(s.Workers))
+				}
+				fmt.Fprintf(os.Stderr, "\r%d/%d segments  %s  %s/s  workers %.0f%%  ETA %s\033[K",
+					s.Segments, s.TotalSegments, formatSize(float64(s.Bytes)), formatSize(s.Speed), busy*100, eta)
+			case <-done:
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// formatSize formats a number of bytes with a binary unit, e.g. 1.5 MiB
+func formatSize(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// formatEstimate formats the estimated size and duration of a download, e.g. ≈1.4 GiB, 42 min
+func formatEstimate(estimate HLSDownloader.SizeEstimate) string {
+	size := "unknown size"
+	if estimate.Bytes > 0 {
+		size = "≈" + formatSize(float64(estimate.Bytes))
+	}
+	minutes := int(estimate.Duration.Round(time.Minute) / time.Minute)
+	switch {
+	case estimate.Duration < time.Minute:
+		return fmt.Sprintf("%s, %d s", size, int(estimate.Duration.Round(time.Second)/time.Second))
+	case minutes < 60:
+		return fmt.Sprintf("%s, %d min", size, minutes)
+	}
+	return fmt.Sprintf("%s, %d h %d min", size, minutes/60, minutes%60)
+}
+
+// isTerminal reports whether the file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// parseResolve parses curl style host:port:address overrides, a * port applying to every port
+func parseResolve(s string) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected host:port:address", entry)
+		}
+		address := strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+		if parts[1] == "*" {
+			hosts[parts[0]] = address
+		} else {
+			hosts[net.JoinHostPort(parts[0], parts[1])] = address
+		}
+	}
+	return hosts, nil
+}
+
+// parseDelay parses a delay ("1s") or a range of delays ("500ms-2s")
+func parseDelay(s string) (time.Duration, time.Duration, error) {
+	low, high, isRange := strings.Cut(s, "-")
+	minDelay, err := time.ParseDuration(low)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return minDelay, minDelay, nil
+	}
+	maxDelay, err := time.ParseDuration(high)
+	if err != nil {
+		return 0, 0, err
 	}
-	return URL, output, workers, debug, nil
+	return minDelay, maxDelay, nil
 }
 
 func main() {
-	URL, output, workers, debug, err := handleArgs()
+	a, err := handleArgs()
 	if err != nil {
 		log.Printf("Invalid arguments: %v\n", err)
 		return
 	}
 
-	hls, err := HLSDownloader.New(URL, output)
-	if debug {
-		HLSDownloader.EnableLogs()
+	// "-" streams the output to stdout, the logs then go to stderr
+	stream := a.output == "-"
+	output := a.output
+	if stream {
+		output = filepath.Join(os.TempDir(), "stream.ts")
 	}
+	if a.debug {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+		log.SetOutput(os.Stdout)
+		if stream {
+			log.SetOutput(os.Stderr)
+		}
+	}
+	hls, err := HLSDownloader.New(a.URL, output)
 	if err != nil {
 		log.Printf("Error creating hlsDownloader: %v\n", err)
 		return
 	}
-	if workers > 0 {
-		err := hls.SetWorkers(workers)
+	if a.debug {
+		level, err := HLSDownloader.ParseLogLevel(a.logLevel)
+		if err != nil {
+			log.Printf("Invalid log level: %v\n", err)
+			return
+		}
+		err = hls.SetLogLevel(level)
+		if err != nil {
+			log.Printf("Error setting log level: %v\n", err)
+			return
+		}
+		hls.SetLogger(log.Default())
+	}
+	if a.baseURL != "" {
+		err := hls.SetBaseURL(a.baseURL)
+		if err != nil {
+			log.Printf("Error setting base url: %v\n", err)
+			return
+		}
+	}
+	if a.userAgent != "" {
+		err := hls.SetUserAgent(a.userAgent)
+		if err != nil {
+			log.Printf("Error setting user agent: %v\n", err)
+			return
+		}
+	}
+	if a.basicAuth != "" {
+		username, password, _ := strings.Cut(a.basicAuth, ":")
+		err := hls.SetBasicAuth(username, password)
+		if err != nil {
+			log.Printf("Error setting basic auth: %v\n", err)
+			return
+		}
+	}
+	if a.digestAuth != "" {
+		username, password, _ := strings.Cut(a.digestAuth, ":")
+		err := hls.SetDigestAuth(username, password)
+		if err != nil {
+			log.Printf("Error setting digest auth: %v\n", err)
+			return
+		}
+	}
+	if a.proxy != "" {
+		err := hls.SetProxy(a.proxy)
+		if err != nil {
+			log.Printf("Error setting proxy: %v\n", err)
+			return
+		}
+	}
+	if a.http3 {
+		if http3Transport == nil {
+			log.Printf("Error setting HTTP/3 transport: this build has no HTTP/3 transport registered\n")
+			return
+		}
+		err := hls.SetHTTP3Transport(http3Transport())
+		if err != nil {
+			log.Printf("Error setting HTTP/3 transport: %v\n", err)
+			return
+		}
+	}
+	if a.propagateQuery != "" {
+		hls.SetPropagateQuery(strings.Split(a.propagateQuery, ",")...)
+	}
+	if a.workers > 0 {
+		err := hls.SetWorkers(a.workers)
 		if err != nil {
 			log.Printf("Error setting workers: %v\n", err)
 			return
 		}
 	}
+	if a.readAhead > 0 {
+		err := hls.SetReadAhead(a.readAhead)
+		if err != nil {
+			log.Printf("Error setting read ahead: %v\n", err)
+			return
+		}
+	}
+
+	policy, err := HLSDownloader.ParseVariantPolicy(a.quality)
+	if err != nil {
+		log.Printf("Invalid quality: %v\n", err)
+		return
+	}
+	err = hls.SetVariantPolicy(policy)
+	if err != nil {
+		log.Printf("Error setting variant policy: %v\n", err)
+		return
+	}
+
+	if a.minHeight > 0 || a.maxHeight > 0 || a.maxBandwidth > 0 || a.codecs != "" {
+		criteria := HLSDownloader.VariantCriteria{
+			MinHeight:    a.minHeight,
+			MaxHeight:    a.maxHeight,
+			MaxBandwidth: uint32(a.maxBandwidth),
+		}
+		if a.codecs != "" {
+			criteria.Codecs = strings.Split(a.codecs, ",")
+		}
+		err = hls.SetVariantFilter(criteria.Match)
+		if err != nil {
+			log.Printf("Error setting variant filter: %v\n", err)
+			return
+		}
+	}
+
+	if a.allVariants {
+		hls.SetAllVariants(true)
+	}
+	if a.strict {
+		hls.SetLenientParsing(false)
+	}
+	if a.resume {
+		hls.SetResume(true)
+	}
+	if a.overwrite != "" {
+		policy, err := HLSDownloader.ParseOverwritePolicy(a.overwrite)
+		if err != nil {
+			log.Printf("Invalid overwrite policy: %v\n", err)
+			return
+		}
+		err = hls.SetOverwritePolicy(policy)
+		if err != nil {
+			log.Printf("Error setting overwrite policy: %v\n", err)
+			return
+		}
+	}
+	if a.rateLimit != "" {
+		rate, err := HLSDownloader.ParseRate(a.rateLimit)
+		if err != nil {
+			log.Printf("Invalid rate limit: %v\n", err)
+			return
+		}
+		err = hls.SetRateLimit(rate)
+		if err != nil {
+			log.Printf("Error setting rate limit: %v\n", err)
+			return
+		}
+	}
+	if a.verifyTS {
+		hls.SetVerifyTS(true)
+	}
+	if a.breakerThreshold > 0 {
+		err = hls.SetCircuitBreaker(a.breakerThreshold, a.breakerCooldown)
+		if err != nil {
+			log.Printf("Error setting circuit breaker: %v\n", err)
+			return
+		}
+	}
+	if a.mirrors != "" {
+		err = hls.SetMirrors(strings.Split(a.mirrors, ",")...)
+		if err != nil {
+			log.Printf("Error setting mirrors: %v\n", err)
+			return
+		}
+	}
+	diskCheck, err := HLSDownloader.ParseDiskSpaceCheck(a.diskCheck)
+	if err != nil {
+		log.Printf("Invalid disk check: %v\n", err)
+		return
+	}
+	err = hls.SetDiskSpaceCheck(diskCheck)
+	if err != nil {
+		log.Printf("Error setting disk check: %v\n", err)
+		return
+	}
+	if a.memory != "" {
+		limit, err := HLSDownloader.ParseSize(a.memory)
+		if err != nil {
+			log.Printf("Invalid memory buffer: %v\n", err)
+			return
+		}
+		err = hls.SetMemoryBuffer(limit)
+		if err != nil {
+			log.Printf("Error setting memory buffer: %v\n", err)
+			return
+		}
+	}
+	if a.memLimit != "" {
+		limit, err := HLSDownloader.ParseSize(a.memLimit)
+		if err != nil {
+			log.Printf("Invalid memory limit: %v\n", err)
+			return
+		}
+		err = hls.SetMemoryLimit(limit)
+		if err != nil {
+			log.Printf("Error setting memory limit: %v\n", err)
+			return
+		}
+	}
+	if a.delay != "" {
+		minDelay, maxDelay, err := parseDelay(a.delay)
+		if err != nil {
+			log.Printf("Invalid delay: %v\n", err)
+			return
+		}
+		err = hls.SetRequestDelay(minDelay, maxDelay)
+		if err != nil {
+			log.Printf("Error setting delay: %v\n", err)
+			return
+		}
+	}
+	err = hls.SetTimeouts(a.timeouts)
+	if err != nil {
+		log.Printf("Error setting timeouts: %v\n", err)
+		return
+	}
+	err = hls.SetTransportOptions(a.transport)
+	if err != nil {
+		log.Printf("Error setting transport options: %v\n", err)
+		return
+	}
+	if a.tlsMin != "" {
+		a.tls.MinVersion, err = HLSDownloader.ParseTLSVersion(a.tlsMin)
+		if err != nil {
+			log.Printf("Invalid tls version: %v\n", err)
+			return
+		}
+	}
+	err = hls.SetTLSOptions(a.tls)
+	if err != nil {
+		log.Printf("Error setting tls options: %v\n", err)
+		return
+	}
+	dns := HLSDownloader.DNSOptions{CacheTTL: a.dnsCache}
+	if a.resolve != "" {
+		dns.Hosts, err = parseResolve(a.resolve)
+		if err != nil {
+			log.Printf("Invalid resolve: %v\n", err)
+			return
+		}
+	}
+	if a.dnsServer != "" {
+		dns.Resolver = HLSDownloader.DNSServer(a.dnsServer)
+	}
+	err = hls.SetDNSOptions(dns)
+	if err != nil {
+		log.Printf("Error setting dns options: %v\n", err)
+		return
+	}
+	if a.keepPartial && !stream {
+		hls.SetKeepPartial(true)
+	}
+	if a.stateFile != "" {
+		hls.SetStateFile(a.stateFile)
+	}
+	if a.archive {
+		hls.SetArchive(true)
+	}
+	if a.keepSegs != "" {
+		hls.SetKeepSegments(a.keepSegs)
+	}
+	if a.keepPadding {
+		hls.SetUnpadding(false)
+	}
+	ivStrategy, err := HLSDownloader.ParseIVStrategy(a.ivStrategy)
+	if err != nil {
+		log.Printf("Invalid IV strategy: %v\n", err)
+		return
+	}
+	err = hls.SetIVStrategy(ivStrategy)
+	if err != nil {
+		log.Printf("Error setting IV strategy: %v\n", err)
+		return
+	}
+	if a.keyFile != "" {
+		err = hls.SetKeyFile(a.keyFile)
+		if err != nil {
+			log.Printf("Error setting key file: %v\n", err)
+			return
+		}
+	}
+	if a.keystore != "" {
+		err = hls.SetKeystore(a.keystore)
+		if err != nil {
+			log.Printf("Error setting keystore: %v\n", err)
+			return
+		}
+	}
+	if a.contentKeys != "" {
+		keys := make(map[string]string)
+		for _, pair := range strings.Split(a.contentKeys, ",") {
+			kid, key, found := strings.Cut(pair, ":")
+			if !found {
+				kid, key = "", pair
+			}
+			keys[kid] = key
+		}
+		err = hls.SetContentKeys(keys)
+		if err != nil {
+			log.Printf("Error setting content keys: %v\n", err)
+			return
+		}
+	}
+
+	err = hls.SetAlternateAudio(!a.noAudio)
+	if err != nil {
+		log.Printf("Error setting alternate audio: %v\n", err)
+		return
+	}
+	if a.muxAudio {
+		hls.SetMuxAudio(true)
+	}
+	err = hls.SetAudioLanguage(a.audioLanguage)
+	if err != nil {
+		log.Printf("Error setting audio language: %v\n", err)
+		return
+	}
+
+	if a.subtitles || a.closedCaptions {
+		format, err := HLSDownloader.ParseSubtitleFormat(a.subtitleFormat)
+		if err != nil {
+			log.Printf("Invalid subtitle format: %v\n", err)
+			return
+		}
+		hls.SetSubtitleFormat(format)
+	}
+	if a.subtitles {
+		hls.SetSubtitles(true)
+		hls.SetSubtitleLanguage(a.subtitleLanguage)
+	}
+	if a.closedCaptions {
+		hls.SetClosedCaptions(true)
+	}
+	if a.timedMetadata {
+		hls.SetTimedMetadata(true)
+	}
+	if a.reportFile {
+		hls.SetReportFile(true)
+	}
+
+	if a.live {
+		hls.SetLive(true)
+	}
+	if a.tolerateMissing {
+		hls.SetTolerateMissing(true)
+	}
+	if a.skipFailed {
+		hls.SetFailurePolicy(HLSDownloader.Skip)
+	}
+	if a.maxFailures > 0 {
+		err = hls.SetMaxConsecutiveFailures(a.maxFailures)
+		if err != nil {
+			log.Printf("Error setting max failures: %v\n", err)
+			return
+		}
+	}
+	if a.iframes {
+		hls.SetIFrames(true)
+	}
+	if a.skipAds {
+		hls.SetSkipAds(true)
+	}
+	if a.split {
+		hls.SetSplitOnDiscontinuity(true)
+	}
+	if a.ignoreStart {
+		hls.SetStartOffset(false)
+	}
+	if a.from != "" || a.to != "" {
+		var from, to time.Time
+		if a.from != "" {
+			from, err = time.Parse(time.RFC3339, a.from)
+			if err != nil {
+				log.Printf("Invalid from time: %v\n", err)
+				return
+			}
+		}
+		if a.to != "" {
+			to, err = time.Parse(time.RFC3339, a.to)
+			if err != nil {
+				log.Printf("Invalid to time: %v\n", err)
+				return
+			}
+		}
+		err = hls.SetTimeWindow(from, to)
+		if err != nil {
+			log.Printf("Error setting time window: %v\n", err)
+			return
+		}
+	}
+	if a.clipStart > 0 || a.clipEnd > 0 {
+		err = hls.SetClip(a.clipStart, a.clipEnd)
+		if err != nil {
+			log.Printf("Error setting clip: %v\n", err)
+			return
+		}
+	}
+	if a.info {
+		info, err := hls.Probe()
+		if err != nil {
+			log.Printf("Error probing playlist: %v\n", err)
+			return
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(info); err != nil {
+			log.Printf("Error writing playlist info: %v\n", err)
+		}
+		return
+	}
+	// Ctrl-C aborts the download, except that the live and EVENT playlists followed are stopped
+	// by the first one and aborted by a second one
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		if hls.Following() {
+			log.Printf("Stopping recording, press Ctrl-C again to abort...\n")
+			hls.Stop()
+			<-interrupt
+		}
+		signal.Stop(interrupt)
+		log.Printf("Aborting download...\n")
+		cancel()
+	}()
 
-	_, err = hls.Download()
+	// the speed and ETA are rendered on the terminal, unless the debug logs are written there
+	if !a.debug && isTerminal(os.Stderr) {
+		// the estimate comes first, so that the download can be aborted before it goes on
+		if estimate, err := hls.EstimateSizeContext(ctx); err == nil {
+			fmt.Fprintln(os.Stderr, formatEstimate(estimate))
+		}
+		stopProgress := showProgress(hls.Stats)
+		defer stopProgress()
+	}
+	var result HLSDownloader.Result
+	if stream {
+		err = hls.DownloadToContext(ctx, os.Stdout)
+	} else {
+		result, err = hls.DownloadContext(ctx)
+	}
+	if errors.Is(err, HLSDownloader.ErrInterrupted) && result.Output != "" {
+		log.Printf("Download aborted, the segments downloaded so far were joined into %s\n", result.Output)
+		return
+	}
 	if err != nil {
 		log.Printf("Error downloading file: %v\n", err)
 		return
 	}
+	if !stream {
+		log.Printf("Downloaded %d segments (%d bytes, %s at %.0f kbit/s) into %s in %s\n", result.Segments, result.Bytes, result.Duration, result.Bitrate/1000, result.Output, result.Elapsed.Round(time.Millisecond))
+	}
 }
@@ -0,0 +1,210 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// SkipAd is the reason of segments left out because they belong to an ad break
+const SkipAd = "ad"
+
+// AdBreak is an ad break signaled in a track playlist through EXT-X-CUE-OUT/EXT-X-CUE-IN
+// or an EXT-X-DATERANGE carrying SCTE35-OUT
+type AdBreak struct {
+	Track string
+	ID    string
+	From  uint64
+	To    uint64
+	// Duration is the signaled duration in seconds, 0 when unknown
+	Duration float64
+	Skipped  bool
+}
+
+type dateRange struct {
+	id       string
+	start    time.Time
+	end      time.Time
+	duration float64
+}
+
+// adBreaks holds the ad markers of a media playlist
+type adBreaks struct {
+	// cues maps the media sequence number of segments inside a CUE-OUT/CUE-IN span to its break
+	cues       map[uint64]string
+	durations  map[string]float64
+	dateRanges []*dateRange
+}
+
+func parseCueDuration(value string) float64 {
+	value = strings.TrimPrefix(value, "DURATION=")
+	d, _ := strconv.ParseFloat(value, 64)
+	return d
+}
+
+// parseAdBreaks scans the raw media playlist for EXT-X-CUE-OUT, EXT-X-CUE-OUT-CONT,
+// EXT-X-CUE-IN and EXT-X-DATERANGE tags
+func parseAdBreaks(data []byte, mediaSequence uint64) *adBreaks {
+	ads := &adBreaks{cues: make(map[uint64]string), durations: make(map[string]float64)}
+	dateRanges := make(map[string]*dateRange)
+	msn := mediaSequence
+	current := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-CUE-OUT-CONT"):
+			if current == "" {
+				// the playlist window starts inside the break
+				current = fmt.Sprintf("cue-%d", msn)
+			}
+			if _, value, ok := strings.Cut(line, ":"); ok {
+				for k, v := range m3u8.DecodeAttributeList(value) {
+					if k == "Duration" || k == "DURATION" {
+						ads.durations[current], _ = strconv.ParseFloat(v, 64)
+					}
+				}
+			}
+		case strings.HasPrefix(line, "#EXT-X-CUE-OUT"):
+			current = fmt.Sprintf("cue-%d", msn)
+			if _, value, ok := strings.Cut(line, ":"); ok {
+				ads.durations[current] = parseCueDuration(value)
+			}
+		case strings.HasPrefix(line, "#EXT-X-CUE-IN"):
+			current = ""
+		case strings.HasPrefix(line, "#EXT-X-DATERANGE:"):
+			parseDateRange(line[len("#EXT-X-DATERANGE:"):], dateRanges)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			if current != "" {
+				ads.cues[msn] = current
+			}
+			msn++
+		}
+	}
+	for _, r := range dateRanges {
+		if !r.start.IsZero() {
+			ads.dateRanges = append(ads.dateRanges, r)
+		}
+	}
+	return ads
+}
+
+// parseDateRange keeps the EXT-X-DATERANGE tags signaling an ad break with SCTE35-OUT,
+// a later tag with the same ID and SCTE35-IN closes the break
+func parseDateRange(value string, dateRanges map[string]*dateRange) {
+	attrs := m3u8.DecodeAttributeList(value)
+	id := attrs["ID"]
+	r, known := dateRanges[id]
+	_, out := attrs["SCTE35-OUT"]
+	_, in := attrs["SCTE35-IN"]
+	if !known && !out {
+		return
+	}
+	if !known {
+		r = &dateRange{id: id}
+		dateRanges[id] = r
+	}
+	if start, err := m3u8.TimeParse(attrs["START-DATE"]); err == nil && out {
+		r.start = start
+	}
+	if d, err := strconv.ParseFloat(attrs["DURATION"], 64); err == nil {
+		r.duration = d
+	} else if d, err := strconv.ParseFloat(attrs["PLANNED-DURATION"], 64); err == nil && r.duration == 0 {
+		r.duration = d
+	}
+	if end, err := m3u8.TimeParse(attrs["END-DATE"]); err == nil {
+		r.end = end
+	}
+	if in {
+		if start, err := m3u8.TimeParse(attrs["START-DATE"]); err == nil {
+			r.end = start
+		}
+	}
+	if r.end.IsZero() && r.duration > 0 && !r.start.IsZero() {
+		r.end = r.start.Add(seconds(r.duration))
+	}
+}
+
+// mark sets the ad break of every segment inside one, date ranges are matched
+// against the segments program date time
+func (ads *adBreaks) mark(segments []*segment) {
+	for _, segment := range segments {
+		if id, ok := ads.cues[segment.SeqId]; ok {
+			segment.adBreak = id
+			continue
+		}
+		if segment.ProgramDateTime.IsZero() {
+			continue
+		}
+		start := segment.ProgramDateTime
+		end := start.Add(seconds(segment.Duration))
+		for _, r := range ads.dateRanges {
+			// segments mostly inside the range belong to the break
+			middle := start.Add(end.Sub(start) / 2)
+			if !middle.Before(r.start) && (r.end.IsZero() || middle.Before(r.end)) {
+				segment.adBreak = r.id
+				break
+			}
+		}
+	}
+}
+
+func (ads *adBreaks) duration(id string) float64 {
+	if d, ok := ads.durations[id]; ok {
+		return d
+	}
+	for _, r := range ads.dateRanges {
+		if r.id == id {
+			return r.duration
+		}
+	}
+	return 0
+}
+
+// SetSkipAds leaves the segments of detected ad breaks out of the output,
+// the breaks are listed in the report either way
+func (h *hlsDownloader) SetSkipAds(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set skip ads on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.skipAds = enabled
+	return nil
+}
+
+func (h *hlsDownloader) skipAdSegments(segments []*segment) {
+	if !h.skipAds {
+		return
+	}
+	for _, segment := range segments {
+		if segment.adBreak != "" && segment.skipReason == "" {
+			segment.skipReason = SkipAd
+		}
+	}
+}
+
+func (h *hlsDownloader) recordAdBreak(t *track, segment *segment) {
+	if segment.adBreak == "" {
+		return
+	}
+	h.reportMu.Lock()
+	defer h.reportMu.Unlock()
+	h.adBreaks = append(h.adBreaks, AdBreak{
+		Track:    t.name,
+		ID:       segment.adBreak,
+		From:     segment.SeqId,
+		To:       segment.SeqId,
+		Duration: t.playlist.adBreaks.duration(segment.adBreak),
+		Skipped:  segment.skipReason == SkipAd,
+	})
+}
@@ -0,0 +1,234 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// archive is the directory a track is archived into and the media playlist referencing
+// the files stored there
+type archive struct {
+	dir      string
+	entries  strings.Builder
+	keys     map[string]string
+	maps     map[m3u8.Map]string
+	key      *m3u8.Key
+	initMap  *m3u8.Map
+	firstSeq uint64
+	started  bool
+	duration float64
+	version  int
+	// discontinuity is set once a segment is left out of the archive
+	discontinuity bool
+}
+
+// SetArchive stores the segments exactly as served, still encrypted, instead of joining them.
+// Every track is archived into a directory named after its output, along with its keys,
+// init segments and an index.m3u8 media playlist referencing them, which is the output.
+func (h *hlsDownloader) SetArchive(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set archive on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.archive = enabled
+	return nil
+}
+
+func newArchive(t *track) (*archive, error) {
+	dir := strings.TrimSuffix(t.output, filepath.Ext(t.output))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &archive{
+		dir:     dir,
+		keys:    make(map[string]string),
+		maps:    make(map[m3u8.Map]string),
+		version: 3,
+	}, nil
+}
+
+// archiveName names the file of a resource after its sequence, keeping the extension of its URI
+func archiveName(prefix string, n uint64, URI string, extension string) string {
+	if u, err := url.Parse(URI); err == nil && path.Ext(u.Path) != "" {
+		extension = path.Ext(u.Path)
+	}
+	return fmt.Sprintf("%s%d%s", prefix, n, extension)
+}
+
+// archiveKey stores the key of the segment and returns the URI of the key tag. Keys that
+// can not be fetched, e.g. skd:// keys of FairPlay streams, keep their URI.
+func (h *hlsDownloader) archiveKey(a *archive, segment *segment) (string, error) {
+	if name, ok := a.keys[segment.Key.URI]; ok {
+		return name, nil
+	}
+	u, err := url.Parse(segment.Key.URI)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && h.keyProvider == nil) {
+		a.keys[segment.Key.URI] = segment.Key.URI
+		return segment.Key.URI, nil
+	}
+	key, _, err := getKey(segment, h.keys)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("key%d.bin", len(a.keys))
+	if err := os.WriteFile(filepath.Join(a.dir, name), key, 0644); err != nil {
+		return "", err
+	}
+	a.keys[segment.Key.URI] = name
+	return name, nil
+}
+
+// archiveInit stores the init segment of the segment as served and returns its file name
+func (h *hlsDownloader) archiveInit(a *archive, segment *segment) (string, error) {
+	if name, ok := a.maps[*segment.Map]; ok {
+		return name, nil
+	}
+	data, err := fetchResource(h.ctx, segment.Map.URI, segment.Map.Limit, segment.Map.Offset, h.header, h.fetcher)
+	if err != nil {
+		return "", fmt.Errorf("failed to get init segment: %w", err)
+	}
+	name := archiveName("init", uint64(len(a.maps)), segment.Map.URI, ".mp4")
+	if err := os.WriteFile(filepath.Join(a.dir, name), data, 0644); err != nil {
+		return "", err
+	}
+	a.maps[*segment.Map] = name
+	return name, nil
+}
+
+func keyTag(key *m3u8.Key, URI string) string {
+	if key.Method == "NONE" {
+		return "#EXT-X-KEY:METHOD=NONE"
+	}
+	tag := fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=%q", key.Method, URI)
+	if key.IV != "" {
+		tag += ",IV=" + key.IV
+	}
+	if key.Keyformat != "" {
+		tag += fmt.Sprintf(",KEYFORMAT=%q", key.Keyformat)
+	}
+	if key.Keyformatversions != "" {
+		tag += fmt.Sprintf(",KEYFORMATVERSIONS=%q", key.Keyformatversions)
+	}
+	return tag
+}
+
+// archiveSegments moves the segments of the current batch into the archive of the track
+// and adds them to its playlist
+func (h *hlsDownloader) archiveSegments(t *track) error {
+	if t.archive == nil {
+		a, err := newArchive(t)
+		if err != nil {
+			return err
+		}
+		t.archive = a
+	}
+	a := t.archive
+
+	segments := t.segments
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].SeqId < segments[j].SeqId
+	})
+	for _, segment := range segments {
+		h.recordAdBreak(t, segment)
+		if segment.skipReason != "" {
+			h.recordSkipped(t, segment)
+			if err := h.reportSegment(t, segment); err != nil {
+				return err
+			}
+			a.discontinuity = true
+			continue
+		}
+		if !a.started {
+			a.firstSeq = segment.SeqId
+			a.started = true
+		}
+		if segment.Discontinuity || a.discontinuity {
+			a.entries.WriteString("#EXT-X-DISCONTINUITY\n")
+			a.discontinuity = false
+		}
+
+		key := segment.Key
+		if key == nil && a.key != nil {
+			key = &m3u8.Key{Method: "NONE"}
+		}
+		if key != nil && (a.key == nil || *key != *a.key) {
+			URI := ""
+			if key.Method != "NONE" {
+				var err error
+				if URI, err = h.archiveKey(a, segment); err != nil {
+					return err
+				}
+			}
+			if key.Keyformat != "" && a.version < 5 {
+				a.version = 5
+			}
+			a.entries.WriteString(keyTag(key, URI) + "\n")
+			a.key = key
+		}
+		if segment.isFMP4() && (a.initMap == nil || *a.initMap != *segment.Map) {
+			name, err := h.archiveInit(a, segment)
+			if err != nil {
+				return err
+			}
+			a.entries.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=%q\n", name))
+			a.initMap = segment.Map
+			a.version = 6
+		}
+		if !segment.ProgramDateTime.IsZero() {
+			a.entries.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + segment.ProgramDateTime.Format(time.RFC3339Nano) + "\n")
+		}
+
+		data, err := readSegment(segment)
+		if err != nil {
+			return err
+		}
+		if err := h.recordJoined(t, segment); err != nil {
+			return err
+		}
+		name := archiveName("", segment.SeqId, segment.URI, ".ts")
+		if err := os.WriteFile(filepath.Join(a.dir, name), data, 0644); err != nil {
+			return err
+		}
+		if err := h.releaseSegment(segment); err != nil {
+			return err
+		}
+		a.entries.WriteString(fmt.Sprintf("#EXTINF:%.3f,%s\n%s\n", segment.Duration, segment.Title, name))
+		if segment.Duration > a.duration {
+			a.duration = segment.Duration
+		}
+		t.written++
+	}
+	return nil
+}
+
+// writeArchivePlaylist writes the media playlist of the archive of the track
+func (h *hlsDownloader) writeArchivePlaylist(t *track) error {
+	a := t.archive
+	if a == nil {
+		return nil
+	}
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n",
+		a.version, int(math.Ceil(a.duration)), a.firstSeq)
+	playlist += a.entries.String() + "#EXT-X-ENDLIST\n"
+
+	output := filepath.Join(a.dir, "index.m3u8")
+	if err := os.WriteFile(output, []byte(playlist), 0644); err != nil {
+		return err
+	}
+	t.outputs = append(t.outputs, output)
+	h.log().infof("Archived %d segments into %s\n", t.written, a.dir)
+	return nil
+}
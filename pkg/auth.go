@@ -0,0 +1,266 @@
+package HLSDownloader
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// credentials authenticate the requests of a download, see SetBasicAuth and SetDigestAuth
+type credentials struct {
+	username string
+	password string
+	digest   bool
+}
+
+// SetBasicAuth authenticates every request with HTTP basic authentication, e.g. against a NAS,
+// an internal CDN or an IP camera. An Authorization header of SetHeader or of a request hook
+// takes precedence. An empty username removes the credentials.
+func (h *hlsDownloader) SetBasicAuth(username string, password string) error {
+	if h == nil {
+		return errors.New("attempt to set basic auth on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.auth = nil
+	if username != "" {
+		h.auth = &credentials{username: username, password: password}
+	}
+	return nil
+}
+
+// SetDigestAuth authenticates every request with HTTP digest authentication (RFC 7616, MD5 and
+// SHA-256): the requests answered with a digest challenge are sent again with the credentials,
+// the next ones reusing the challenge until the server renews it. An empty username removes
+// the credentials.
+func (h *hlsDownloader) SetDigestAuth(username string, password string) error {
+	if h == nil {
+		return errors.New("attempt to set digest auth on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.auth = nil
+	if username != "" {
+		h.auth = &credentials{username: username, password: password, digest: true}
+	}
+	return nil
+}
+
+// withAuth returns fetcher authenticating the requests with the credentials of the download
+func (h *hlsDownloader) withAuth(fetcher Fetcher) Fetcher {
+	if h.auth == nil {
+		return fetcher
+	}
+	return &authFetcher{fetcher: fetcher, credentials: *h.auth}
+}
+
+type authFetcher struct {
+	fetcher     Fetcher
+	credentials credentials
+
+	// mu guards the last digest challenge and how many requests answered it
+	mu        sync.Mutex
+	challenge *digestChallenge
+	count     int
+}
+
+func (f *authFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return f.fetcher.Do(ctx, req)
+	}
+	cloneRequestHeader(req)
+	if !f.credentials.digest {
+		req.SetBasicAuth(f.credentials.username, f.credentials.password)
+		return f.fetcher.Do(ctx, req)
+	}
+
+	used, err := f.authorize(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.fetcher.Do(ctx, req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := parseDigestChallenge(resp.Header.Values("WWW-Authenticate"))
+	// the credentials are rejected when the challenge they answered is still the same
+	if challenge == nil || (used != nil && used.nonce == challenge.nonce && !challenge.stale) {
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	f.mu.Lock()
+	f.challenge, f.count = challenge, 0
+	f.mu.Unlock()
+	if _, err := f.authorize(req); err != nil {
+		return nil, err
+	}
+	return f.fetcher.Do(ctx, req)
+}
+
+// authorize sets the Authorization header of the request answering the last digest challenge,
+// which it returns, nil before the first one
+func (f *authFetcher) authorize(req *http.Request) (*digestChallenge, error) {
+	f.mu.Lock()
+	challenge := f.challenge
+	f.count++
+	count := f.count
+	f.mu.Unlock()
+	if challenge == nil {
+		return nil, nil
+	}
+	authorization, err := challenge.authorization(f.credentials, req.Method, req.URL.RequestURI(), count)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	return challenge, nil
+}
+
+// digestChallenge is the WWW-Authenticate header of a digest authentication
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	stale     bool
+}
+
+// parseDigestChallenge returns the first digest challenge of the WWW-Authenticate headers
+func parseDigestChallenge(headers []string) *digestChallenge {
+	for _, header := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		c := &digestChallenge{}
+		for key, value := range parseAuthParams(params) {
+			switch key {
+			case "realm":
+				c.realm = value
+			case "nonce":
+				c.nonce = value
+			case "opaque":
+				c.opaque = value
+			case "algorithm":
+				c.algorithm = value
+			case "stale":
+				c.stale = strings.EqualFold(value, "true")
+			case "qop":
+				// only the auth quality of protection is supported, auth-int hashes the body
+				for _, qop := range strings.Split(value, ",") {
+					if strings.TrimSpace(qop) == "auth" {
+						c.qop = "auth"
+					}
+				}
+			}
+		}
+		return c
+	}
+	return nil
+}
+
+// parseAuthParams parses the comma separated key=value parameters of a challenge, the values
+// being tokens or quoted strings
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			token, next, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(token))
+			s = next
+		}
+		params[key] = value.String()
+	}
+}
+
+// authorization returns the Authorization header of the request answering the challenge, count
+// being how many requests answered it so far
+func (c *digestChallenge) authorization(cred credentials, method string, uri string, count int) (string, error) {
+	var newHash func() hash.Hash
+	algorithm := strings.ToUpper(c.algorithm)
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", c.algorithm)
+	}
+	digest := func(parts ...string) string {
+		h := newHash()
+		io.WriteString(h, strings.Join(parts, ":"))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b)
+	nc := fmt.Sprintf("%08x", count)
+	ha1 := digest(cred.username, c.realm, cred.password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = digest(ha1, c.nonce, cnonce)
+	}
+	ha2 := digest(method, uri)
+	var response string
+	if c.qop != "" {
+		response = digest(ha1, c.nonce, nc, cnonce, c.qop, ha2)
+	} else {
+		response = digest(ha1, c.nonce, ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, cred.username),
+		fmt.Sprintf(`realm="%s"`, c.realm),
+		fmt.Sprintf(`nonce="%s"`, c.nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if c.algorithm != "" {
+		fields = append(fields, "algorithm="+c.algorithm)
+	}
+	if c.qop != "" {
+		fields = append(fields, "qop="+c.qop, "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if c.opaque != "" {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, c.opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
@@ -0,0 +1,148 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SetCircuitBreaker stops sending requests to a host for cooldown once threshold requests in a row
+// failed on it (server errors, timeouts, connection failures). Meanwhile its segments are moved to
+// the mirrors, see SetMirrors, or wait for the cooldown to end, when a single request is let through
+// to probe the host. A zero threshold disables it.
+func (h *hlsDownloader) SetCircuitBreaker(threshold int, cooldown time.Duration) error {
+	if h == nil {
+		return errors.New("attempt to set circuit breaker on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if threshold < 0 || cooldown < 0 {
+		return errors.New("circuit breaker threshold and cooldown must not be negative")
+	}
+	if threshold > 0 && cooldown == 0 {
+		return errors.New("circuit breaker cooldown must be set")
+	}
+	h.breakerThreshold = threshold
+	h.breakerCooldown = cooldown
+	return nil
+}
+
+// circuitBreaker tracks the consecutive failures of the hosts of a download
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*hostCircuit
+	log       levelLogger
+}
+
+type hostCircuit struct {
+	failures  int
+	openUntil time.Time
+	// probing is set while the single request probing a host after its cooldown is running
+	probing bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, log levelLogger) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, hosts: make(map[string]*hostCircuit), log: log}
+}
+
+// openFor returns how long the host is still closed to requests, zero when a request can be sent
+func (b *circuitBreaker) openFor(host string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil || c.failures < b.threshold {
+		return 0
+	}
+	if wait := time.Until(c.openUntil); wait > 0 {
+		return wait
+	}
+	if c.probing {
+		// the other requests wait for the probe, a second at a time
+		return time.Second
+	}
+	c.probing = true
+	return 0
+}
+
+// record counts a failure of the host, or closes its circuit again after a success
+func (b *circuitBreaker) record(host string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil {
+		c = &hostCircuit{}
+		b.hosts[host] = c
+	}
+	probe := c.probing
+	c.probing = false
+	if err == nil || !hostFailure(err) {
+		if c.failures >= b.threshold {
+			b.log.debugf("Host %s answers again, closing its circuit\n", host)
+		}
+		c.failures = 0
+		return
+	}
+	c.failures++
+	// the requests failing while the circuit is open do not extend it, a failed probe does
+	if c.failures == b.threshold || (probe && c.failures > b.threshold) {
+		c.openUntil = time.Now().Add(b.cooldown)
+		b.log.warnf("Host %s failed %d requests in a row, opening its circuit for %s\n", host, c.failures, b.cooldown)
+	}
+}
+
+// hostFailure reports whether an error tells about the health of the host rather than about the
+// segment, e.g. a server error, a timeout or a connection failure, but not a missing segment
+func hostFailure(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return isRetryable(err) || errors.As(err, &dnsErr) || errors.As(err, &opErr)
+}
+
+// segmentHost returns the host the segment is downloaded from, empty for data URIs
+func (h *hlsDownloader) segmentHost(t *track, segment *segment) string {
+	if isDataURI(segment.URI) {
+		return ""
+	}
+	u, err := url.Parse(h.segmentURL(t, segment))
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// waitCircuit holds a segment whose host has an open circuit, moving it to the next mirror when
+// there is one. It returns false when the download is aborted meanwhile.
+func (h *hlsDownloader) waitCircuit(wc *workerController, segment *segment) bool {
+	for {
+		host := h.segmentHost(wc.track, segment)
+		wait := h.breaker.openFor(host)
+		if host == "" || wait <= 0 {
+			return true
+		}
+		if h.nextMirror(segment) {
+			h.log().debugf("Circuit of %s is open, trying %s for segment %d\n", host, h.segmentURL(wc.track, segment), segment.SeqId)
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-wc.abort:
+			return false
+		}
+	}
+}
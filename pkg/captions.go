@@ -0,0 +1,478 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// captionData is the CEA-608 field 1 byte pairs carried by one video access unit, dtvcc tells
+// whether it also carries CEA-708 packets
+type captionData struct {
+	pts   int64
+	pairs [][2]byte
+	dtvcc bool
+}
+
+// SetClosedCaptions extracts the CEA-608 closed captions embedded in the video
+// of transport stream outputs into a <output>.cc sidecar, written in the subtitle format.
+// Only the CC1 channel of CEA-608 field 1 is decoded: CEA-708 (DTVCC) captions are not, the
+// outputs carrying them are listed by Report, and a stream with no CEA-608 compatibility bytes
+// gets no sidecar.
+func (h *hlsDownloader) SetClosedCaptions(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set closed captions on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.closedCaptions = enabled
+	return nil
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// nalUnits splits an Annex B byte stream on its start codes
+func nalUnits(data []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			units = append(units, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+// seiCaptions returns the CEA-608 cc_data of the ATSC A/53 user data SEI messages of a NAL unit,
+// dtvcc tells whether they also carry CEA-708 packets
+func seiCaptions(nal []byte, hevc bool) (pairs [][2]byte, dtvcc bool) {
+	header := 1
+	if hevc {
+		header = 2
+		if len(nal) < 2 || (nal[0]>>1)&0x3F != 39 {
+			return nil, false
+		}
+	} else if len(nal) < 1 || nal[0]&0x1F != 6 {
+		return nil, false
+	}
+	sei := unescapeRBSP(nal[header:])
+
+	for i := 0; i < len(sei) && sei[i] != 0x80; {
+		payloadType := 0
+		for i < len(sei) && sei[i] == 0xFF {
+			payloadType += 255
+			i++
+		}
+		if i >= len(sei) {
+			break
+		}
+		payloadType += int(sei[i])
+		i++
+		payloadSize := 0
+		for i < len(sei) && sei[i] == 0xFF {
+			payloadSize += 255
+			i++
+		}
+		if i >= len(sei) {
+			break
+		}
+		payloadSize += int(sei[i])
+		i++
+		if i+payloadSize > len(sei) {
+			break
+		}
+		if payloadType == 4 {
+			user, user708 := userDataCaptions(sei[i : i+payloadSize])
+			pairs = append(pairs, user...)
+			dtvcc = dtvcc || user708
+		}
+		i += payloadSize
+	}
+	return pairs, dtvcc
+}
+
+// userDataCaptions parses a registered ITU-T T.35 payload carrying GA94 cc_data, dtvcc tells
+// whether it carries CEA-708 packets, which are skipped
+func userDataCaptions(p []byte) (pairs [][2]byte, dtvcc bool) {
+	if len(p) < 10 || p[0] != 0xB5 || p[1] != 0x00 || p[2] != 0x31 || string(p[3:7]) != "GA94" || p[7] != 0x03 {
+		return nil, false
+	}
+	if p[8]&0x40 == 0 {
+		return nil, false
+	}
+	count := int(p[8] & 0x1F)
+	for i := 0; i < count && 10+i*3+2 < len(p); i++ {
+		b := p[10+i*3:]
+		valid := b[0]&0x04 != 0
+		ccType := b[0] & 0x03
+		// field 1 carries CC1 and CC2
+		if valid && ccType == 0 {
+			pairs = append(pairs, [2]byte{b[1] & 0x7F, b[2] & 0x7F})
+		}
+		// DTVCC packet data and start
+		if valid && ccType >= 2 {
+			dtvcc = true
+		}
+	}
+	return pairs, dtvcc
+}
+
+// readCaptions collects the caption data of the video stream of a transport stream file
+func readCaptions(path string) ([]captionData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var captions []captionData
+	isVideo := func(streamType byte) bool {
+		return streamType == streamTypeH264 || streamType == streamTypeHEVC
+	}
+	err = demuxTS(file, isVideo, func(pes *pesPacket) error {
+		if !pes.hasPTS {
+			return nil
+		}
+		data := captionData{pts: pes.pts}
+		for _, nal := range nalUnits(pes.data) {
+			pairs, dtvcc := seiCaptions(nal, pes.streamType == streamTypeHEVC)
+			data.pairs = append(data.pairs, pairs...)
+			data.dtvcc = data.dtvcc || dtvcc
+		}
+		captions = append(captions, data)
+		return nil
+	})
+	// pictures are decoded out of presentation order when there are B-frames
+	sort.SliceStable(captions, func(i, j int) bool {
+		return captions[i].pts < captions[j].pts
+	})
+	return captions, err
+}
+
+var cea608Basic = map[byte]rune{
+	0x2A: 'á', 0x5C: 'é', 0x5E: 'í', 0x5F: 'ó', 0x60: 'ú',
+	0x7B: 'ç', 0x7C: '÷', 0x7D: 'Ñ', 0x7E: 'ñ', 0x7F: '█',
+}
+
+const cea608Special = "®°½¿™¢£♪à èâêîôû"
+const cea608Extended1 = "ÁÉÓÚÜü‘¡*'─©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"
+const cea608Extended2 = "ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘"
+
+// pacRows maps the first byte of a preamble address code to its two rows
+var pacRows = map[byte][2]int{
+	0x11: {1, 2}, 0x12: {3, 4}, 0x15: {5, 6}, 0x16: {7, 8},
+	0x17: {9, 10}, 0x10: {11, 11}, 0x13: {12, 13}, 0x14: {14, 15},
+}
+
+type captionMode int
+
+const (
+	popOn captionMode = iota
+	rollUp
+	paintOn
+)
+
+// cea608Decoder turns the CC1 channel of CEA-608 byte pairs into cues
+type cea608Decoder struct {
+	mode         captionMode
+	rollUpRows   int
+	row          int
+	displayed    map[int][]rune
+	nonDisplayed map[int][]rune
+	channel      int
+	lastControl  [2]byte
+
+	text  string
+	start int64
+	cues  []vttCue
+	base  int64
+}
+
+func newCEA608Decoder(base int64) *cea608Decoder {
+	return &cea608Decoder{
+		displayed:    make(map[int][]rune),
+		nonDisplayed: make(map[int][]rune),
+		row:          15,
+		channel:      1,
+		base:         base,
+	}
+}
+
+func (d *cea608Decoder) timestamp(pts int64) time.Duration {
+	return time.Duration(pts-d.base) * time.Second / mpegtsClock
+}
+
+// memory is where characters are written in the current mode
+func (d *cea608Decoder) memory() map[int][]rune {
+	if d.mode == popOn {
+		return d.nonDisplayed
+	}
+	return d.displayed
+}
+
+func screenText(memory map[int][]rune) string {
+	rows := make([]int, 0, len(memory))
+	for row := range memory {
+		rows = append(rows, row)
+	}
+	sort.Ints(rows)
+	var lines []string
+	for _, row := range rows {
+		if line := strings.TrimSpace(string(memory[row])); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// show ends the cue on screen and starts a new one when the displayed text changes
+func (d *cea608Decoder) show(pts int64) {
+	text := screenText(d.displayed)
+	if text == d.text {
+		return
+	}
+	if d.text != "" && pts > d.start {
+		d.cues = append(d.cues, vttCue{start: d.timestamp(d.start), end: d.timestamp(pts), text: d.text})
+	}
+	d.text = text
+	d.start = pts
+}
+
+func (d *cea608Decoder) write(r rune) {
+	memory := d.memory()
+	memory[d.row] = append(memory[d.row], r)
+}
+
+func (d *cea608Decoder) backspace() {
+	memory := d.memory()
+	if line := memory[d.row]; len(line) > 0 {
+		memory[d.row] = line[:len(line)-1]
+	}
+}
+
+func (d *cea608Decoder) carriageReturn() {
+	for row := range d.displayed {
+		if row <= d.row-d.rollUpRows+1 {
+			delete(d.displayed, row)
+		}
+	}
+	shifted := make(map[int][]rune)
+	for row, line := range d.displayed {
+		shifted[row-1] = line
+	}
+	d.displayed = shifted
+}
+
+func (d *cea608Decoder) control(b2 byte, pts int64) {
+	switch b2 {
+	case 0x20: // resume caption loading
+		d.mode = popOn
+	case 0x21: // backspace
+		d.backspace()
+	case 0x25, 0x26, 0x27: // roll-up captions
+		if d.mode != rollUp {
+			d.displayed = make(map[int][]rune)
+			d.nonDisplayed = make(map[int][]rune)
+		}
+		d.mode = rollUp
+		d.rollUpRows = int(b2-0x25) + 2
+	case 0x29: // resume direct captioning
+		d.mode = paintOn
+	case 0x2C: // erase displayed memory
+		d.displayed = make(map[int][]rune)
+	case 0x2D: // carriage return
+		if d.mode == rollUp {
+			d.carriageReturn()
+		}
+	case 0x2E: // erase non-displayed memory
+		d.nonDisplayed = make(map[int][]rune)
+	case 0x2F: // end of caption
+		d.displayed, d.nonDisplayed = d.nonDisplayed, d.displayed
+	}
+	d.show(pts)
+}
+
+// decode processes one byte pair of the CC1/CC2 data
+func (d *cea608Decoder) decode(pair [2]byte, pts int64) {
+	b1, b2 := pair[0], pair[1]
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+	if b1 >= 0x10 && b1 <= 0x1F {
+		// control codes are usually sent twice
+		if pair == d.lastControl {
+			d.lastControl = [2]byte{}
+			return
+		}
+		d.lastControl = pair
+		d.channel = 1
+		if b1 >= 0x18 {
+			d.channel = 2
+			b1 -= 0x08
+		}
+		if d.channel != 1 {
+			return
+		}
+		switch {
+		case b1 == 0x14 && b2 >= 0x20 && b2 <= 0x2F:
+			d.control(b2, pts)
+		case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3F:
+			d.write([]rune(cea608Special)[b2-0x30])
+		case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2F:
+			// mid-row codes are displayed as a space
+			d.write(' ')
+		case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3F:
+			// extended characters replace the basic character sent before them
+			table := cea608Extended1
+			if b1 == 0x13 {
+				table = cea608Extended2
+			}
+			d.backspace()
+			d.write([]rune(table)[b2-0x20])
+		case b2 >= 0x40 && b2 <= 0x7F:
+			rows, ok := pacRows[b1]
+			if !ok {
+				return
+			}
+			row := rows[(b2&0x20)>>5]
+			if d.mode == rollUp {
+				// the base row of roll-up captions moves the whole window
+				if row != d.row {
+					d.displayed = make(map[int][]rune)
+				}
+			} else if line := d.memory()[row]; len(line) > 0 {
+				d.memory()[row] = append(line, ' ')
+			}
+			d.row = row
+			if d.mode == paintOn {
+				d.show(pts)
+			}
+		}
+		return
+	}
+	d.lastControl = [2]byte{}
+	if d.channel != 1 {
+		return
+	}
+	for _, b := range []byte{b1, b2} {
+		if b < 0x20 {
+			continue
+		}
+		if r, ok := cea608Basic[b]; ok {
+			d.write(r)
+		} else {
+			d.write(rune(b))
+		}
+	}
+}
+
+// decodeCaptions decodes the CC1 captions of a stream into cues relative to its first picture
+func decodeCaptions(captions []captionData) []vttCue {
+	if len(captions) == 0 {
+		return nil
+	}
+	d := newCEA608Decoder(captions[0].pts)
+	for _, c := range captions {
+		for _, pair := range c.pairs {
+			d.decode(pair, c.pts)
+		}
+	}
+	d.displayed = make(map[int][]rune)
+	d.show(captions[len(captions)-1].pts)
+	return d.cues
+}
+
+// hasDTVCC reports whether CEA-708 packets are carried along with the captions
+func hasDTVCC(captions []captionData) bool {
+	for _, c := range captions {
+		if c.dtvcc {
+			return true
+		}
+	}
+	return false
+}
+
+// extractClosedCaptions writes the closed captions of every output of the track
+// into a sidecar next to it and returns the sidecars
+func (h *hlsDownloader) extractClosedCaptions(t *track) ([]string, error) {
+	var sidecars []string
+	for _, output := range t.outputs {
+		captions, err := readCaptions(output)
+		if errors.Is(err, errNotTransportStream) {
+			h.log().warnf("Closed captions can only be extracted from transport streams, skipping %s\n", output)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cues := decodeCaptions(captions)
+		if hasDTVCC(captions) {
+			h.reportMu.Lock()
+			h.cea708 = append(h.cea708, output)
+			h.reportMu.Unlock()
+			if len(cues) == 0 {
+				h.log().warnf("Closed captions of %s are CEA-708 only, which is not supported\n", output)
+				continue
+			}
+			h.log().warnf("CEA-708 closed captions of %s are not supported, extracting their CEA-608 captions only\n", output)
+		}
+		if len(cues) == 0 {
+			h.log().infof("No closed captions found in %s\n", output)
+			continue
+		}
+
+		path, err := h.sidecarPath(output, ".cc", h.subtitleFormat.extension())
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w := bufio.NewWriter(file)
+		if h.subtitleFormat == SRT {
+			writeSRT(w, cues)
+		} else {
+			writeVTT(w, nil, cues)
+		}
+		err = w.Flush()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		h.log().infof("Extracted %d closed caption cues into %s", len(cues), path)
+		sidecars = append(sidecars, path)
+	}
+	return sidecars, nil
+}
@@ -0,0 +1,105 @@
+package HLSDownloader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// cbcChunkSize is the size of the chunks segments are decrypted in, a multiple of the block size
+const cbcChunkSize = 64 * 1024
+
+// cbcReader decrypts AES-128 CBC data as it is read, in chunks. The last block is held
+// back until the data ends so its padding can be removed.
+type cbcReader struct {
+	src   io.Reader
+	mode  cipher.BlockMode
+	unpad bool
+	log   levelLogger
+	chunk *[]byte
+	buf   []byte
+	// pending is the data read but not decrypted yet, out the data decrypted but not read yet
+	pending []byte
+	out     []byte
+	read    int64
+	eof     bool
+}
+
+func newCBCReader(src io.Reader, key, iv []byte, unpad bool, log levelLogger) (*cbcReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid IV length %d", len(iv))
+	}
+	chunk := getChunk()
+	return &cbcReader{
+		src:   src,
+		mode:  cipher.NewCBCDecrypter(block, iv),
+		unpad: unpad,
+		log:   log,
+		chunk: chunk,
+		buf:   *chunk,
+	}, nil
+}
+
+// release returns the chunk buffer to the pool, the reader is not used afterwards
+func (r *cbcReader) release() {
+	if r.chunk != nil {
+		putChunk(r.chunk)
+		r.chunk, r.buf, r.out, r.pending = nil, nil, nil, nil
+	}
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads the next chunk and decrypts its whole blocks
+func (r *cbcReader) fill() error {
+	n := copy(r.buf, r.pending)
+	m, err := io.ReadFull(r.src, r.buf[n:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.eof = true
+	} else if err != nil {
+		return err
+	}
+	r.read += int64(m)
+	data := r.buf[:n+m]
+
+	if r.eof {
+		if r.read == 0 || len(data)%aes.BlockSize != 0 {
+			return fmt.Errorf("encrypted data length %d is not a multiple of the block size", r.read)
+		}
+		r.mode.CryptBlocks(data, data)
+		if r.unpad {
+			data = pkcs7UnPadding(data, r.log)
+		}
+		r.out, r.pending = data, nil
+		return nil
+	}
+
+	ready := len(data) / aes.BlockSize * aes.BlockSize
+	if ready == len(data) {
+		ready -= aes.BlockSize
+	}
+	if ready <= 0 {
+		return errors.New("chunk smaller than two blocks")
+	}
+	r.mode.CryptBlocks(data[:ready], data[:ready])
+	r.out, r.pending = data[:ready], data[ready:]
+	return nil
+}
@@ -0,0 +1,509 @@
+package HLSDownloader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// protection schemes of the schm box
+const (
+	schemeCENC = "cenc"
+	schemeCBC1 = "cbc1"
+	schemeCBCS = "cbcs"
+)
+
+// piffSampleEncryption is the user type of the PIFF uuid box laid out like senc
+var piffSampleEncryption = []byte{0xA2, 0x39, 0x4F, 0x52, 0x5A, 0x9B, 0x4F, 0x14, 0xA2, 0x44, 0x6C, 0x42, 0x7C, 0x64, 0x8D, 0xF4}
+
+// trackProtection is the protection of a track, declared by the tenc box of its init segment
+type trackProtection struct {
+	scheme      string
+	key         []byte
+	ivSize      int
+	constantIV  []byte
+	cryptBlocks int
+	skipBlocks  int
+}
+
+// cencDecrypter decrypts the samples of the fragments of the encrypted tracks of an init segment
+type cencDecrypter struct {
+	tracks map[uint32]*trackProtection
+}
+
+type subsample struct {
+	clear     int
+	protected int
+}
+
+// SetContentKeys sets the content keys of fragmented MP4 segments encrypted with the cenc, cbc1
+// or cbcs schemes, as hexadecimal strings by hexadecimal key ID. The key of the empty key ID is
+// used for the tracks whose key ID has no key. The encryption is removed from the init segments
+// so the output plays without the keys.
+func (h *hlsDownloader) SetContentKeys(keys map[string]string) error {
+	if h == nil {
+		return errors.New("attempt to set content keys on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	contentKeys := make(map[string][]byte)
+	for kid, key := range keys {
+		kid = strings.ToLower(strings.ReplaceAll(kid, "-", ""))
+		if b, err := hex.DecodeString(kid); err != nil || (kid != "" && len(b) != 16) {
+			return fmt.Errorf("invalid key ID %q", kid)
+		}
+		k, err := hex.DecodeString(key)
+		if err != nil || len(k) != 16 {
+			return fmt.Errorf("invalid content key of key ID %q", kid)
+		}
+		contentKeys[kid] = k
+	}
+	h.contentKeys = contentKeys
+	return nil
+}
+
+// rebuildBox rebuilds a box held in memory out of its fields, the extra bytes between its header
+// and its first child, and its children passed through fn, which drops a child by returning nil
+func rebuildBox(box []byte, header int64, extra int64, fn func(child mp4Box, data []byte) ([]byte, error)) ([]byte, error) {
+	if header+extra > int64(len(box)) {
+		return nil, fmt.Errorf("invalid %q box", box[4:8])
+	}
+	children, err := childBoxes(box, header+extra)
+	if err != nil {
+		return nil, err
+	}
+	payload := append([]byte(nil), box[header:header+extra]...)
+	for _, child := range children {
+		data, err := fn(child, box[child.offset:child.offset+child.size])
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, data...)
+	}
+	return append(boxHeader(string(box[4:8]), len(payload)), payload...), nil
+}
+
+// rebuildPath rebuilds the boxes along path down from box, the children of the last box
+// of the path are passed through fn
+func rebuildPath(box []byte, header int64, path []string, fn func(child mp4Box, data []byte) ([]byte, error)) ([]byte, error) {
+	if len(path) == 0 {
+		extra := int64(0)
+		if string(box[4:8]) == "stsd" {
+			// version, flags and entry count
+			extra = 8
+		}
+		return rebuildBox(box, header, extra, fn)
+	}
+	return rebuildBox(box, header, 0, func(child mp4Box, data []byte) ([]byte, error) {
+		if child.boxType != path[0] {
+			return data, nil
+		}
+		return rebuildPath(data, child.header, path[1:], fn)
+	})
+}
+
+// sampleEntryFields returns the size of the fields of a sample entry preceding its child boxes
+func sampleEntryFields(entry []byte, header int64) (int64, error) {
+	switch string(entry[4:8]) {
+	case "encv":
+		return 78, nil
+	case "enca":
+		if int64(len(entry)) < header+10 {
+			return 0, errors.New("invalid enca box")
+		}
+		switch binary.BigEndian.Uint16(entry[header+8:]) {
+		case 1:
+			return 44, nil
+		case 2:
+			return 64, nil
+		}
+		return 28, nil
+	}
+	return 0, fmt.Errorf("unsupported %q sample entry", entry[4:8])
+}
+
+// parseProtection reads the protection scheme of the sinf box of an encrypted sample entry
+func parseProtection(sinf []byte, keys map[string][]byte) (string, *trackProtection, error) {
+	frma, err := findBox(sinf, 8, "frma")
+	if err != nil || len(frma) < 12 {
+		return "", nil, errors.New("invalid frma box")
+	}
+	schm, err := findBox(sinf, 8, "schm")
+	if err != nil || len(schm) < 16 {
+		return "", nil, errors.New("invalid schm box")
+	}
+	tenc, err := findBox(sinf, 8, "schi", "tenc")
+	if err != nil || len(tenc) < 32 {
+		return "", nil, errors.New("invalid tenc box")
+	}
+
+	p := &trackProtection{scheme: string(schm[12:16]), ivSize: int(tenc[15])}
+	switch p.scheme {
+	case schemeCENC, schemeCBC1, schemeCBCS:
+	default:
+		return "", nil, fmt.Errorf("unsupported protection scheme %q", p.scheme)
+	}
+	if tenc[8] > 0 {
+		p.cryptBlocks, p.skipBlocks = int(tenc[13]>>4), int(tenc[13]&0x0F)
+	}
+	if p.scheme != schemeCBCS && p.skipBlocks > 0 {
+		return "", nil, fmt.Errorf("pattern encryption of the %q scheme is not supported", p.scheme)
+	}
+	if tenc[14] == 1 && p.ivSize == 0 {
+		if len(tenc) < 33 || len(tenc) < 33+int(tenc[32]) {
+			return "", nil, errors.New("invalid tenc box")
+		}
+		p.constantIV = tenc[33 : 33+int(tenc[32])]
+	}
+
+	kid := hex.EncodeToString(tenc[16:32])
+	key, ok := keys[kid]
+	if !ok {
+		key, ok = keys[""]
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("no content key for key ID %s", kid)
+	}
+	p.key = key
+	return string(frma[8:12]), p, nil
+}
+
+// decryptInit removes the protection of the encrypted sample entries of an init segment
+// and returns the decrypter of the fragments that follow it, which is nil when no track is encrypted
+func decryptInit(init []byte, keys map[string][]byte) ([]byte, *cencDecrypter, error) {
+	d := &cencDecrypter{tracks: make(map[uint32]*trackProtection)}
+	rewriteTrak := func(trak mp4Box, data []byte) ([]byte, error) {
+		tkhd, err := findBox(data, trak.header, "tkhd")
+		if err != nil {
+			return nil, err
+		}
+		offset, err := tkhdTrackIDOffset(tkhd)
+		if err != nil {
+			return nil, err
+		}
+		trackID := binary.BigEndian.Uint32(tkhd[offset:])
+		return rebuildPath(data, trak.header, []string{"mdia", "minf", "stbl", "stsd"}, func(entry mp4Box, data []byte) ([]byte, error) {
+			if entry.boxType != "encv" && entry.boxType != "enca" {
+				return data, nil
+			}
+			fields, err := sampleEntryFields(data, entry.header)
+			if err != nil {
+				return nil, err
+			}
+			sinf, err := findBox(data, entry.header+fields, "sinf")
+			if err != nil {
+				return nil, err
+			}
+			format, p, err := parseProtection(sinf, keys)
+			if err != nil {
+				return nil, err
+			}
+			d.tracks[trackID] = p
+			clear, err := rebuildBox(data, entry.header, fields, func(child mp4Box, data []byte) ([]byte, error) {
+				if child.boxType == "sinf" {
+					return nil, nil
+				}
+				return data, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			copy(clear[4:8], format)
+			return clear, nil
+		})
+	}
+
+	boxes, err := childBoxes(init, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var out []byte
+	for _, box := range boxes {
+		data := init[box.offset : box.offset+box.size]
+		if box.boxType == "moov" {
+			data, err = rebuildBox(data, box.header, 0, func(child mp4Box, data []byte) ([]byte, error) {
+				switch child.boxType {
+				case "trak":
+					return rewriteTrak(child, data)
+				case "pssh":
+					return nil, nil
+				}
+				return data, nil
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		out = append(out, data...)
+	}
+	if len(d.tracks) == 0 {
+		return init, nil, nil
+	}
+	return out, d, nil
+}
+
+// decryptFragments decrypts in place the samples of the fragments of a segment
+func (d *cencDecrypter) decryptFragments(data []byte) error {
+	boxes, err := childBoxes(data, 0)
+	if err != nil {
+		return err
+	}
+	for i, box := range boxes {
+		if box.boxType != "moof" {
+			continue
+		}
+		// samples of truns without a data offset start at the payload of the mdat
+		mdatStart := int64(-1)
+		for _, next := range boxes[i+1:] {
+			if next.boxType == "mdat" {
+				mdatStart = next.offset + next.header
+				break
+			}
+		}
+		moof := data[box.offset : box.offset+box.size]
+		trafs, err := childBoxes(moof, box.header)
+		if err != nil {
+			return err
+		}
+		for _, traf := range trafs {
+			if traf.boxType != "traf" {
+				continue
+			}
+			err := d.decryptTraf(data, box.offset, mdatStart, moof[traf.offset:traf.offset+traf.size], traf.header)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fullBoxFlags(box []byte) uint32 {
+	return binary.BigEndian.Uint32(box[8:12]) & 0xFFFFFF
+}
+
+// decryptTraf decrypts the samples of a track fragment, data is the whole segment
+// and moofOffset the offset of the moof holding the traf
+func (d *cencDecrypter) decryptTraf(data []byte, moofOffset int64, mdatStart int64, traf []byte, header int64) error {
+	tfhd, err := findBox(traf, header, "tfhd")
+	if err != nil || len(tfhd) < 16 {
+		return errors.New("invalid tfhd box")
+	}
+	p := d.tracks[binary.BigEndian.Uint32(tfhd[12:])]
+	if p == nil {
+		return nil
+	}
+	flags := fullBoxFlags(tfhd)
+	if flags&0x01 != 0 {
+		return errors.New("fragments with an explicit base data offset can not be decrypted")
+	}
+	pos := 16
+	for _, flag := range []uint32{0x02, 0x08} {
+		if flags&flag != 0 {
+			pos += 4
+		}
+	}
+	defaultSize := 0
+	if flags&0x10 != 0 {
+		if len(tfhd) < pos+4 {
+			return errors.New("invalid tfhd box")
+		}
+		defaultSize = int(binary.BigEndian.Uint32(tfhd[pos:]))
+	}
+
+	children, err := childBoxes(traf, header)
+	if err != nil {
+		return err
+	}
+	var samples [][]byte
+	var senc []byte
+	sencFields := 0
+	next := mdatStart
+	for _, child := range children {
+		box := traf[child.offset : child.offset+child.size]
+		switch {
+		case child.boxType == "senc":
+			senc, sencFields = box, 12
+		case child.boxType == "uuid" && len(box) >= 24 && string(box[8:24]) == string(piffSampleEncryption):
+			senc, sencFields = box[16:], 12
+		case child.boxType == "trun":
+			if samples, next, err = trunSamples(data, moofOffset, next, box, defaultSize, samples); err != nil {
+				return err
+			}
+		}
+	}
+	if senc == nil {
+		return errors.New("encrypted track fragment without sample encryption box")
+	}
+	return p.decryptSamples(samples, senc, sencFields)
+}
+
+// trunSamples appends the samples of a trun to samples and returns where its samples end
+func trunSamples(data []byte, moofOffset int64, start int64, trun []byte, defaultSize int, samples [][]byte) ([][]byte, int64, error) {
+	if len(trun) < 16 {
+		return nil, 0, errors.New("invalid trun box")
+	}
+	flags := fullBoxFlags(trun)
+	count := int(binary.BigEndian.Uint32(trun[12:]))
+	pos := 16
+	if flags&0x01 != 0 {
+		if len(trun) < pos+4 {
+			return nil, 0, errors.New("invalid trun box")
+		}
+		start = moofOffset + int64(int32(binary.BigEndian.Uint32(trun[pos:])))
+		pos += 4
+	}
+	if flags&0x04 != 0 {
+		pos += 4
+	}
+	if start < 0 {
+		return nil, 0, errors.New("missing mdat box")
+	}
+	// the sample count is untrusted: the per sample fields must fit in the trun, samples of the
+	// default size in the segment, and samples without a size are rejected
+	fields := 0
+	for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&flag != 0 {
+			fields += 4
+		}
+	}
+	if fields > 0 && count > (len(trun)-pos)/fields {
+		return nil, 0, errors.New("invalid trun box")
+	}
+	if flags&0x200 == 0 && count > 0 {
+		if defaultSize <= 0 {
+			return nil, 0, errors.New("trun box without sample sizes")
+		}
+		if int64(count) > (int64(len(data))-start)/int64(defaultSize) {
+			return nil, 0, errors.New("sample out of the segment")
+		}
+	}
+	for n := 0; n < count; n++ {
+		size := defaultSize
+		for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if flags&flag == 0 {
+				continue
+			}
+			if len(trun) < pos+4 {
+				return nil, 0, errors.New("invalid trun box")
+			}
+			if flag == 0x200 {
+				size = int(binary.BigEndian.Uint32(trun[pos:]))
+			}
+			pos += 4
+		}
+		if start+int64(size) > int64(len(data)) {
+			return nil, 0, errors.New("sample out of the segment")
+		}
+		samples = append(samples, data[start:start+int64(size)])
+		start += int64(size)
+	}
+	return samples, start, nil
+}
+
+// decryptSamples decrypts the samples with the IVs and subsamples of the sample encryption box
+func (p *trackProtection) decryptSamples(samples [][]byte, senc []byte, pos int) error {
+	if len(senc) < pos+4 {
+		return errors.New("invalid senc box")
+	}
+	flags := fullBoxFlags(senc)
+	if flags&0x01 != 0 {
+		return errors.New("sample encryption boxes overriding the track encryption are not supported")
+	}
+	count := int(binary.BigEndian.Uint32(senc[pos:]))
+	pos += 4
+	if count != len(samples) {
+		return fmt.Errorf("sample encryption box describes %d samples, the track fragment has %d", count, len(samples))
+	}
+	block, err := aes.NewCipher(p.key)
+	if err != nil {
+		return err
+	}
+	for _, sample := range samples {
+		iv := p.constantIV
+		if p.ivSize > 0 {
+			if len(senc) < pos+p.ivSize {
+				return errors.New("invalid senc box")
+			}
+			iv = senc[pos : pos+p.ivSize]
+			pos += p.ivSize
+		}
+		subsamples := []subsample{{0, len(sample)}}
+		if flags&0x02 != 0 {
+			if len(senc) < pos+2 {
+				return errors.New("invalid senc box")
+			}
+			n := int(binary.BigEndian.Uint16(senc[pos:]))
+			pos += 2
+			if len(senc) < pos+6*n {
+				return errors.New("invalid senc box")
+			}
+			subsamples = make([]subsample, n)
+			total := 0
+			for i := range subsamples {
+				subsamples[i].clear = int(binary.BigEndian.Uint16(senc[pos:]))
+				subsamples[i].protected = int(binary.BigEndian.Uint32(senc[pos+2:]))
+				total += subsamples[i].clear + subsamples[i].protected
+				pos += 6
+			}
+			if total > len(sample) {
+				return errors.New("subsamples larger than the sample")
+			}
+		}
+		p.decryptSample(block, sample, paddedIV(iv), subsamples)
+	}
+	return nil
+}
+
+// paddedIV extends 8 bytes IVs to the block size, the counter of cenc starts at 0
+func paddedIV(iv []byte) []byte {
+	padded := make([]byte, aes.BlockSize)
+	copy(padded, iv)
+	return padded
+}
+
+func (p *trackProtection) decryptSample(block cipher.Block, sample []byte, iv []byte, subsamples []subsample) {
+	pos := 0
+	switch p.scheme {
+	case schemeCENC:
+		// the key stream runs on across the subsamples
+		stream := cipher.NewCTR(block, iv)
+		for _, s := range subsamples {
+			pos += s.clear
+			stream.XORKeyStream(sample[pos:pos+s.protected], sample[pos:pos+s.protected])
+			pos += s.protected
+		}
+	case schemeCBC1:
+		// the cipher block chain runs on across the subsamples
+		mode := cipher.NewCBCDecrypter(block, iv)
+		for _, s := range subsamples {
+			pos += s.clear
+			n := s.protected - s.protected%aes.BlockSize
+			mode.CryptBlocks(sample[pos:pos+n], sample[pos:pos+n])
+			pos += s.protected
+		}
+	case schemeCBCS:
+		// the IV is reset for every subsample, the blocks follow the crypt and skip pattern
+		// and the partial block ending a subsample is left clear
+		for _, s := range subsamples {
+			pos += s.clear
+			mode := cipher.NewCBCDecrypter(block, iv)
+			region := sample[pos : pos+s.protected]
+			for offset := 0; len(region)-offset >= aes.BlockSize; {
+				n := (len(region) - offset) / aes.BlockSize * aes.BlockSize
+				if p.skipBlocks > 0 && p.cryptBlocks*aes.BlockSize < n {
+					n = p.cryptBlocks * aes.BlockSize
+				}
+				mode.CryptBlocks(region[offset:offset+n], region[offset:offset+n])
+				offset += n + p.skipBlocks*aes.BlockSize
+			}
+			pos += s.protected
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ClippedRange is the part of a track kept by SetClip. Segments are never cut, the output runs from
+// Start to End of the playlist, TrimStart before and TrimEnd after the requested interval.
+type ClippedRange struct {
+	Track string
+	// From and To are the first and last segments kept
+	From      uint64
+	To        uint64
+	Start     time.Duration
+	End       time.Duration
+	TrimStart time.Duration
+	TrimEnd   time.Duration
+}
+
+// SetClip restricts the download to the segments covering [start, end) of the playlist, the
+// offset of a segment being the sum of the EXTINF durations before it. A zero end clips up to the
+// end of the playlist. Report tells how much of the first and last segment lies outside of the
+// interval, to trim the output precisely. Live playlists are clipped as listed when the download
+// starts. The clip takes precedence over the EXT-X-START offset.
+func (h *hlsDownloader) SetClip(start time.Duration, end time.Duration) error {
+	if h == nil {
+		return errors.New("attempt to set clip on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if start < 0 || end < 0 {
+		return errors.New("clip bounds must not be negative")
+	}
+	if end > 0 && end <= start {
+		return errors.New("clip end must be after its start")
+	}
+	h.clipStart = start
+	h.clipEnd = end
+	return nil
+}
+
+func (h *hlsDownloader) hasClip() bool {
+	return h.clipStart > 0 || h.clipEnd > 0
+}
+
+// applyClip keeps the segments of every track covering the clip, and records the ranges kept
+func (h *hlsDownloader) applyClip(tracks []*track) error {
+	var clips []ClippedRange
+	if h.hasClip() {
+		for _, t := range tracks {
+			var kept []*segment
+			var offset, start time.Duration
+			for _, segment := range t.segments {
+				segmentStart := offset
+				offset += seconds(segment.Duration)
+				if offset <= h.clipStart {
+					continue
+				}
+				if h.clipEnd > 0 && segmentStart >= h.clipEnd {
+					break
+				}
+				if len(kept) == 0 {
+					start = segmentStart
+				}
+				kept = append(kept, segment)
+			}
+			if len(kept) == 0 {
+				return fmt.Errorf("clip starts after the end of the %s playlist (%s)", t.name, offset)
+			}
+			end := start
+			for _, segment := range kept {
+				end += seconds(segment.Duration)
+			}
+			r := ClippedRange{Track: t.name, From: kept[0].SeqId, To: kept[len(kept)-1].SeqId, Start: start, End: end, TrimStart: h.clipStart - start}
+			if h.clipEnd > 0 && end > h.clipEnd {
+				r.TrimEnd = end - h.clipEnd
+			}
+			clips = append(clips, r)
+			t.segments = kept
+			// the segments listed later are past the clip
+			t.windowDone = true
+		}
+	}
+	h.reportMu.Lock()
+	h.clips = clips
+	h.reportMu.Unlock()
+	return nil
+}
+
+// SetTimeWindow restricts the download to the segments whose EXT-X-PROGRAM-DATE-TIME
+// span overlaps [from, to). A zero from or to leaves that side of the window open.
+func (h *hlsDownloader) SetTimeWindow(from time.Time, to time.Time) error {
+	if h == nil {
+		return errors.New("attempt to set time window on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if !from.IsZero() && !to.IsZero() && !to.After(from) {
+		return errors.New("time window end must be after its start")
+	}
+	h.windowFrom = from
+	h.windowTo = to
+	return nil
+}
+
+func (h *hlsDownloader) hasTimeWindow() bool {
+	return !h.windowFrom.IsZero() || !h.windowTo.IsZero()
+}
+
+// SetStartOffset enables or disables starting the download at the EXT-X-START TIME-OFFSET
+// of the playlist instead of its first segment (enabled by default). A time window set
+// with SetTimeWindow or a clip set with SetClip takes precedence over it.
+func (h *hlsDownloader) SetStartOffset(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set start offset on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.startOffset = enabled
+	return nil
+}
+
+// startIndex returns the index of the segment containing the offset in seconds,
+// negative offsets are counted from the end of the playlist
+func startIndex(segments []*segment, offset float64) int {
+	if offset < 0 {
+		for _, segment := range segments {
+			offset += segment.Duration
+		}
+		if offset < 0 {
+			return 0
+		}
+	}
+	elapsed := 0.0
+	for i, segment := range segments {
+		if elapsed+segment.Duration > offset {
+			return i
+		}
+		elapsed += segment.Duration
+	}
+	return len(segments) - 1
+}
+
+// applyStartOffset drops the segments before the EXT-X-START offset of the main
+// playlist from every track, segments are never cut so the download starts at the
+// beginning of the segment holding the offset
+func (h *hlsDownloader) applyStartOffset(tracks []*track) {
+	if !h.startOffset || h.hasTimeWindow() || h.hasClip() || tracks[0].playlist.StartTime == 0 {
+		return
+	}
+	offset := tracks[0].playlist.StartTime
+	for _, t := range tracks {
+		if i := startIndex(t.segments, offset); i > 0 {
+			h.log().infof("Starting %s at segment %d (EXT-X-START offset %.3fs)\n", t.name, t.segments[i].SeqId, offset)
+			t.segments = t.segments[i:]
+		}
+	}
+}
+
+// fillProgramDateTime gives every segment a program date time, extrapolating from
+// the closest EXT-X-PROGRAM-DATE-TIME tag with the EXTINF durations
+func fillProgramDateTime(segments []*segment) {
+	first := -1
+	for i, segment := range segments {
+		if !segment.ProgramDateTime.IsZero() {
+			if first < 0 {
+				first = i
+			}
+			continue
+		}
+		if i > 0 && !segments[i-1].ProgramDateTime.IsZero() {
+			previous := segments[i-1]
+			segment.ProgramDateTime = previous.ProgramDateTime.Add(seconds(previous.Duration))
+		}
+	}
+	for i := first - 1; i >= 0; i-- {
+		segments[i].ProgramDateTime = segments[i+1].ProgramDateTime.Add(-seconds(segments[i].Duration))
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// clipByDateTime keeps the segments overlapping the time window. Once a segment
+// starting after the end of the window is seen the track is marked as done.
+func (h *hlsDownloader) clipByDateTime(t *track, segments []*segment) ([]*segment, error) {
+	if !h.hasTimeWindow() || len(segments) == 0 {
+		return segments, nil
+	}
+	if segments[0].ProgramDateTime.IsZero() {
+		return nil, errors.New("playlist has no EXT-X-PROGRAM-DATE-TIME, it can not be clipped by time")
+	}
+	var clipped []*segment
+	for _, segment := range segments {
+		start := segment.ProgramDateTime
+		end := start.Add(seconds(segment.Duration))
+		if !h.windowTo.IsZero() && !start.Before(h.windowTo) {
+			t.windowDone = true
+			break
+		}
+		if !h.windowFrom.IsZero() && !end.After(h.windowFrom) {
+			continue
+		}
+		clipped = append(clipped, segment)
+	}
+	return clipped, nil
+}
@@ -0,0 +1,70 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+)
+
+// SetCookieJar sets the jar the cookies of the responses are stored in and the requests take
+// theirs from, e.g. holding the signed cookies of a CDN. Every download uses a new in-memory
+// jar by default, so that the cookies set by the playlist response reach the segment and key
+// requests. The jar of the client of SetClient is still used for the redirects it follows.
+func (h *hlsDownloader) SetCookieJar(jar http.CookieJar) error {
+	if h == nil {
+		return errors.New("attempt to set cookie jar on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.cookieJar = jar
+	return nil
+}
+
+// newCookieJar returns the jar of a download
+func (h *hlsDownloader) newCookieJar() http.CookieJar {
+	if h.cookieJar != nil {
+		return h.cookieJar
+	}
+	// cookiejar.New only fails with invalid options
+	jar, _ := cookiejar.New(nil)
+	return jar
+}
+
+// withCookies returns fetcher adding the cookies of the jar of the download to the requests and
+// storing the ones of the responses
+func (h *hlsDownloader) withCookies(fetcher Fetcher) Fetcher {
+	if h.jar == nil {
+		return fetcher
+	}
+	return cookieFetcher{fetcher: fetcher, jar: h.jar}
+}
+
+type cookieFetcher struct {
+	fetcher Fetcher
+	jar     http.CookieJar
+}
+
+func (f cookieFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if cookies := f.jar.Cookies(req.URL); len(cookies) > 0 {
+		cloneRequestHeader(req)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+	}
+	resp, err := f.fetcher.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		// the cookies belong to the URL answering once the redirects are followed
+		u := req.URL
+		if resp.Request != nil {
+			u = resp.Request.URL
+		}
+		f.jar.SetCookies(u, cookies)
+	}
+	return resp, nil
+}
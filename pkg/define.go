@@ -0,0 +1,86 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+var variableReference = regexp.MustCompile(`\{\$([A-Za-z0-9_-]+)\}`)
+
+// defineVariables collects the EXT-X-DEFINE variables of a raw playlist. IMPORT takes the
+// value from the master playlist variables and QUERYPARAM from the playlist URL query.
+// It returns nil when the playlist defines nothing.
+func defineVariables(data []byte, playlistURL string, imports map[string]string) (map[string]string, error) {
+	var variables map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#EXT-X-DEFINE:") {
+			continue
+		}
+		if variables == nil {
+			variables = make(map[string]string)
+		}
+		attrs := m3u8.DecodeAttributeList(line[len("#EXT-X-DEFINE:"):])
+		switch {
+		case attrs["NAME"] != "":
+			variables[attrs["NAME"]] = attrs["VALUE"]
+		case attrs["IMPORT"] != "":
+			value, ok := imports[attrs["IMPORT"]]
+			if !ok {
+				return nil, fmt.Errorf("imported variable %q is not defined by the master playlist", attrs["IMPORT"])
+			}
+			variables[attrs["IMPORT"]] = value
+		case attrs["QUERYPARAM"] != "":
+			u, err := url.Parse(playlistURL)
+			if err != nil {
+				return nil, err
+			}
+			values, ok := u.Query()[attrs["QUERYPARAM"]]
+			if !ok {
+				return nil, fmt.Errorf("query parameter %q of variable is not in the playlist url", attrs["QUERYPARAM"])
+			}
+			variables[attrs["QUERYPARAM"]] = values[0]
+		default:
+			return nil, fmt.Errorf("invalid EXT-X-DEFINE %q", line)
+		}
+	}
+	return variables, scanner.Err()
+}
+
+// substituteVariables replaces the {$name} references of the playlist lines, except
+// the EXT-X-DEFINE tags themselves
+func substituteVariables(data []byte, variables map[string]string) ([]byte, error) {
+	var out bytes.Buffer
+	var err error
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if !strings.HasPrefix(line, "#EXT-X-DEFINE:") {
+			line = variableReference.ReplaceAllStringFunc(line, func(reference string) string {
+				name := variableReference.FindStringSubmatch(reference)[1]
+				value, ok := variables[name]
+				if !ok && err == nil {
+					err = fmt.Errorf("variable %q is not defined", name)
+				}
+				return value
+			})
+		}
+		out.WriteString(line)
+	}
+	return out.Bytes(), err
+}
+
+// resolveVariables applies the EXT-X-DEFINE variable substitution to a raw playlist,
+// playlists without EXT-X-DEFINE are left untouched
+func resolveVariables(data []byte, playlistURL string, imports map[string]string) ([]byte, error) {
+	variables, err := defineVariables(data, playlistURL, imports)
+	if err != nil || variables == nil {
+		return data, err
+	}
+	return substituteVariables(data, variables)
+}
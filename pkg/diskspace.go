@@ -0,0 +1,182 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ErrInsufficientDiskSpace is returned when the estimated size of a download exceeds the free
+// space of its output or temp directory and the disk space check refuses to start it
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+// errFreeSpaceUnsupported is returned by freeSpace on the platforms it does not support
+var errFreeSpaceUnsupported = errors.New("free disk space is not available on this platform")
+
+// diskSpaceSamples is how many segments of a track are asked for their size with a HEAD request
+const diskSpaceSamples = 3
+
+// DiskSpaceCheck defines what happens when the estimated size of a download exceeds the free
+// space of its output directory, or of the temp directory for resumable downloads
+type DiskSpaceCheck int
+
+const (
+	// DiskSpaceWarn logs a warning and downloads anyway (default)
+	DiskSpaceWarn DiskSpaceCheck = iota
+	// DiskSpaceRefuse fails with ErrInsufficientDiskSpace before downloading any segment
+	DiskSpaceRefuse
+	// DiskSpaceOff skips the check, along with the requests estimating the size
+	DiskSpaceOff
+)
+
+func (c DiskSpaceCheck) String() string {
+	switch c {
+	case DiskSpaceWarn:
+		return "warn"
+	case DiskSpaceRefuse:
+		return "refuse"
+	case DiskSpaceOff:
+		return "off"
+	}
+	return fmt.Sprintf("DiskSpaceCheck(%d)", int(c))
+}
+
+// ParseDiskSpaceCheck converts a textual check ("warn", "refuse", "off") into a DiskSpaceCheck
+func ParseDiskSpaceCheck(s string) (DiskSpaceCheck, error) {
+	switch s {
+	case "", "warn":
+		return DiskSpaceWarn, nil
+	case "refuse":
+		return DiskSpaceRefuse, nil
+	case "off":
+		return DiskSpaceOff, nil
+	}
+	return 0, fmt.Errorf("unknown disk space check %q", s)
+}
+
+// SetDiskSpaceCheck sets what happens when the estimated size of the download exceeds the free space
+func (h *hlsDownloader) SetDiskSpaceCheck(check DiskSpaceCheck) error {
+	if h == nil {
+		return errors.New("attempt to set disk space check on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if check < DiskSpaceWarn || check > DiskSpaceOff {
+		return fmt.Errorf("unknown disk space check %d", int(check))
+	}
+	h.diskSpaceCheck = check
+	return nil
+}
+
+// checkDiskSpace compares the estimated size of the tracks with the free space of the directories
+// they are written to. Live and EVENT playlists have no known size and are not checked.
+func (h *hlsDownloader) checkDiskSpace(tracks []*track) error {
+	h.estimatedSize = 0
+	if h.diskSpaceCheck == DiskSpaceOff {
+		return nil
+	}
+	var estimate int64
+	for _, t := range tracks {
+		if h.following(t) {
+			h.log().infof("Playlist (%s) is not complete, skipping the disk space check\n", t.name)
+			return nil
+		}
+		estimate += h.estimateSize(t)
+	}
+	if estimate == 0 {
+		return nil
+	}
+	h.estimatedSize = estimate
+	h.log().infof("Estimated download size: %d bytes\n", estimate)
+
+	var dirs []string
+	if h.stream == nil {
+		dirs = append(dirs, h.path)
+	}
+	// the other downloads only keep the segments waiting for an earlier one
+	if h.resumable() {
+		dirs = append(dirs, os.TempDir())
+	}
+	for _, dir := range dirs {
+		free, err := freeSpace(dir)
+		if err != nil {
+			h.log().warnf("Failed to get the free space of %s: %s\n", dir, err.Error())
+			continue
+		}
+		if uint64(estimate) <= free {
+			continue
+		}
+		if h.diskSpaceCheck == DiskSpaceRefuse {
+			return fmt.Errorf("%w: %s has %d bytes free, the download needs about %d", ErrInsufficientDiskSpace, dir, free, estimate)
+		}
+		h.log().warnf("%s has %d bytes free, the download needs about %d\n", dir, free, estimate)
+	}
+	return nil
+}
+
+// estimateSize estimates the size of a track from the byte ranges and EXT-X-BITRATE of its
+// segments, the Content-Length of a few sampled segments or the bandwidth of its variant, zero
+// when unknown
+func (h *hlsDownloader) estimateSize(t *track) int64 {
+	var known int64
+	var whole []*segment
+	var duration float64
+	for _, segment := range t.segments {
+		duration += segment.Duration
+		if segment.skipReason != "" {
+			continue
+		}
+		if segment.Limit > 0 {
+			known += segment.Limit
+		} else if segment.bitrate > 0 {
+			known += int64(float64(segment.bitrate) / 8 * segment.Duration)
+		} else if !isDataURI(segment.URI) {
+			whole = append(whole, segment)
+		}
+	}
+	if len(whole) == 0 {
+		return known
+	}
+
+	var sampled, sampledSize int64
+	step := len(whole)/diskSpaceSamples + 1
+	for i := 0; i < len(whole); i += step {
+		size, err := h.contentLength(whole[i].URI)
+		if err != nil {
+			h.log().debugf("Failed to get the size of segment %d: %s\n", whole[i].SeqId, err.Error())
+			continue
+		}
+		sampled++
+		sampledSize += size
+	}
+	if sampled > 0 {
+		return known + sampledSize*int64(len(whole))/sampled
+	}
+	if t.bandwidth > 0 {
+		return known + int64(float64(t.bandwidth)/8*duration)
+	}
+	return known
+}
+
+// contentLength returns the size of a resource announced by a HEAD request
+func (h *hlsDownloader) contentLength(URI string) (int64, error) {
+	req, err := newMethodRequest(h.ctx, http.MethodHead, URI, h.header)
+	if err != nil {
+		return 0, err
+	}
+	res, err := h.fetch(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, newStatusError(res)
+	}
+	if res.ContentLength < 0 {
+		return 0, errors.New("no Content-Length")
+	}
+	return res.ContentLength, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package HLSDownloader
+
+// freeSpace is not supported on this platform, the disk space check is skipped
+func freeSpace(dir string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
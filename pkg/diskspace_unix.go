@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package HLSDownloader
+
+import "syscall"
+
+// freeSpace returns the space of the filesystem of dir available to unprivileged users
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,154 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver resolves host names into IP addresses, *net.Resolver is one
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSOptions changes how the host names of the requests are resolved, a zero value keeps the
+// system resolver
+type DNSOptions struct {
+	// Resolver replaces the system resolver, e.g. DNSServer or a DNS-over-HTTPS client
+	Resolver Resolver
+	// Hosts maps a host, or a host:port, to the IP address connected to instead of resolving it,
+	// like the --resolve option of curl
+	Hosts map[string]string
+	// CacheTTL keeps the resolved addresses for that long, zero disables the cache
+	CacheTTL time.Duration
+}
+
+// DNSServer returns a resolver querying the DNS server at address (ip or ip:port) instead of the
+// ones of the system
+func DNSServer(address string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// SetDNSOptions sets how the host names are resolved. Like the transport options, they apply
+// to a copy of the transport of the client and are ignored when it has a custom RoundTripper.
+func (h *hlsDownloader) SetDNSOptions(options DNSOptions) error {
+	if h == nil {
+		return errors.New("attempt to set dns options on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if options.CacheTTL < 0 {
+		return errors.New("dns cache ttl must not be negative")
+	}
+	for host, address := range options.Hosts {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid address %q of host %s", address, host)
+		}
+	}
+	h.dns = options
+	h.resetTransport()
+	return nil
+}
+
+func (o DNSOptions) enabled() bool {
+	return o.Resolver != nil || len(o.Hosts) > 0 || o.CacheTTL > 0
+}
+
+// resolvingDialer dials the addresses resolved with the DNS options
+type resolvingDialer struct {
+	dialer  *net.Dialer
+	options DNSOptions
+	mu      sync.Mutex
+	cache   map[string]cachedAddresses
+}
+
+type cachedAddresses struct {
+	addresses []string
+	expires   time.Time
+}
+
+// dialContext returns the dial function of the transport, resolving with the DNS options
+func (h *hlsDownloader) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if !h.dns.enabled() {
+		return dialer.DialContext
+	}
+	d := &resolvingDialer{dialer: dialer, options: h.dns, cache: make(map[string]cachedAddresses)}
+	return d.DialContext
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := d.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	// the addresses are tried in turn, like the dialer does with the ones it resolves
+	for _, ip := range addresses {
+		var conn net.Conn
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolve returns the IP addresses of a host, from the overrides, the cache or the resolver
+func (d *resolvingDialer) resolve(ctx context.Context, host, port string) ([]string, error) {
+	if ip, ok := d.options.Hosts[net.JoinHostPort(host, port)]; ok {
+		return []string{ip}, nil
+	}
+	if ip, ok := d.options.Hosts[host]; ok {
+		return []string{ip}, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if d.options.CacheTTL > 0 {
+		d.mu.Lock()
+		cached, ok := d.cache[host]
+		d.mu.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.addresses, nil
+		}
+	}
+
+	var resolver Resolver = net.DefaultResolver
+	if d.options.Resolver != nil {
+		resolver = d.options.Resolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		addresses[i] = ip.String()
+	}
+	if d.options.CacheTTL > 0 {
+		d.mu.Lock()
+		d.cache[host] = cachedAddresses{addresses: addresses, expires: time.Now().Add(d.options.CacheTTL)}
+		d.mu.Unlock()
+	}
+	return addresses, nil
+}
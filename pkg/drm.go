@@ -0,0 +1,124 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// ErrDRMProtected is matched by the DRMError of streams protected by a DRM system
+var ErrDRMProtected = errors.New("stream is protected by DRM")
+
+// DRMError is returned by Download, before any segment is downloaded, when the stream is
+// protected by a DRM system and neither a DRM decrypter nor content keys are set
+type DRMError struct {
+	Track     string
+	System    string
+	KeyURI    string
+	KeyFormat string
+}
+
+func (e *DRMError) Error() string {
+	return fmt.Sprintf("%s track is protected by %s DRM (key %s), set a DRM decrypter with SetDRMDecrypter or the content keys with SetContentKeys",
+		e.Track, e.System, e.KeyURI)
+}
+
+func (e *DRMError) Is(target error) bool {
+	return target == ErrDRMProtected
+}
+
+// DRMSegment describes a segment, or the init segment of a segment, handed to a DRMDecrypter
+type DRMSegment struct {
+	URI       string
+	SeqID     uint64
+	Init      bool
+	System    string
+	Method    string
+	KeyURI    string
+	KeyFormat string
+	IV        string
+}
+
+// DRMDecrypter takes over the decryption of the segments of DRM protected streams.
+// DecryptSegment is called with the data of every segment and init segment as served
+// and returns the data written to the output.
+type DRMDecrypter interface {
+	DecryptSegment(ctx context.Context, segment DRMSegment, data []byte) ([]byte, error)
+}
+
+// SetDRMDecrypter sets the decrypter of the segments of DRM protected streams
+func (h *hlsDownloader) SetDRMDecrypter(decrypter DRMDecrypter) error {
+	if h == nil {
+		return errors.New("attempt to set DRM decrypter on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.drmDecrypter = decrypter
+	return nil
+}
+
+// drmSystem returns the DRM system of a key, from its KEYFORMAT or its URI scheme,
+// or "" when the key is not a DRM key
+func drmSystem(key *m3u8.Key) string {
+	if key == nil {
+		return ""
+	}
+	switch strings.ToLower(key.Keyformat) {
+	case "com.apple.streamingkeydelivery":
+		return "FairPlay"
+	case "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed":
+		return "Widevine"
+	case "com.microsoft.playready", "urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95":
+		return "PlayReady"
+	}
+	if strings.HasPrefix(strings.ToLower(key.URI), "skd:") {
+		return "FairPlay"
+	}
+	return ""
+}
+
+func newDRMSegment(segment *segment, init bool) DRMSegment {
+	s := DRMSegment{
+		URI:       segment.URI,
+		SeqID:     segment.SeqId,
+		Init:      init,
+		System:    drmSystem(segment.Key),
+		Method:    segment.Key.Method,
+		KeyURI:    segment.Key.URI,
+		KeyFormat: segment.Key.Keyformat,
+		IV:        segment.Key.IV,
+	}
+	if init {
+		s.URI = segment.Map.URI
+	}
+	return s
+}
+
+// usesDRMDecrypter reports whether the segment is decrypted by the DRM decrypter,
+// fragmented MP4 segments decrypted with content keys are not
+func (h *hlsDownloader) usesDRMDecrypter(t *track, segment *segment) bool {
+	return h.drmDecrypter != nil && t.cenc == nil && drmSystem(segment.Key) != ""
+}
+
+// checkDRM fails with a DRMError when a track is protected by a DRM system nothing can decrypt.
+// Archived segments are stored encrypted, so archives need no decrypter.
+func (h *hlsDownloader) checkDRM(tracks []*track) error {
+	if h.drmDecrypter != nil || h.archive {
+		return nil
+	}
+	for _, t := range tracks {
+		for _, segment := range t.segments {
+			system := drmSystem(segment.Key)
+			if system == "" || (segment.isFMP4() && len(h.contentKeys) > 0) {
+				continue
+			}
+			return &DRMError{Track: t.name, System: system, KeyURI: segment.Key.URI, KeyFormat: segment.Key.Keyformat}
+		}
+	}
+	return nil
+}
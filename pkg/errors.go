@@ -0,0 +1,48 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrNotMediaPlaylist is returned when a playlist expected to list segments is a master playlist
+	ErrNotMediaPlaylist = errors.New("playlist is not a media playlist")
+	// ErrKeyFetch wraps the errors of fetching a decryption key, from its URI or the key provider
+	ErrKeyFetch = errors.New("failed to get decryption key")
+	// ErrOutputPermission is returned when the output can not be written, it also matches
+	// os.ErrPermission
+	ErrOutputPermission = fmt.Errorf("output is not writable: %w", os.ErrPermission)
+	// ErrAlreadyRunning is returned when a download is started, or a setting changed, while a
+	// download of the same downloader is running
+	ErrAlreadyRunning = errors.New("download already running")
+)
+
+// ErrSegmentDownload is returned when a segment can not be downloaded once its retries and
+// mirrors are exhausted, errors.As gives access to it to tell which segment failed and why
+type ErrSegmentDownload struct {
+	SeqID uint64
+	URL   string
+	// Status is the HTTP status code the server answered with, zero when the request failed
+	// without an answer, e.g. a timeout
+	Status int
+	Err    error
+}
+
+func (e *ErrSegmentDownload) Error() string {
+	return fmt.Sprintf("segment %d (%s): %s", e.SeqID, e.URL, e.Err.Error())
+}
+
+func (e *ErrSegmentDownload) Unwrap() error {
+	return e.Err
+}
+
+func newSegmentDownloadError(segment *segment, URL string, err error) error {
+	e := &ErrSegmentDownload{SeqID: segment.SeqId, URL: URL, Err: err}
+	var se *statusError
+	if errors.As(err, &se) {
+		e.Status = se.code
+	}
+	return e
+}
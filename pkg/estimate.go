@@ -0,0 +1,55 @@
+package HLSDownloader
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+const bitrateTagName = "#EXT-X-BITRATE:"
+
+// bitrateTag decodes EXT-X-BITRATE, the approximate bitrate in kbit/s of the segments following it
+type bitrateTag struct {
+	kbps int64
+}
+
+func (bitrateTag) TagName() string { return bitrateTagName }
+
+func (bitrateTag) Decode(line string) (m3u8.CustomTag, error) {
+	kbps, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, bitrateTagName)), 10, 64)
+	return bitrateTag{kbps: kbps}, err
+}
+
+func (bitrateTag) SegmentTag() bool { return true }
+
+func (t bitrateTag) Encode() *bytes.Buffer { return bytes.NewBufferString(t.String()) }
+
+func (t bitrateTag) String() string { return bitrateTagName + strconv.FormatInt(t.kbps, 10) }
+
+// SizeEstimate is the estimated size and duration of a download, see EstimateSize
+type SizeEstimate struct {
+	// Bytes is the estimated size of every track, zero when unknown, e.g. for live playlists
+	Bytes int64
+	// Duration is the duration of the segments of the main track listed so far
+	Duration time.Duration
+}
+
+// EstimateSize fetches the playlists of the download and estimates its size, without downloading
+// any segment, from the byte ranges and EXT-X-BITRATE of the segments, the Content-Length of a few
+// sampled segments or the bandwidth of the variant, see Probe
+func (h *hlsDownloader) EstimateSize() (SizeEstimate, error) {
+	return h.EstimateSizeContext(context.Background())
+}
+
+// EstimateSizeContext estimates like EstimateSize, aborting as soon as ctx is done
+func (h *hlsDownloader) EstimateSizeContext(ctx context.Context) (SizeEstimate, error) {
+	info, err := h.ProbeContext(ctx)
+	if err != nil {
+		return SizeEstimate{}, err
+	}
+	return SizeEstimate{Bytes: info.EstimatedSize, Duration: seconds(info.Duration)}, nil
+}
@@ -0,0 +1,196 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// EventType tells what a ProgressEvent reports
+type EventType int
+
+const (
+	// EventPhase is sent when the download enters a new phase
+	EventPhase EventType = iota
+	// EventStarted is sent before every request of a segment, including the retried ones
+	EventStarted
+	// EventCompleted is sent once a segment is downloaded and verified
+	EventCompleted
+	// EventRetried is sent when a segment is requested again after an error, from the same
+	// server or the next mirror
+	EventRetried
+	// EventSkipped is sent when a missing or failed segment is left out of the output
+	EventSkipped
+	// EventFailed is sent when a segment fails after every retry, aborting the download
+	EventFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPhase:
+		return "phase"
+	case EventStarted:
+		return "started"
+	case EventCompleted:
+		return "completed"
+	case EventRetried:
+		return "retried"
+	case EventSkipped:
+		return "skipped"
+	case EventFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Phase is a step of a download
+type Phase int
+
+const (
+	// PhaseResolving fetches the playlists and selects the tracks
+	PhaseResolving Phase = iota
+	// PhaseDownloading downloads and joins the segments
+	PhaseDownloading
+	// PhaseFinalizing muxes the tracks and extracts the sidecars
+	PhaseFinalizing
+	// PhaseDone ends the download, successfully or not
+	PhaseDone
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseResolving:
+		return "resolving"
+	case PhaseDownloading:
+		return "downloading"
+	case PhaseFinalizing:
+		return "finalizing"
+	case PhaseDone:
+		return "done"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// eventBuffer is the capacity of the channel returned by Events
+const eventBuffer = 256
+
+// ProgressEvent describes a step of the running download, see OnProgress and Events
+type ProgressEvent struct {
+	Type  EventType
+	Phase Phase
+	Time  time.Time
+	// Track, SeqID and Attempt identify the segment of the segment events, Attempt counting from
+	// 1 for every server tried
+	Track   string
+	SeqID   uint64
+	Attempt int
+	// Bytes is the size of the completed segment
+	Bytes int64
+	// TotalBytes is how many bytes were received so far, Speed the current bytes per second
+	TotalBytes int64
+	Speed      float64
+	// Err is the error of a retried, skipped or failed segment, or of a failed download once done
+	Err error
+}
+
+// OnProgress calls handler with every event of the download, nil removes it. The events are
+// delivered from the goroutines of the download, the workers calling handler concurrently, so it
+// must be safe for concurrent use and return quickly. It may call the methods of the downloader.
+func (h *hlsDownloader) OnProgress(handler func(ProgressEvent)) error {
+	if h == nil {
+		return errors.New("attempt to set progress handler on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.progressHandler = handler
+	return nil
+}
+
+// Event is an event of the download received from Events
+type Event = ProgressEvent
+
+// Events returns the channel receiving the events of the downloads, the same as OnProgress. Its
+// buffer is bounded rather than slowing the download down: the segment events are dropped while it
+// is full, and the oldest events to make room for the phase ones, so that EventPhase with PhaseDone
+// always tells when a download ends. The channel is never closed, the downloader can be reused.
+func (h *hlsDownloader) Events() <-chan Event {
+	if h == nil {
+		return nil
+	}
+	h.eventMu.Lock()
+	defer h.eventMu.Unlock()
+	if h.events == nil {
+		h.events = make(chan Event, eventBuffer)
+		h.hasEvents.Store(true)
+	}
+	return h.events
+}
+
+// observed tells whether the events are delivered anywhere
+func (h *hlsDownloader) observed() bool {
+	return h.progressHandler != nil || h.hasEvents.Load()
+}
+
+// setPhase enters the phase and reports it
+func (h *hlsDownloader) setPhase(phase Phase, err error) {
+	atomic.StoreInt32(&h.phase, int32(phase))
+	h.emit(ProgressEvent{Type: EventPhase, Err: err})
+}
+
+// segmentEvent reports an event of the segment of the track
+func (h *hlsDownloader) segmentEvent(eventType EventType, t *track, segment *segment, attempt int, err error) {
+	if !h.observed() {
+		return
+	}
+	event := ProgressEvent{Type: eventType, Track: t.name, SeqID: segment.SeqId, Attempt: attempt, Err: err}
+	if eventType == EventCompleted {
+		event.Bytes = segmentSize(segment)
+	}
+	h.emit(event)
+}
+
+// emit completes the event with the phase and the stats of the download, and delivers it
+func (h *hlsDownloader) emit(event ProgressEvent) {
+	if !h.observed() {
+		return
+	}
+	event.Time = time.Now()
+	event.Phase = Phase(atomic.LoadInt32(&h.phase))
+	// the stats of the previous download are still there while the playlists are resolved
+	if s := h.stats.Load(); s != nil && event.Phase != PhaseResolving {
+		stats := s.snapshot(atomic.LoadInt64(&h.totalSegments))
+		event.TotalBytes, event.Speed = stats.Bytes, stats.Speed
+	}
+	// the handler is called once eventMu is released, so that it may use the downloader
+	h.eventMu.Lock()
+	handler := h.progressHandler
+	h.send(event)
+	h.eventMu.Unlock()
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// send delivers the event to the channel of Events, eventMu must be held
+func (h *hlsDownloader) send(event ProgressEvent) {
+	if h.events == nil {
+		return
+	}
+	select {
+	case h.events <- event:
+		return
+	default:
+	}
+	if event.Type != EventPhase {
+		return
+	}
+	// the events are only sent while eventMu is held, there is room once the oldest is dropped
+	select {
+	case <-h.events:
+	default:
+	}
+	h.events <- event
+}
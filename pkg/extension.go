@@ -0,0 +1,96 @@
+package HLSDownloader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"path/filepath"
+	"strings"
+)
+
+// sniffSize is how many bytes of the first segment are fetched to tell its container, enough
+// for the ID3 tag starting packed audio segments
+const sniffSize = 1024
+
+// detectExtensions picks the extension of the outputs from the container of their first
+// segment when the output was requested without one: .mp4 for fragmented MP4, .aac for ADTS
+// audio and .ts for transport streams, the default.
+func (h *hlsDownloader) detectExtensions(tracks []*track) error {
+	if h.outputBase == "" || h.stream != nil || h.archive {
+		return nil
+	}
+	for _, t := range tracks {
+		if t.subtitles || len(t.segments) == 0 {
+			continue
+		}
+		extension, err := h.segmentExtension(t.segments[0])
+		if err != nil {
+			h.log().warnf("Could not detect the container of %s, keeping %s: %s\n", t.name, filepath.Ext(t.output), err.Error())
+			continue
+		}
+		if extension == filepath.Ext(t.output) {
+			continue
+		}
+		base := strings.TrimSuffix(t.output, filepath.Ext(t.output))
+		main := t.output == h.output
+		if main {
+			base = h.outputBase
+		}
+		output, err := availablePath(base+extension, h.overwritePolicy, h.log())
+		if err != nil {
+			return err
+		}
+		h.log().infof("Detected %s segments in %s, saving as %s\n", extension, t.name, output)
+		t.output = output
+		if main {
+			h.output, h.filename, h.extension = output, filepath.Base(output), extension
+		}
+	}
+	return nil
+}
+
+// segmentExtension returns the extension of the container of the segment, fetching its head
+// unless the playlist tells
+func (h *hlsDownloader) segmentExtension(segment *segment) (string, error) {
+	if segment.isFMP4() {
+		return ".mp4", nil
+	}
+	limit, offset := int64(sniffSize), segment.Offset
+	if segment.Limit > 0 && segment.Limit < limit {
+		limit = segment.Limit
+	}
+	head, err := fetchResource(h.ctx, segment.URI, limit, offset, h.header, h.fetcher)
+	if err != nil {
+		return "", err
+	}
+	if segment.isAES128() {
+		key, iv, err := getKey(segment, h.keys)
+		if err != nil {
+			return "", err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return "", err
+		}
+		head = head[:len(head)-len(head)%aes.BlockSize]
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(head, head)
+	}
+	return containerExtension(head), nil
+}
+
+// containerExtension tells the container of data from its first bytes
+func containerExtension(data []byte) string {
+	if len(data) >= 8 {
+		switch string(data[4:8]) {
+		case "ftyp", "styp", "moof":
+			return ".mp4"
+		}
+	}
+	if size := id3Size(data); size > 0 && size < len(data) {
+		data = data[size:]
+	}
+	// ADTS frames start with 12 set bits followed by the layer, always 0
+	if len(data) >= 2 && data[0] == 0xFF && data[1]&0xF6 == 0xF0 {
+		return ".aac"
+	}
+	return ".ts"
+}
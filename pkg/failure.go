@@ -0,0 +1,101 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooManyFailures is returned when more segments failed in a row than the limit set with
+// SetMaxConsecutiveFailures, the stream is then most likely dead
+var ErrTooManyFailures = errors.New("too many consecutive segment failures")
+
+// FailurePolicy defines what happens when a segment can not be downloaded once its retries
+// and mirrors are exhausted
+type FailurePolicy int
+
+const (
+	// Abort fails the whole download (default)
+	Abort FailurePolicy = iota
+	// Skip leaves the segment out of the output, like a missing one, and records it in the report
+	Skip
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case Abort:
+		return "abort"
+	case Skip:
+		return "skip"
+	}
+	return fmt.Sprintf("FailurePolicy(%d)", int(p))
+}
+
+// ParseFailurePolicy converts a textual policy ("abort", "skip") into a FailurePolicy
+func ParseFailurePolicy(s string) (FailurePolicy, error) {
+	switch s {
+	case "", "abort":
+		return Abort, nil
+	case "skip":
+		return Skip, nil
+	}
+	return 0, fmt.Errorf("unknown failure policy %q", s)
+}
+
+// SetFailurePolicy sets what happens when a segment fails after every retry. Skipped segments are
+// replaced by the gap filler, see SetGapFiller.
+func (h *hlsDownloader) SetFailurePolicy(policy FailurePolicy) error {
+	if h == nil {
+		return errors.New("attempt to set failure policy on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if policy < Abort || policy > Skip {
+		return fmt.Errorf("unknown failure policy %d", int(policy))
+	}
+	h.failurePolicy = policy
+	return nil
+}
+
+// SetMaxConsecutiveFailures aborts the download with ErrTooManyFailures once limit segments of
+// a track in a row were skipped because they could not be downloaded, in the order their
+// downloads end, so that a dead stream fails fast while isolated failures are still skipped.
+// It applies to the Skip failure policy and to the missing segments tolerated. Zero disables it.
+func (h *hlsDownloader) SetMaxConsecutiveFailures(limit int) error {
+	if h == nil {
+		return errors.New("attempt to set max consecutive failures on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if limit < 0 {
+		return errors.New("max consecutive failures must not be negative")
+	}
+	h.maxFailures = limit
+	return nil
+}
+
+// countFailure counts the segments of the track failing in a row, failure is nil for a
+// segment downloaded or skipped for another reason
+func (h *hlsDownloader) countFailure(t *track, failure error) error {
+	if failure == nil {
+		t.failures = 0
+		return nil
+	}
+	t.failures++
+	if h.maxFailures > 0 && t.failures >= h.maxFailures {
+		return fmt.Errorf("%w: %d segments of %s, the last one: %w", ErrTooManyFailures, t.failures, t.name, failure)
+	}
+	return nil
+}
+
+// skipsFailed reports whether a segment failing with err is skipped, the cancellation of the
+// download is never skipped
+func (h *hlsDownloader) skipsFailed(err error) bool {
+	if h.tolerateMissing && isMissing(err) {
+		return true
+	}
+	return h.failurePolicy == Skip && h.ctx.Err() == nil
+}
@@ -0,0 +1,83 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Fetcher sends the HTTP requests of a download: the playlists, keys, init segments and segments,
+// and the requests checking the URL and the disk space. A Fetcher can serve them from a cache,
+// from recorded fixtures or through another transport, see SetFetcher. It is called concurrently
+// by the workers.
+type Fetcher interface {
+	Do(ctx context.Context, req *http.Request) (*http.Response, error)
+}
+
+// FetcherFunc adapts a function to a Fetcher
+type FetcherFunc func(ctx context.Context, req *http.Request) (*http.Response, error)
+
+func (f FetcherFunc) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	return f(ctx, req)
+}
+
+// clientFetcher sends the requests with an http.Client
+type clientFetcher struct {
+	client *http.Client
+}
+
+func (f clientFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if req.Context() != ctx {
+		req = req.WithContext(ctx)
+	}
+	return f.client.Do(req)
+}
+
+// SetFetcher sends every request of the download through fetcher instead of the client of
+// SetClient or of the Manager, whose timeouts, transport, DNS and HTTP/3 options then do not
+// apply. The key requests keep the client of SetKeyClient when set. The requests reach fetcher
+// once the request hooks changed them, signed and with the User-Agent, the credentials and the
+// cookies of the download. Nil restores the client.
+func (h *hlsDownloader) SetFetcher(fetcher Fetcher) error {
+	if h == nil {
+		return errors.New("attempt to set fetcher on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.customFetcher = fetcher
+	return nil
+}
+
+// newFetcher returns the fetcher of a download: the one of SetFetcher, otherwise the client of
+// the manager or of the downloader
+func (h *hlsDownloader) newFetcher() Fetcher {
+	switch {
+	case h.customFetcher != nil:
+		return h.decorate(h.customFetcher)
+	case h.manager != nil:
+		return h.decorate(clientFetcher{h.withHTTP3(h.manager.client)})
+	}
+	return h.decorate(clientFetcher{h.withHTTP3(h.configureClient(h.client))})
+}
+
+// decorate returns fetcher signing the requests and setting the User-Agent, the token, the
+// credentials and the cookies of the download on them
+func (h *hlsDownloader) decorate(fetcher Fetcher) Fetcher {
+	return h.withSigner(h.withCookies(h.withUserAgent(h.withToken(h.withAuth(fetcher)))))
+}
+
+// fetch sends the request with the fetcher of the running download
+func (h *hlsDownloader) fetch(req *http.Request) (*http.Response, error) {
+	return h.fetcher.Do(req.Context(), req)
+}
+
+// cloneRequestHeader gives the request a header of its own before it is changed, the header
+// requests are created with is shared by every request of the download
+func cloneRequestHeader(req *http.Request) {
+	req.Header = req.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+}
@@ -0,0 +1,34 @@
+package HLSDownloader
+
+import "errors"
+
+// SkipFiltered is the reason of segments left out by the segment filter
+const SkipFiltered = "filtered"
+
+// SetSegmentFilter sets the predicate every segment is checked with before it is downloaded, e.g.
+// to leave out the pre-roll ads by their URI or the segments before a sequence number. The
+// segments it rejects are cut out of the output like skipped ads and recorded in the report.
+// nil removes it.
+func (h *hlsDownloader) SetSegmentFilter(filter func(SegmentInfo) bool) error {
+	if h == nil {
+		return errors.New("attempt to set segment filter on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.segmentFilter = filter
+	return nil
+}
+
+// filterSegments marks the segments of the track rejected by the segment filter as skipped
+func (h *hlsDownloader) filterSegments(t *track, segments []*segment) {
+	if h.segmentFilter == nil {
+		return
+	}
+	for _, segment := range segments {
+		if segment.skipReason == "" && !h.segmentFilter(segmentInfo(t, segment)) {
+			segment.skipReason = SkipFiltered
+		}
+	}
+}
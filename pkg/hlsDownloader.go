@@ -1,19 +1,23 @@
 package HLSDownloader
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// BarUpdater is a progress bar counting the segments, see SetBar. Progress also tells the
+// estimated size and the bytes of every segment.
 type BarUpdater interface {
 	SetTotal(total int)
 	Increment()
@@ -28,49 +32,319 @@ type hlsDownloader struct {
 	path      string
 	filename  string
 	extension string
-	tmpDir    string
+	outputs   []string
+	// baseURL resolves the relative URIs of the playlist instead of url
+	baseURL *url.URL
+	// mirrors are the alternate base URLs of the segments, see SetMirrors
+	mirrors          []*url.URL
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// breaker is the circuit breaker of the hosts of the running download
+	breaker *circuitBreaker
+	// playlistData is the playlist given to NewFromPlaylist, used instead of fetching url
+	playlistData []byte
+	// propagateQuery names the query parameters of url copied to every child request
+	propagateQuery []string
+	// variables are the EXT-X-DEFINE variables of the master playlist
+	variables map[string]string
+	// strict fails on the first playlist syntax error instead of skipping the faulty lines
+	strict bool
 
 	client *http.Client
 	header *http.Header
+	// logger receives the logs from logLevel on, see SetLogger
+	logger   Logger
+	logLevel LogLevel
+	// requestHooks modify every request of the download, see UseRequestHook
+	requestHooks []RequestHook
 
 	workers int
-	bar     BarUpdater
+	// readAhead bounds the segments downloaded past the next one to append, see SetReadAhead
+	readAhead int
+	progress  Progress
+	// progressHandler receives the events of the download, see OnProgress
+	progressHandler func(ProgressEvent)
+	eventMu         sync.Mutex
+	phase           int32
+	// events receives the events as well once Events is called
+	events    chan Event
+	hasEvents atomic.Bool
+	// keepSegmentsDir keeps the joined segments, see SetKeepSegments
+	keepSegmentsDir string
+
+	variantFilter  func(Variant) bool
+	allVariants    bool
+	variantPolicy  VariantPolicy
+	iframes        bool
+	alternateAudio bool
+	audioLanguage  string
+
+	subtitles        bool
+	subtitleLanguage string
+	subtitleFormat   SubtitleFormat
+
+	live          bool
+	lowLatency    bool
+	totalSegments int64
+	// stop is closed by Stop, it is created for every run, stopMu guards stop and stopOnce
+	stopMu   sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+	// followed is set while the running download follows a live or EVENT playlist, see Following
+	followed atomic.Bool
+
+	backoff backoff
+
+	pauseMu sync.Mutex
+	// resumed is closed by Resume, it is nil unless the download is paused
+	resumed chan struct{}
+
+	tolerateMissing bool
+	failurePolicy   FailurePolicy
+	maxFailures     int
+	gapFiller       []byte
+
+	splitOnDiscontinuity bool
+	archive              bool
+
+	startOffset bool
+	windowFrom  time.Time
+	windowTo    time.Time
+	clipStart   time.Duration
+	clipEnd     time.Duration
+	reportMu    sync.Mutex
+	skipped     []SkippedRange
+
+	skipAds  bool
+	adBreaks []AdBreak
+	clips    []ClippedRange
+
+	closedCaptions bool
+	// cea708 lists the outputs whose CEA-708 captions were not extracted, see Report
+	cea708   []string
+	muxAudio bool
+
+	timedMetadata   bool
+	reportFile      bool
+	metadataHandler func(MetadataEvent)
+
+	keyProvider  KeyProvider
+	keyClient    *http.Client
+	keyHeader    *http.Header
+	keyFile      []byte
+	keystore     map[string][]byte
+	contentKeys  map[string][]byte
+	drmDecrypter DRMDecrypter
+	// keepPadding leaves the padding of the last block of AES-128 segments in place
+	keepPadding bool
+	ivStrategy  IVStrategy
+	keys        *keyCache
+	slots       chan int
+	// stats gathers the progress of the running download, read by Stats from any goroutine
+	stats atomic.Pointer[statsCollector]
+	// ctx is the context of the running download, cancelling it aborts every request
+	ctx context.Context
+	// fetcher sends the requests of the running download, see newFetcher
+	fetcher  Fetcher
+	timeouts Timeouts
+	// transportOptions tunes the transport of the client, see SetTransportOptions
+	transportOptions TransportOptions
+	dns              DNSOptions
+	// http3 is the RoundTripper of the HTTP/3 requests, see SetHTTP3Transport
+	http3     http.RoundTripper
+	rateLimit int64
+	// requestDelayMin and requestDelayMax bound the pause of a worker between two segments
+	requestDelayMin time.Duration
+	requestDelayMax time.Duration
+	// limiter is the bandwidth limiter shared by the workers of the running download
+	limiter           *rateLimiter
+	memoryBufferLimit int64
+	memoryLimit       int64
+	// memory accounts for the segments of the running download buffered in memory, decryptMemory
+	// for the buffers they are verified and decrypted in
+	memory        *memoryBuffer
+	decryptMemory *memoryBudget
+
+	resume    bool
+	stateFile string
+	// keepPartial joins the segments downloaded so far when the download is cancelled
+	keepPartial bool
+	// requestedOutput is the output given to New, the job state file is named after it
+	requestedOutput string
+	state           *jobState
+
+	diskSpaceCheck DiskSpaceCheck
+	// estimatedSize is the size of the running download estimated by the disk space check
+	estimatedSize int64
+	verifyTS      bool
+	// segmentVerifier checks every downloaded segment, see SetSegmentVerifier
+	segmentVerifier SegmentVerifier
+	// segmentFilter leaves out the segments it rejects, see SetSegmentFilter
+	segmentFilter func(SegmentInfo) bool
+
+	// stream receives the main track instead of the output file, see DownloadTo
+	stream io.Writer
+
+	// validated is set once Validate succeeded
+	validated bool
+	// manager runs the download as a job, sharing its workers, bandwidth and client, see Manager
+	manager *Manager
+	// customFetcher replaces the client, see SetFetcher
+	customFetcher Fetcher
+	// tracks are the tracks of the last download, selectedVariant its variant, see Result
+	tracks          []*track
+	selectedVariant *Variant
+	// segmentStore opens the stores replacing the temp dir, see SetSegmentStore
+	segmentStore func(track string) (SegmentStore, error)
+	// overwritePolicy tells what to do with the existing outputs, see SetOverwritePolicy
+	overwritePolicy OverwritePolicy
+	// outputBase is the output without extension when none was requested, see detectExtensions
+	outputBase string
+	// userAgent is the User-Agent of the requests, DefaultUserAgent when empty
+	userAgent string
+	// cookieJar is the jar of SetCookieJar, jar the one of the running download
+	cookieJar http.CookieJar
+	jar       http.CookieJar
+	// auth are the credentials of SetBasicAuth and SetDigestAuth
+	auth *credentials
+	// tokenSource returns the bearer token of the requests, see SetTokenSource
+	tokenSource TokenSource
+	// proxy is the proxy of the requests, see SetProxy
+	proxy *url.URL
+	// tlsConfig is the TLS configuration of the client, see SetTLSOptions
+	tlsConfig *tls.Config
+	// signer signs the URLs of the requests, see SetSigner
+	signer Signer
+	// transport is the configured copy of transportBase, the transport of the client, reused by
+	// the downloads until a setting it is built from changes, see configureClient
+	transport     *http.Transport
+	transportBase *http.Transport
+	// settingsMu guards the settings, they can not change while running is set
+	settingsMu sync.Mutex
+	running    bool
 }
 
+// New creates a downloader of the playlist at URL, a local path or file:// URL, into output.
+// It has no side effect: the URL and the output are checked by Validate, or once the download
+// starts.
+//
+// A downloader runs one download at a time, starting another one while it runs fails with
+// ErrAlreadyRunning, as does changing its settings. Stats, Report, Outputs, Pause, Resume and
+// Stop can be called from any goroutine.
 func New(URL string, output string) (*hlsDownloader, error) {
-	DisableLogs()
-	out, err := validateParameters(URL, output)
+	if URL == "" {
+		return nil, errors.New("url is empty")
+	}
+	var err error
+	if isLocalPlaylist(URL) {
+		URL, err = fileURL(URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h := newHLSDownloader(URL)
+	h.requestedOutput = output
+	return h, nil
+}
+
+// NewFromPlaylist creates a downloader for a playlist that was already fetched, e.g. behind
+// a custom authentication. Its relative URIs are resolved against baseURL, which is
+// fetched again whenever a live or EVENT media playlist is refreshed.
+func NewFromPlaylist(r io.Reader, baseURL string, output string) (*hlsDownloader, error) {
+	if r == nil {
+		return nil, errors.New("playlist reader is nil")
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || !u.IsAbs() {
+		return nil, errors.New("base url must be an absolute url")
+	}
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	h := newHLSDownloader(baseURL)
+	h.playlistData = data
+	h.requestedOutput = output
+	return h, nil
+}
+
+// Validate checks that the playlist can be fetched and that the output can be written, and
+// picks the output file, applying the overwrite policy when it already exists, see
+// SetOverwritePolicy. The download validates first unless Validate already succeeded, calling
+// it beforehand lets a caller bound the checks with ctx.
+func (h *hlsDownloader) Validate(ctx context.Context) error {
+	if h == nil {
+		return errors.New("instance is nil")
+	}
+	if ctx == nil {
+		return errors.New("context is nil")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	return h.validate(ctx)
+}
+
+func (h *hlsDownloader) validate(ctx context.Context) error {
+	// the playlist of NewFromPlaylist is already there
+	if h.playlistData == nil {
+		if err := h.validateURL(withRequestHooks(ctx, h.requestHooks)); err != nil {
+			return err
+		}
+	}
+	out, err := validateOutput(h.requestedOutput, h.overwritePolicy, h.log())
+	if err != nil {
+		return err
+	}
+	if err := validateOutputPermission(out); err != nil {
+		return err
+	}
+	h.output, h.path, h.filename, h.extension = out.output, out.path, out.filename, out.extension
+	h.outputBase = out.base
+	h.validated = true
+	return nil
+}
+
+func newHLSDownloader(URL string) *hlsDownloader {
 	return &hlsDownloader{
 		header: &http.Header{},
 		client: &http.Client{},
 
 		url: URL,
 
-		output:    out.output,
-		path:      out.path,
-		filename:  out.filename,
-		extension: out.extension,
+		workers:  defaultWorkers,
+		logLevel: LogInfo,
 
-		workers: defaultWorkers,
+		variantPolicy:  HighestBandwidth,
+		alternateAudio: true,
+		lowLatency:     true,
+		startOffset:    true,
 
-		bar: nil,
-	}, nil
+		stop: make(chan struct{}),
+	}
 }
 
 func (h *hlsDownloader) SetClient(client *http.Client) error {
 	if h == nil {
 		return errors.New("attempt to set client on nil instance")
 	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
 	h.client = client
+	h.resetTransport()
 	return nil
 }
 func (h *hlsDownloader) SetHeader(header *http.Header) error {
 	if h == nil {
 		return errors.New("attempt to set header on nil instance")
 	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
 	h.header = header
 	return nil
 }
@@ -78,201 +352,1016 @@ func (h *hlsDownloader) SetWorkers(workers int) error {
 	if h == nil {
 		return errors.New("attempt to set workers on nil instance")
 	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
 	if workers < 1 {
 		return errors.New("workers must be greater than 0")
 	}
 	h.workers = workers
+	h.resetTransport()
 	return nil
 }
+
+// SetBar sets a progress bar counting the segments, it replaces the Progress of SetProgress
 func (h *hlsDownloader) SetBar(externalBar BarUpdater) error {
 	if h == nil {
 		return errors.New("attempt to set bar on nil instance")
 	}
-	h.bar = externalBar
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.progress = nil
+	if externalBar != nil {
+		h.progress = barProgress{bar: externalBar}
+	}
 	return nil
 }
 
-func (h *hlsDownloader) Download() (string, error) {
+// SetLenientParsing sets whether playlists with syntax errors are parsed anyway, skipping the
+// faulty lines with a warning. It is enabled by default, disabling it fails on the first error.
+func (h *hlsDownloader) SetLenientParsing(enabled bool) error {
 	if h == nil {
-		return "", errors.New("instance is nil")
+		return errors.New("attempt to set lenient parsing on nil instance")
 	}
-	segments, err := parseHLSSegments(h.url, h.header)
-	log.Printf("Total Segments: %d", len(segments))
-	if err != nil {
-		return "", err
+	if err := h.lockSettings(); err != nil {
+		return err
 	}
+	defer h.settingsMu.Unlock()
+	h.strict = !enabled
+	return nil
+}
 
-	err = os.MkdirAll(h.path, os.ModePerm)
+// SetVariantPolicy sets how a variant is picked when the URL points to a master playlist
+func (h *hlsDownloader) SetVariantPolicy(policy VariantPolicy) error {
+	if h == nil {
+		return errors.New("attempt to set variant policy on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if policy != HighestBandwidth && policy != LowestBandwidth {
+		return errors.New("invalid variant policy")
+	}
+	h.variantPolicy = policy
+	return nil
+}
+
+// SetAllVariants downloads every variant of a master playlist the variant filter accepts
+// into its own <output>_<height>p_<bandwidth>k file, instead of the one the variant policy picks
+func (h *hlsDownloader) SetAllVariants(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set all variants on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.allVariants = enabled
+	return nil
+}
+
+// SetVariantFilter restricts the variants of a master playlist the variant policy picks from,
+// e.g. hls.SetVariantFilter(VariantCriteria{MaxHeight: 720}.Match). A nil filter accepts every variant.
+func (h *hlsDownloader) SetVariantFilter(filter func(Variant) bool) error {
+	if h == nil {
+		return errors.New("attempt to set variant filter on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.variantFilter = filter
+	return nil
+}
+
+// SetIFrames downloads the I-frame only (trick play) variant of a master playlist instead
+// of a regular one, producing a keyframes only output for thumbnails or fast seeking
+func (h *hlsDownloader) SetIFrames(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set iframes on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.iframes = enabled
+	return nil
+}
+
+// SetAlternateAudio enables or disables downloading the EXT-X-MEDIA audio rendition
+// referenced by the selected variant into a separate output file (enabled by default)
+func (h *hlsDownloader) SetAlternateAudio(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set alternate audio on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.alternateAudio = enabled
+	return nil
+}
+
+// SetAudioLanguage sets the preferred language of the alternate audio rendition
+func (h *hlsDownloader) SetAudioLanguage(language string) error {
+	if h == nil {
+		return errors.New("attempt to set audio language on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.audioLanguage = language
+	return nil
+}
+
+// SetSubtitles enables downloading the WebVTT subtitle rendition referenced by
+// the selected variant into a sidecar file next to the output
+func (h *hlsDownloader) SetSubtitles(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set subtitles on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.subtitles = enabled
+	return nil
+}
+
+// SetSubtitleLanguage sets the preferred language of the subtitle rendition
+func (h *hlsDownloader) SetSubtitleLanguage(language string) error {
+	if h == nil {
+		return errors.New("attempt to set subtitle language on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.subtitleLanguage = language
+	return nil
+}
+
+// SetSubtitleFormat sets the format of the subtitle sidecar file (WebVTT by default)
+func (h *hlsDownloader) SetSubtitleFormat(format SubtitleFormat) error {
+	if h == nil {
+		return errors.New("attempt to set subtitle format on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if format != WebVTT && format != SRT {
+		return errors.New("invalid subtitle format")
+	}
+	h.subtitleFormat = format
+	return nil
+}
+
+// SetSplitOnDiscontinuity writes the output into a new file at every EXT-X-DISCONTINUITY
+// (output_part1.ts, output_part2.ts, ...) instead of concatenating across them
+func (h *hlsDownloader) SetSplitOnDiscontinuity(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set split on discontinuity on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.splitOnDiscontinuity = enabled
+	return nil
+}
+
+// Outputs returns every file written by the last download, the main output first, nil while
+// a download is running
+func (h *hlsDownloader) Outputs() []string {
+	if h == nil {
+		return nil
+	}
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	if h.running {
+		return nil
+	}
+	return h.outputs
+}
+
+// Download downloads the playlist into the output and describes what it wrote, see Result
+func (h *hlsDownloader) Download() (Result, error) {
+	return h.DownloadContext(context.Background())
+}
+
+// DownloadContext downloads like Download, aborting every request, worker and the join
+// of the segments as soon as ctx is done, in which case the error of ctx is returned, or
+// the partial output with ErrInterrupted, see SetKeepPartial
+func (h *hlsDownloader) DownloadContext(ctx context.Context) (Result, error) {
+	if h == nil {
+		return Result{}, errors.New("instance is nil")
+	}
+	return h.downloadContext(ctx, nil)
+}
+
+// downloadContext runs a download, of the main track into stream when it is set
+func (h *hlsDownloader) downloadContext(ctx context.Context, stream io.Writer) (Result, error) {
+	if ctx == nil {
+		return Result{}, errors.New("context is nil")
+	}
+	if err := h.start(); err != nil {
+		return Result{}, err
+	}
+	defer h.finish()
+	h.stream = stream
+	return h.runDownload(ctx)
+}
+
+// runDownload validates and runs the download, which is marked running
+func (h *hlsDownloader) runDownload(ctx context.Context) (Result, error) {
+	h.ctx = withRequestHooks(ctx, h.requestHooks)
+	if !h.validated {
+		if err := h.validate(h.ctx); err != nil {
+			return Result{}, err
+		}
+	}
+	output, err := h.download()
+	if errors.Is(err, ErrInterrupted) {
+		return h.result(output), err
+	}
+	if err != nil && ctx.Err() != nil {
+		return h.result(""), ctx.Err()
+	}
+	return h.result(output), err
+}
+
+// lockSettings locks the settings to change them, unless a download is running
+func (h *hlsDownloader) lockSettings() error {
+	h.settingsMu.Lock()
+	if h.running {
+		h.settingsMu.Unlock()
+		return ErrAlreadyRunning
+	}
+	return nil
+}
+
+// start marks the download running, the settings are left as they are until it finishes
+func (h *hlsDownloader) start() error {
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	h.running = true
+	// a Stop of the previous run does not stop this one
+	h.stopMu.Lock()
+	h.stop = make(chan struct{})
+	h.stopOnce = sync.Once{}
+	h.stopMu.Unlock()
+	h.settingsMu.Unlock()
+	return nil
+}
+
+func (h *hlsDownloader) finish() {
+	h.settingsMu.Lock()
+	h.stream = nil
+	h.running = false
+	h.settingsMu.Unlock()
+}
+
+func (h *hlsDownloader) download() (output string, err error) {
+	h.setPhase(PhaseResolving, nil)
+	defer func() {
+		h.setPhase(PhaseDone, err)
+	}()
+	h.jar = h.newCookieJar()
+	h.fetcher = h.newFetcher()
+	h.limiter = nil
+	if h.rateLimit > 0 {
+		h.limiter = newRateLimiter(h.rateLimit)
+	}
+	h.breaker = nil
+	if h.breakerThreshold > 0 {
+		h.breaker = newCircuitBreaker(h.breakerThreshold, h.breakerCooldown, h.log())
+	}
+	h.setupMemory()
+	if h.segmentStore != nil && h.resumable() {
+		h.log().warnf("Resumable downloads keep their segments on disk, segment store is not used\n")
+	}
+	h.keys = h.newKeyCache()
+	h.tracks, h.selectedVariant = nil, nil
+	h.followed.Store(false)
+	h.outputs = nil
+	h.skipped, h.cea708 = nil, nil
+	tracks, err := h.resolveTracks()
 	if err != nil {
 		return "", err
 	}
-	h.tmpDir, err = os.MkdirTemp("", "*-segments")
-	log.Printf("Temp Dir: %s", h.tmpDir)
+	tracks, err = h.checkStream(tracks)
 	if err != nil {
 		return "", err
 	}
-	defer os.RemoveAll(h.tmpDir)
-
-	err = h.processSegments(segments)
-	if err != nil {
+	h.applyStartOffset(tracks)
+	if err := h.applyClip(tracks); err != nil {
+		return "", err
+	}
+	if err := h.checkDRM(tracks); err != nil {
+		return "", err
+	}
+	if err := h.detectExtensions(tracks); err != nil {
 		return "", err
 	}
+	h.tracks = tracks
+	h.followed.Store(h.follows(tracks))
+	h.state = nil
+	if h.resumeEnabled() || h.stateFile != "" {
+		h.state, err = h.openJobState(tracks)
+		if err != nil {
+			return "", err
+		}
+	}
+	total := 0
+	for _, t := range tracks {
+		h.log().infof("Total Segments (%s): %d", t.name, len(t.segments))
+		total += len(t.segments)
+	}
 
-	filepath, err := h.join(segments)
+	err = os.MkdirAll(h.path, os.ModePerm)
 	if err != nil {
 		return "", err
 	}
+	if err := h.checkDiskSpace(tracks); err != nil {
+		return "", err
+	}
 
-	return filepath, nil
-}
+	atomic.StoreInt64(&h.totalSegments, int64(total))
+	if h.progress != nil {
+		h.progress.SetTotal(total, h.estimatedSize)
+	}
+	// the slots are numbered, so that the stats tell how busy every worker is
+	h.slots = make(chan int, h.workers)
+	for i := 0; i < h.workers; i++ {
+		h.slots <- i
+	}
+	stats := newStatsCollector(h.workers, h.live)
+	h.stats.Store(stats)
+	defer stats.finish()
+	h.adBreaks = nil
+	h.setPhase(PhaseDownloading, nil)
 
-func (h *hlsDownloader) join(segments []*segment) (string, error) {
-	file, err := os.Create(h.output)
+	errs := make(chan error, len(tracks))
+	for _, t := range tracks {
+		go func(t *track) {
+			errs <- h.downloadTrack(t)
+		}(t)
+	}
+	for range tracks {
+		if trackErr := <-errs; trackErr != nil && err == nil {
+			err = trackErr
+		}
+	}
 	if err != nil {
+		h.recordState(h.state.flush())
+		if h.keepPartial && h.ctx.Err() != nil {
+			return h.partialOutput(tracks)
+		}
 		return "", err
 	}
-	defer file.Close()
-
-	sort.Slice(segments, func(i, j int) bool {
-		return segments[i].SeqId < segments[j].SeqId
-	})
-
-	for _, segment := range segments {
+	h.setPhase(PhaseFinalizing, nil)
+	if h.state != nil {
+		if err := h.state.finish(); err != nil {
+			h.log().errorf("Failed to finish job state: %s\n", err.Error())
+		}
+	}
+	if h.progress != nil {
+		h.progress.Finished()
+	}
 
-		d, err := decrypt(segment, h.client)
+	if h.muxAudio && !h.archive {
+		if err := h.muxTracks(tracks); err != nil {
+			return "", err
+		}
+	}
+	for _, t := range tracks {
+		h.outputs = append(h.outputs, t.outputs...)
+	}
+	// archived segments are kept as served, the sidecars are extracted from joined outputs only
+	if h.closedCaptions && !h.archive {
+		sidecars, err := h.extractClosedCaptions(tracks[0])
 		if err != nil {
 			return "", err
 		}
-
-		if _, err := file.Write(d); err != nil {
+		h.outputs = append(h.outputs, sidecars...)
+	}
+	if (h.timedMetadata || h.metadataHandler != nil) && !h.archive {
+		sidecar, err := h.extractTimedMetadata(tracks)
+		if err != nil {
 			return "", err
 		}
-
-		if err := os.RemoveAll(segment.path); err != nil {
+		if sidecar != "" {
+			h.outputs = append(h.outputs, sidecar)
+		}
+	}
+	// the report lists every other output, it comes last
+	if h.reportFile {
+		path, err := h.writeReportFile(tracks)
+		if err != nil {
 			return "", err
 		}
+		h.outputs = append(h.outputs, path)
+	}
+	report := h.Report()
+	for _, r := range report.Skipped {
+		h.log().infof("Skipped segments %d-%d of %s: %s\n", r.From, r.To, r.Track, r.Reason)
+	}
+	for _, b := range report.AdBreaks {
+		h.log().infof("Ad break %s in segments %d-%d of %s (skipped: %t)\n", b.ID, b.From, b.To, b.Track, b.Skipped)
+	}
+	if len(tracks[0].outputs) > 0 {
+		return tracks[0].outputs[0], nil
 	}
-	log.Printf("Joined segments into %s", h.output)
 	return h.output, nil
 }
 
-func (h *hlsDownloader) downloadSegment(segment *segment) error {
-	req, err := newRequest(segment.URI, h.header)
+func (h *hlsDownloader) downloadTrack(t *track) (err error) {
+	if err = h.openStore(t); err != nil {
+		return err
+	}
+	defer func() {
+		// the segments of a failed download are kept for the next run to resume from
+		if err != nil && !h.resumable() {
+			h.dropStored(t)
+		}
+		if err == nil || !h.resumable() {
+			os.RemoveAll(t.existingTmpDir())
+		}
+	}()
+
+	defer func() {
+		if t.file != nil {
+			t.file.Close()
+		}
+	}()
+
+	var subtitles []*segment
+	for {
+		batch := t.segments
+		t.segments, err = h.clipByDateTime(t, batch)
+		if err != nil {
+			return err
+		}
+		h.skipAdSegments(t.segments)
+		h.filterSegments(t, t.segments)
+		err = h.processSegments(t)
+		if err != nil {
+			return err
+		}
+		if h.archive {
+			err = h.archiveSegments(t)
+		} else if t.subtitles {
+			subtitles = append(subtitles, t.segments...)
+		}
+		if err != nil {
+			return err
+		}
+		for _, segment := range batch {
+			if !t.started || segment.SeqId > t.lastSeq {
+				t.lastSeq = segment.SeqId
+				t.started = true
+			}
+		}
+
+		if !h.following(t) {
+			break
+		}
+		if h.usesParts(t) {
+			if _, err = h.appendParts(t); err != nil && !h.isStopped() {
+				return err
+			}
+		}
+		if !h.live && !t.waiting {
+			h.log().infof("Playlist (%s) is an EVENT playlist, waiting for EXT-X-ENDLIST\n", t.name)
+			t.waiting = true
+		}
+		err = h.refreshTrack(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.archive {
+		return h.writeArchivePlaylist(t)
+	}
+	if t.subtitles {
+		_, err = h.joinSubtitles(t, subtitles)
+		return err
+	}
+	if h.stream != nil {
+		h.log().infof("Streamed segments of %s", t.name)
+		return nil
+	}
+	if err = h.finishOutputFile(t); err != nil {
+		return err
+	}
+	h.log().infof("Joined segments into %s", strings.Join(t.outputs, ", "))
+	return nil
+}
+
+// finishOutputFile closes the output file of the track and moves it to its path, so that an
+// output file only appears there once complete
+func (h *hlsDownloader) finishOutputFile(t *track) error {
+	if t.file == nil {
+		return nil
+	}
+	file := t.file
+	t.file = nil
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), strings.TrimSuffix(file.Name(), partSuffix))
+}
+
+// partSuffix is added to the path of an output file until it is complete
+const partSuffix = ".part"
+
+// nextOutputFile closes the current output file of the track and creates the next one,
+// numbered when the output is split at discontinuities
+func (h *hlsDownloader) nextOutputFile(t *track) error {
+	if h.stream != nil {
+		t.out = h.stream
+		return nil
+	}
+	output := t.output
+	if h.splitOnDiscontinuity && !t.subtitles {
+		var err error
+		output, err = h.sidecarPath(t.output, fmt.Sprintf("_part%d", len(t.outputs)+1), filepath.Ext(t.output))
+		if err != nil {
+			return err
+		}
+	}
+	if t.file != nil {
+		if err := h.finishOutputFile(t); err != nil {
+			return err
+		}
+		h.log().infof("Discontinuity found, continuing in %s", output)
+	}
+	file, err := os.Create(output + partSuffix)
 	if err != nil {
 		return err
 	}
+	t.file = file
+	t.out = file
+	t.outputs = append(t.outputs, output)
+	t.initMap = nil
+	t.written = 0
+	return nil
+}
+
+// joinSegment decrypts the segment and appends it to the track output, skipped segments
+// are left out or replaced by the gap filler
+func (h *hlsDownloader) joinSegment(t *track, segment *segment) error {
+	// an interrupted download keeping its partial output still appends the downloaded segments
+	if err := h.ctx.Err(); err != nil && !h.keepPartial {
+		return err
+	}
 
-	res, err := h.client.Do(req)
+	h.recordAdBreak(t, segment)
+	if segment.Discontinuity {
+		t.discontinuity = true
+	}
+	if segment.skipReason != "" {
+		h.recordSkipped(t, segment)
+		if err := h.reportSegment(t, segment); err != nil {
+			return err
+		}
+		// ad breaks and filtered segments are cut out, not filled
+		if len(h.gapFiller) > 0 && segment.skipReason != SkipAd && segment.skipReason != SkipFiltered {
+			if _, err := t.out.Write(h.gapFiller); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if t.discontinuity && h.splitOnDiscontinuity && t.written > 0 {
+		if err := h.nextOutputFile(t); err != nil {
+			return err
+		}
+	}
+	t.discontinuity = false
+
+	if segment.isFMP4() && (t.initMap == nil || *t.initMap != *segment.Map) {
+		init, err := getInitSegment(h.ctx, segment, h.keys, !h.keepPadding, h.log(), h.header, h.fetcher)
+		if err != nil {
+			return err
+		}
+		if len(h.contentKeys) > 0 {
+			init, t.cenc, err = decryptInit(init, h.contentKeys)
+			if err != nil {
+				return err
+			}
+		}
+		if h.usesDRMDecrypter(t, segment) {
+			init, err = h.drmDecrypter.DecryptSegment(h.ctx, newDRMSegment(segment, true), init)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt init segment: %w", err)
+			}
+		}
+		if _, err := t.out.Write(init); err != nil {
+			return err
+		}
+		t.initMap = segment.Map
+	}
+
+	if err := h.writeSegment(t, segment); err != nil {
+		return err
+	}
+	t.written++
+	if err := h.recordJoined(t, segment); err != nil {
+		return err
+	}
+	if err := h.keepSegment(t, segment); err != nil {
+		return err
+	}
+
+	// resumable downloads keep the segments until the track is complete
+	if !h.resumable() {
+		return h.releaseSegment(segment)
+	}
+	return nil
+}
+
+// writeSegment decrypts the segment into the track output. Segments whose samples are decrypted
+// with content keys or by the DRM decrypter are decrypted in memory, the others as they are written.
+func (h *hlsDownloader) writeSegment(t *track, segment *segment) error {
+	cenc := segment.isFMP4() && t.cenc != nil
+	drm := h.usesDRMDecrypter(t, segment)
+	if !cenc && !drm {
+		return decrypt(t.out, segment, h.keys, !h.keepPadding, h.log())
+	}
+
+	size, err := h.reserveDecryption(segment)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
+	defer h.decryptMemory.release(size)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := decrypt(buf, segment, h.keys, !h.keepPadding, h.log()); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if cenc {
+		err = t.cenc.decryptFragments(data)
+	} else {
+		data, err = h.drmDecrypter.DecryptSegment(h.ctx, newDRMSegment(segment, false), data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decrypt segment %d: %w", segment.SeqId, err)
+	}
+	_, err = t.out.Write(data)
+	return err
+}
+
+func (h *hlsDownloader) downloadSegment(t *track, segment *segment) error {
+	sink := segment.partial
+	segment.partial = nil
+	if sink == nil {
+		sink = h.newSegmentSink(t, segment)
+	}
+	if isDataURI(segment.URI) {
+		data, err := fetchResource(h.ctx, segment.URI, segment.Limit, segment.Offset, h.header, h.fetcher)
+		if err == nil {
+			_, err = sink.Write(data)
+		}
+		return sink.close(err)
+	}
+	ctx, cancel := h.segmentContext()
+	defer cancel(nil)
+	err := segmentError(ctx, h.fetchSegment(ctx, cancel, segment, sink))
+	// an interrupted transfer is resumed where it stopped by the next attempt
+	if err != nil && h.ctx.Err() == nil && isRetryable(err) && sink.resumable() {
+		segment.partial = sink
+		return err
+	}
+	return sink.close(err)
+}
 
-	if res.StatusCode != 200 {
-		return errors.New(res.Status)
+// throttle passes a response body through the rate limiters of the download and of its
+// manager, and counts the bytes read in the statistics
+func (h *hlsDownloader) throttle(ctx context.Context, body io.Reader) io.Reader {
+	if h.limiter != nil {
+		body = &limitedReader{ctx: ctx, r: body, limiter: h.limiter}
+	}
+	if h.manager != nil && h.manager.limiter != nil {
+		body = &limitedReader{ctx: ctx, r: body, limiter: h.manager.limiter}
 	}
+	return &countingReader{r: body, stats: h.stats.Load()}
+}
 
-	file, err := os.Create(segment.path)
+func (h *hlsDownloader) fetchSegment(ctx context.Context, cancel context.CancelCauseFunc, segment *segment, sink *segmentSink) error {
+	req, err := newRequest(ctx, h.segmentURL(sink.t, segment), h.header)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	resumed := sink.written
+	if resumed > 0 {
+		h.log().debugf("Resuming segment %d at byte %d\n", segment.SeqId, resumed)
+		setResumeRange(req, segment, sink)
+	} else if segment.Limit > 0 {
+		setRange(req, segment.Offset, segment.Limit)
+	}
+
+	res, err := h.fetch(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	partial := res.StatusCode == http.StatusPartialContent
+	if res.StatusCode != http.StatusOK && !(partial && (segment.Limit > 0 || resumed > 0)) {
+		return newStatusError(res)
+	}
+	if resumed > 0 && !(partial && contentRangeStart(res) == segment.Offset+resumed) {
+		// the resource changed or the server ignored the Range header, the segment starts over
+		if err := sink.reset(); err != nil {
+			return err
+		}
+		resumed = 0
+	}
+	if resumed == 0 {
+		sink.validator = responseValidator(res)
+	}
+
+	body := h.throttle(ctx, res.Body)
+	if h.timeouts.Stall > 0 {
+		stall := newStallReader(body, h.timeouts.Stall, cancel)
+		defer stall.stop()
+		body = stall
+	}
+	if segment.Limit > 0 {
+		if res.StatusCode == http.StatusOK {
+			// the server ignored the Range header and sent the whole resource
+			if _, err := io.CopyN(io.Discard, body, segment.Offset); err != nil {
+				return err
+			}
+		}
+		body = io.LimitReader(body, segment.Limit-resumed)
+	}
 
-	_, err = io.Copy(file, res.Body)
+	chunk := getChunk()
+	defer putChunk(chunk)
+	n, err := io.CopyBuffer(sink, body, *chunk)
 	if err != nil {
 		return err
 	}
+	return checkSegmentLength(segment, res, resumed, n)
+}
+
+// checkSegmentLength verifies that the whole segment was received, an empty or truncated
+// segment is retried instead of silently corrupting the output. resumed is how many bytes
+// were received before the response, n how many were received with it.
+func checkSegmentLength(segment *segment, res *http.Response, resumed int64, n int64) error {
+	expected := res.ContentLength
+	if segment.Limit > 0 {
+		expected = segment.Limit - resumed
+	}
+	if expected >= 0 && n < expected {
+		return fmt.Errorf("segment truncated, received %d of %d bytes: %w", resumed+n, resumed+expected, io.ErrUnexpectedEOF)
+	}
+	if resumed+n == 0 {
+		return errEmptySegment
+	}
 	return nil
 }
 
 func (h *hlsDownloader) downloadSegments(wc *workerController) {
 	defer wc.wg.Done()
-	maxAttempts := 3
+	first := true
 	for segment := range wc.segments {
-		attempts := 0
-		for {
-			if h.isAbort(wc) {
-				close(wc.downloadResult)
+		if !first && h.requestDelayMax > 0 {
+			select {
+			case <-time.After(h.requestDelay()):
+			case <-wc.abort:
 				return
 			}
-			err := h.downloadSegment(segment)
-			if err == nil {
-				log.Printf("Downloaded segment %d\n", segment.SeqId)
-				wc.downloadResult <- &downloadResult{seqId: segment.SeqId}
-				break
+		}
+		first = false
+		if !h.downloadWithRetries(wc, segment) {
+			return
+		}
+	}
+}
+
+// downloadWithRetries downloads the segment, retrying it after transient errors, and reports
+// the result. It returns false when the download is aborted meanwhile.
+func (h *hlsDownloader) downloadWithRetries(wc *workerController, segment *segment) bool {
+	defer h.dropPartial(segment)
+	attempts := 0
+	for {
+		if h.isAbort(wc) || !h.waitResumed(wc) || !h.backoff.wait(wc.abort) || !h.waitCircuit(wc, segment) {
+			return false
+		}
+		var slot int
+		select {
+		case slot = <-h.slots:
+		case <-wc.abort:
+			return false
+		}
+		if h.manager != nil && !h.manager.acquireSlot(wc.abort) {
+			h.slots <- slot
+			return false
+		}
+		h.stats.Load().acquired(slot)
+		if segment.attempts == 0 {
+			segment.fetchStart = time.Now()
+		}
+		segment.attempts++
+		h.segmentEvent(EventStarted, wc.track, segment, attempts+1, nil)
+		host := h.segmentHost(wc.track, segment)
+		err := h.downloadSegment(wc.track, segment)
+		if err == nil {
+			err = h.verifySegment(wc.track, segment)
+		}
+		h.stats.Load().released(slot)
+		h.slots <- slot
+		if h.manager != nil {
+			h.manager.releaseSlot()
+		}
+		if host != "" && h.ctx.Err() == nil {
+			h.breaker.record(host, err)
+		}
+		segment.fetchTime = time.Since(segment.fetchStart)
+		if err == nil {
+			h.log().debugf("Downloaded segment %d\n", segment.SeqId)
+			h.recordDownloaded(wc.track, segment)
+			h.segmentEvent(EventCompleted, wc.track, segment, attempts+1, nil)
+			size := segmentSize(segment)
+			wc.sendResult(&downloadResult{seqId: segment.SeqId, bytes: size})
+			return true
+		}
+		// errors caused by the cancellation of the download are not retried
+		if h.ctx.Err() == nil && isRetryable(err) {
+			limit, delay := maxRetries, retryDelay(attempts+1)
+			if retryAfter, limited := rateLimited(err); limited {
+				// the server is asked less often by every worker until it accepts requests again
+				limit = maxRateLimitRetries
+				if retryAfter > 0 {
+					delay = retryAfter
+				}
+				h.backoff.delay(delay)
 			}
-			connectionReset := strings.Contains(err.Error(), "connection reset by peer")
-			if connectionReset && attempts < maxAttempts {
+			if attempts < limit {
+				h.segmentEvent(EventRetried, wc.track, segment, attempts+1, err)
 				attempts++
-				time.Sleep(time.Second)
-				log.Printf("Connection reset by peer, retrying download of segment %d. Attempt #%d\n", segment.SeqId, attempts)
+				h.log().debugf("Error downloading segment %d: %s, retrying in %s. Attempt #%d\n", segment.SeqId, err.Error(), delay.Round(time.Millisecond), attempts)
+				select {
+				case <-time.After(delay):
+				case <-wc.abort:
+					return false
+				}
 				continue
 			}
-			log.Printf("Error downloading segment %d: %s\n", segment.SeqId, err.Error())
-			wc.downloadResult <- &downloadResult{err: err, seqId: segment.SeqId}
-			break
 		}
+		if h.nextMirror(segment) {
+			h.segmentEvent(EventRetried, wc.track, segment, attempts+1, err)
+			attempts = 0
+			h.log().debugf("Error downloading segment %d: %s, trying %s\n", segment.SeqId, err.Error(), h.segmentURL(wc.track, segment))
+			continue
+		}
+		if h.skipsFailed(err) {
+			segment.skipReason = SkipMissing
+			if !isMissing(err) {
+				h.log().warnf("Error downloading segment %d: %s, skipping it\n", segment.SeqId, err.Error())
+				segment.skipReason = SkipFailed
+			}
+			h.recordState(h.state.skipped(wc.track, segment))
+			failure := newSegmentDownloadError(segment, h.segmentURL(wc.track, segment), err)
+			h.segmentEvent(EventSkipped, wc.track, segment, attempts+1, failure)
+			wc.sendResult(&downloadResult{seqId: segment.SeqId, failure: failure})
+			return true
+		}
+		h.log().errorf("Error downloading segment %d: %s\n", segment.SeqId, err.Error())
+		h.recordState(h.state.failed(wc.track, segment, err))
+		// the cancellation of the download is returned as is
+		if h.ctx.Err() == nil {
+			err = newSegmentDownloadError(segment, h.segmentURL(wc.track, segment), err)
+			h.segmentEvent(EventFailed, wc.track, segment, attempts+1, err)
+		}
+		wc.sendResult(&downloadResult{err: err, seqId: segment.SeqId})
+		return true
 	}
 }
 
 func (h *hlsDownloader) isAbort(wc *workerController) bool {
 	select {
 	case <-wc.abort:
-		log.Printf("Abort signal received\n")
+		h.log().infof("Abort signal received\n")
 		return true
 	default:
 	}
 	return false
 }
 
-func (h *hlsDownloader) prepareSegments(segments []*segment, wc *workerController) {
+func (h *hlsDownloader) prepareSegments(t *track, wc *workerController) {
 	defer close(wc.segments)
-	for _, segment := range segments {
+	for i, segment := range t.segments {
 		if h.isAbort(wc) {
 			return
 		}
-		segName := fmt.Sprintf("seg%d.ts", segment.SeqId)
-		segment.path = filepath.Join(h.tmpDir, segName)
-		wc.segments <- segment
+		if wc.writer != nil && !wc.writer.waitWindow(i, h.readAheadSegments(), wc.abort) {
+			return
+		}
+		if segment.skipReason != "" {
+			h.recordState(h.state.skipped(t, segment))
+			wc.sendResult(&downloadResult{seqId: segment.SeqId})
+			continue
+		}
+		if size, ok := h.state.downloadedBytes(t, segment); ok {
+			segment.store, segment.size = t.store, size
+			h.log().debugf("Segment %d already downloaded\n", segment.SeqId)
+			wc.sendResult(&downloadResult{seqId: segment.SeqId})
+			continue
+		}
+		select {
+		case wc.segments <- segment:
+		case <-wc.abort:
+			return
+		}
 	}
 }
 
-func (h *hlsDownloader) processSegments(segments []*segment) error {
+func (h *hlsDownloader) processSegments(t *track) error {
 	wc := &workerController{
+		track:          t,
 		wg:             sync.WaitGroup{},
 		segments:       make(chan *segment),
 		downloadResult: make(chan *downloadResult),
 		abort:          make(chan struct{}),
 		success:        make(chan struct{}),
 	}
-	if h.bar != nil {
-		h.bar.SetTotal(len(segments))
+	// the segments are joined while the next ones are downloaded, archives and subtitles
+	// are written once the whole batch is downloaded
+	var writer *segmentWriter
+	var written <-chan struct{}
+	if !h.archive && !t.subtitles {
+		writer = h.startSegmentWriter(t)
+		written = writer.done
+		wc.writer = writer
 	}
 	for i := 0; i < h.workers; i++ {
 		wc.wg.Add(1)
 		go h.downloadSegments(wc)
 	}
-	go h.prepareSegments(segments, wc)
+	go h.prepareSegments(t, wc)
 
 	go func() {
 		wc.wg.Wait()
-		wc.success <- struct{}{}
+		close(wc.success)
 	}()
 
+	abort := func(err error) error {
+		close(wc.abort)
+		if writer != nil {
+			writer.stop()
+		}
+		return err
+	}
+	interrupted := func() error {
+		if h.keepPartial && writer != nil {
+			return h.finishPartial(t, wc, writer)
+		}
+		return abort(h.ctx.Err())
+	}
 	for {
 		select {
 		case <-wc.success:
-			if h.bar != nil {
-				h.bar.Complete()
+			if writer != nil {
+				return writer.wait()
 			}
 			return nil
+		case <-written:
+			written = nil
+			if writer.err != nil {
+				return abort(writer.err)
+			}
+		case <-h.ctx.Done():
+			return interrupted()
 		case result := <-wc.downloadResult:
+			if result.err != nil && h.ctx.Err() != nil {
+				return interrupted()
+			}
 			if result.err != nil {
-				close(wc.abort)
-				return result.err
+				return abort(result.err)
+			}
+			if err := h.countFailure(t, result.failure); err != nil {
+				return abort(err)
+			}
+			if writer != nil {
+				writer.ready <- result.seqId
 			}
-			if h.bar != nil {
-				h.bar.Increment()
+			h.stats.Load().done.Add(1)
+			if h.progress != nil {
+				h.progress.SegmentDone(result.seqId, result.bytes)
 			}
 		}
 	}
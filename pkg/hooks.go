@@ -0,0 +1,57 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// RequestHook modifies a request before it is sent, e.g. to sign its URL or to add a fresh
+// token. An error aborts the request.
+type RequestHook func(*http.Request) error
+
+// requestHooksKey is the context key of the request hooks of a download
+type requestHooksKey struct{}
+
+// UseRequestHook adds a hook called with every playlist, segment and key request of the
+// download, in the order they were added. The hooks are called concurrently by the workers
+// and receive a copy of the header, see SetHeader, which they can change.
+func (h *hlsDownloader) UseRequestHook(hook RequestHook) error {
+	if h == nil {
+		return errors.New("attempt to use request hook on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if hook == nil {
+		return errors.New("request hook is nil")
+	}
+	h.requestHooks = append(h.requestHooks, hook)
+	return nil
+}
+
+// withRequestHooks returns ctx carrying the hooks, every request built with it by newRequest
+// passes through them
+func withRequestHooks(ctx context.Context, hooks []RequestHook) context.Context {
+	if len(hooks) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, requestHooksKey{}, hooks)
+}
+
+// applyRequestHooks calls the hooks carried by the context of the request
+func applyRequestHooks(req *http.Request) error {
+	hooks, _ := req.Context().Value(requestHooksKey{}).([]RequestHook)
+	if len(hooks) == 0 {
+		return nil
+	}
+	cloneRequestHeader(req)
+	for _, hook := range hooks {
+		if err := hook(req); err != nil {
+			return fmt.Errorf("request hook: %w", err)
+		}
+	}
+	return nil
+}
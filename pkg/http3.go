@@ -0,0 +1,61 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// SetHTTP3Transport requests the playlists, keys and segments over HTTP/3 (QUIC) through the
+// given RoundTripper, e.g. the http3.RoundTripper of github.com/quic-go/quic-go, which this
+// package does not depend on. The first request failing over HTTP/3, e.g. where UDP is blocked,
+// switches the rest of the download to the transport of the client. Nil disables it.
+func (h *hlsDownloader) SetHTTP3Transport(roundTripper http.RoundTripper) error {
+	if h == nil {
+		return errors.New("attempt to set HTTP/3 transport on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.http3 = roundTripper
+	return nil
+}
+
+// http3Transport sends the requests over HTTP/3, falling back to the other transport for good
+// once HTTP/3 fails
+type http3Transport struct {
+	http3    http.RoundTripper
+	fallback http.RoundTripper
+	failed   atomic.Bool
+	log      levelLogger
+}
+
+// withHTTP3 returns a copy of the client sending its requests over HTTP/3, when enabled
+func (h *hlsDownloader) withHTTP3(client *http.Client) *http.Client {
+	if h.http3 == nil {
+		return client
+	}
+	fallback := client.Transport
+	if fallback == nil {
+		fallback = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &http3Transport{http3: h.http3, fallback: fallback, log: h.log()}
+	return &c
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.failed.Load() {
+		return t.fallback.RoundTrip(req)
+	}
+	res, err := t.http3.RoundTrip(req)
+	// requests with a body can not be sent again, cancelled ones must not
+	if err == nil || req.Body != nil || req.Context().Err() != nil {
+		return res, err
+	}
+	if !t.failed.Swap(true) {
+		t.log.warnf("HTTP/3 request to %s failed: %s, falling back to HTTP/1.1 and HTTP/2\n", req.URL.Host, err.Error())
+	}
+	return t.fallback.RoundTrip(req)
+}
@@ -0,0 +1,343 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// transportStreamTimestamp is the PRIV frame owner carrying the PTS of packed audio segments
+const transportStreamTimestamp = "com.apple.streaming.transportStreamTimestamp"
+
+// ID3Frame is a single frame of an ID3 tag. Text frames carry their text in Value,
+// TXXX, WXXX, COMM and PRIV frames their description or owner in Description and
+// PRIV frames their payload in Data.
+type ID3Frame struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+// MetadataEvent is an ID3 tag found in a track, Time is the position in seconds
+// from the start of the output it was found in
+type MetadataEvent struct {
+	Track  string     `json:"track"`
+	Output string     `json:"output"`
+	Time   float64    `json:"time"`
+	PTS    int64      `json:"pts"`
+	Frames []ID3Frame `json:"frames"`
+}
+
+// SetTimedMetadata writes the ID3 timed metadata of the main and audio tracks
+// into a <output>.id3.json sidecar
+func (h *hlsDownloader) SetTimedMetadata(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set timed metadata on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.timedMetadata = enabled
+	return nil
+}
+
+// SetMetadataHandler calls handler with every ID3 timed metadata event once the download completes
+func (h *hlsDownloader) SetMetadataHandler(handler func(MetadataEvent)) error {
+	if h == nil {
+		return errors.New("attempt to set metadata handler on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.metadataHandler = handler
+	return nil
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// id3Size returns the size of the ID3 tag at the start of data, 0 when there is none
+func id3Size(data []byte) int {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return 0
+	}
+	size := 10 + syncsafe(data[6:10])
+	if data[5]&0x10 != 0 {
+		// footer
+		size += 10
+	}
+	return size
+}
+
+func decodeID3Text(encoding byte, b []byte) string {
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			bigEndian, b = false, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			bigEndian, b = true, b[2:]
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(b[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(b[i:]))
+			}
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	case 3:
+		return strings.TrimRight(string(b), "\x00")
+	}
+	runes := make([]rune, 0, len(b))
+	for _, c := range b {
+		runes = append(runes, rune(c))
+	}
+	return strings.TrimRight(string(runes), "\x00")
+}
+
+// splitID3Text splits a description from the value following it, the terminator
+// is two bytes long in UTF-16
+func splitID3Text(encoding byte, b []byte) ([]byte, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+func parseID3Frame(id string, b []byte) ID3Frame {
+	frame := ID3Frame{ID: id}
+	switch {
+	case id == "PRIV":
+		owner, data := splitID3Text(0, b)
+		frame.Description = string(owner)
+		frame.Data = data
+	case len(b) == 0:
+	case id == "TXXX" || id == "WXXX":
+		description, value := splitID3Text(b[0], b[1:])
+		frame.Description = decodeID3Text(b[0], description)
+		if id == "WXXX" {
+			frame.Value = decodeID3Text(0, value)
+		} else {
+			frame.Value = decodeID3Text(b[0], value)
+		}
+	case id == "COMM" && len(b) >= 4:
+		description, value := splitID3Text(b[0], b[4:])
+		frame.Description = decodeID3Text(b[0], description)
+		frame.Value = decodeID3Text(b[0], value)
+	case id[0] == 'T':
+		frame.Value = decodeID3Text(b[0], b[1:])
+	case id[0] == 'W':
+		frame.Value = decodeID3Text(0, b)
+	default:
+		frame.Data = b
+	}
+	return frame
+}
+
+// parseID3 returns the frames of an ID3v2.3/2.4 tag
+func parseID3(tag []byte) []ID3Frame {
+	size := id3Size(tag)
+	if size == 0 || size > len(tag) {
+		return nil
+	}
+	version := tag[3]
+	body := tag[10 : 10+syncsafe(tag[6:10])]
+	if tag[5]&0x40 != 0 && len(body) >= 4 {
+		// skip the extended header
+		extended := int(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			extended = syncsafe(body)
+		}
+		if extended > len(body) {
+			return nil
+		}
+		body = body[extended:]
+	}
+
+	var frames []ID3Frame
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		frameSize := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			frameSize = syncsafe(body[4:8])
+		}
+		if 10+frameSize > len(body) {
+			break
+		}
+		frames = append(frames, parseID3Frame(id, body[10:10+frameSize]))
+		body = body[10+frameSize:]
+	}
+	return frames
+}
+
+// id3Timestamp returns the PTS of the transportStreamTimestamp PRIV frame
+func id3Timestamp(frames []ID3Frame) (int64, bool) {
+	for _, frame := range frames {
+		if frame.ID == "PRIV" && frame.Description == transportStreamTimestamp && len(frame.Data) == 8 {
+			return int64(binary.BigEndian.Uint64(frame.Data) & (1<<33 - 1)), true
+		}
+	}
+	return 0, false
+}
+
+// readTSMetadata collects the ID3 tags of the timed metadata streams of a transport stream
+func readTSMetadata(file *os.File) ([]MetadataEvent, int64, error) {
+	var events []MetadataEvent
+	var base int64
+	baseSet := false
+	err := demuxTS(file, func(byte) bool { return true }, func(pes *pesPacket) error {
+		if !pes.hasPTS {
+			return nil
+		}
+		if !baseSet || pes.pts < base {
+			base, baseSet = pes.pts, true
+		}
+		if pes.streamType != streamTypeMetadata {
+			return nil
+		}
+		for data := pes.data; id3Size(data) > 0 && id3Size(data) <= len(data); data = data[id3Size(data):] {
+			events = append(events, MetadataEvent{PTS: pes.pts, Frames: parseID3(data)})
+		}
+		return nil
+	})
+	return events, base, err
+}
+
+// readPackedAudioMetadata walks the ADTS frames of packed audio, every segment of
+// which starts with an ID3 tag carrying its timestamp
+func readPackedAudioMetadata(file *os.File) ([]MetadataEvent, int64, error) {
+	r := bufio.NewReader(file)
+	head, _ := r.Peek(10)
+	if !isPackedAudio(head) {
+		// neither packed audio nor a transport stream
+		return nil, 0, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	var events []MetadataEvent
+	var base int64
+	baseSet := false
+	for i := 0; i+10 <= len(data); {
+		if size := id3Size(data[i:]); size > 0 {
+			if i+size > len(data) {
+				break
+			}
+			event := MetadataEvent{Frames: parseID3(data[i : i+size])}
+			if pts, ok := id3Timestamp(event.Frames); ok {
+				event.PTS = pts
+				if !baseSet {
+					base, baseSet = pts, true
+				}
+			}
+			events = append(events, event)
+			i += size
+			continue
+		}
+		if data[i] == 0xFF && data[i+1]&0xF0 == 0xF0 {
+			length := int(data[i+3]&0x03)<<11 | int(data[i+4])<<3 | int(data[i+5])>>5
+			if length >= 7 {
+				i += length
+				continue
+			}
+		}
+		// not an ADTS frame, look for the next tag
+		next := bytes.Index(data[i+1:], []byte("ID3"))
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return events, base, nil
+}
+
+// readMetadata returns the ID3 timed metadata events of an output file
+func readMetadata(path string) ([]MetadataEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events, base, err := readTSMetadata(file)
+	if errors.Is(err, errNotTransportStream) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		events, base, err = readPackedAudioMetadata(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		events[i].Output = path
+		if events[i].PTS >= base {
+			events[i].Time = float64(events[i].PTS-base) / mpegtsClock
+		}
+	}
+	return events, nil
+}
+
+// extractTimedMetadata collects the ID3 timed metadata of the media tracks, then
+// passes it to the metadata handler and writes the JSON sidecar, whose path is returned
+func (h *hlsDownloader) extractTimedMetadata(tracks []*track) (string, error) {
+	events := []MetadataEvent{}
+	for _, t := range tracks {
+		if t.subtitles {
+			continue
+		}
+		for _, output := range t.outputs {
+			found, err := readMetadata(output)
+			if err != nil {
+				return "", err
+			}
+			for i := range found {
+				found[i].Track = t.name
+			}
+			events = append(events, found...)
+		}
+	}
+	h.log().infof("Found %d timed metadata events\n", len(events))
+
+	if h.metadataHandler != nil {
+		for _, event := range events {
+			h.metadataHandler(event)
+		}
+	}
+	if !h.timedMetadata {
+		return "", nil
+	}
+	data, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path, err := h.sidecarPath(h.output, ".id3", ".json")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
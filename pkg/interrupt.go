@@ -0,0 +1,68 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrInterrupted is returned along with the path of the partial output when a download keeping
+// its partial output is cancelled, see SetKeepPartial. The error of the context is wrapped too.
+var ErrInterrupted = errors.New("download interrupted")
+
+// SetKeepPartial makes a cancelled download stop its workers, append the segments downloaded
+// without a gap since the start to the output and keep it as <output>.part, so that an
+// interrupted download still leaves a playable file. The returned output is then that file,
+// with an error wrapping ErrInterrupted. Archives and subtitles are not joined partially.
+func (h *hlsDownloader) SetKeepPartial(keep bool) error {
+	if h == nil {
+		return errors.New("attempt to set keep partial on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.keepPartial = keep
+	return nil
+}
+
+// finishPartial stops the workers of a cancelled batch and waits for the writer to append
+// the segments downloaded so far, up to the first one missing
+func (h *hlsDownloader) finishPartial(t *track, wc *workerController, writer *segmentWriter) error {
+	close(wc.abort)
+	// the results sent before the workers noticed the abort are still appended
+	for running := true; running; {
+		select {
+		case result := <-wc.downloadResult:
+			if result.err == nil {
+				writer.ready <- result.seqId
+			}
+		case <-wc.success:
+			running = false
+		}
+	}
+	writer.partial = true
+	if err := writer.wait(); err != nil {
+		h.log().warnf("Partial output of %s stopped early: %s\n", t.name, err.Error())
+	}
+	return h.ctx.Err()
+}
+
+// partialOutput returns the output of an interrupted download along with ErrInterrupted,
+// the outputs of every track joined so far are kept
+func (h *hlsDownloader) partialOutput(tracks []*track) (string, error) {
+	for _, t := range tracks {
+		for _, output := range t.outputs {
+			// the output file being written is left at its .part path
+			if _, err := os.Stat(output + partSuffix); err == nil {
+				output += partSuffix
+			}
+			h.outputs = append(h.outputs, output)
+		}
+	}
+	err := fmt.Errorf("%w: %w", ErrInterrupted, h.ctx.Err())
+	if len(h.outputs) == 0 {
+		return "", err
+	}
+	return h.outputs[0], err
+}
@@ -0,0 +1,81 @@
+package HLSDownloader
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// IVStrategy is how the IV of AES-128 segments whose EXT-X-KEY has no IV attribute is derived
+type IVStrategy int
+
+const (
+	// SequenceIV uses the media sequence number of the segment as a big-endian 128 bits IV,
+	// as the specification requires (default)
+	SequenceIV IVStrategy = iota
+	// ZeroIV uses an all zero IV
+	ZeroIV
+	// OffsetIV uses the position of the segment in its playlist, i.e. its media sequence number
+	// minus the EXT-X-MEDIA-SEQUENCE of the playlist, for encoders that ignore the media sequence
+	OffsetIV
+)
+
+func (s IVStrategy) String() string {
+	switch s {
+	case SequenceIV:
+		return "sequence"
+	case ZeroIV:
+		return "zero"
+	case OffsetIV:
+		return "offset"
+	}
+	return fmt.Sprintf("IVStrategy(%d)", int(s))
+}
+
+// ParseIVStrategy converts a textual strategy ("sequence", "zero", "offset") into an IVStrategy
+func ParseIVStrategy(s string) (IVStrategy, error) {
+	switch s {
+	case "", "sequence":
+		return SequenceIV, nil
+	case "zero":
+		return ZeroIV, nil
+	case "offset":
+		return OffsetIV, nil
+	}
+	return 0, fmt.Errorf("unknown IV strategy %q", s)
+}
+
+// SetIVStrategy sets how the IV of AES-128 segments is derived when EXT-X-KEY has no IV
+// attribute. Explicit IVs, and the ones returned by the key provider, are always used as is.
+func (h *hlsDownloader) SetIVStrategy(strategy IVStrategy) error {
+	if h == nil {
+		return errors.New("attempt to set IV strategy on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if strategy != SequenceIV && strategy != ZeroIV && strategy != OffsetIV {
+		return errors.New("invalid IV strategy")
+	}
+	h.ivStrategy = strategy
+	return nil
+}
+
+// iv derives the IV of a segment without an IV attribute
+func (s IVStrategy) iv(segment *segment) []byte {
+	switch s {
+	case ZeroIV:
+		return make([]byte, aes.BlockSize)
+	case OffsetIV:
+		return defaultIV(segment.SeqId - segment.mediaSequence)
+	}
+	return defaultIV(segment.SeqId)
+}
+
+func defaultIV(seqID uint64) []byte {
+	buf := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(buf[8:], seqID)
+	return buf
+}
@@ -0,0 +1,49 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SetKeepSegments keeps every segment joined into the output, as served, in a subdirectory of dir
+// named after its track (main, audio, ...), e.g. to inspect, re-mux or serve them again. The files
+// are named after the sequence number of the segment. An empty dir removes them once joined.
+func (h *hlsDownloader) SetKeepSegments(dir string) error {
+	if h == nil {
+		return errors.New("attempt to set keep segments on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.keepSegmentsDir = dir
+	return nil
+}
+
+// keepSegment copies the segment into the keep segments directory
+func (h *hlsDownloader) keepSegment(t *track, segment *segment) error {
+	if h.keepSegmentsDir == "" {
+		return nil
+	}
+	dir := filepath.Join(h.keepSegmentsDir, t.name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, archiveName("", segment.SeqId, segment.URI, ".ts"))
+	in, err := openSegment(segment)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,207 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+// KeyProvider supplies decryption keys instead of fetching them from the key URI, e.g.
+// through a license proxy or a key vault. GetKey is called for every encrypted segment
+// with the absolute key URI and the media sequence number of the segment. A nil key
+// falls back to the HTTP fetch of the key URI, a nil iv to the IV of the playlist.
+type KeyProvider interface {
+	GetKey(ctx context.Context, keyURI string, seqID uint64) (key, iv []byte, err error)
+}
+
+// SetKeyProvider sets the provider consulted for the decryption keys before they are fetched
+func (h *hlsDownloader) SetKeyProvider(provider KeyProvider) error {
+	if h == nil {
+		return errors.New("attempt to set key provider on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.keyProvider = provider
+	return nil
+}
+
+// SetKeyHeader sets the HTTP header of the key requests, which use the header of SetHeader by default
+func (h *hlsDownloader) SetKeyHeader(header *http.Header) error {
+	if h == nil {
+		return errors.New("attempt to set key header on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.keyHeader = header
+	return nil
+}
+
+// SetKeyClient sets the HTTP client of the key requests, which use the client of SetClient or the
+// fetcher of SetFetcher by default
+func (h *hlsDownloader) SetKeyClient(client *http.Client) error {
+	if h == nil {
+		return errors.New("attempt to set key client on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.keyClient = client
+	return nil
+}
+
+// SetUnpadding sets whether the PKCS#7 padding of the last block of AES-128 segments is removed.
+// It is enabled by default, some encoders do not pad the last block.
+func (h *hlsDownloader) SetUnpadding(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set unpadding on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.keepPadding = !enabled
+	return nil
+}
+
+// keyCall is a key fetch, waiters block on done until key or err is set
+type keyCall struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+// keyCache holds the decryption keys of a download by key URI, so every key is
+// fetched once instead of once per segment. Concurrent requests of a key being
+// fetched wait for that fetch instead of starting their own, failed fetches are
+// not cached so the next request tries again.
+type keyCache struct {
+	ctx      context.Context
+	mu       sync.Mutex
+	calls    map[string]*keyCall
+	provider KeyProvider
+	fetcher  Fetcher
+	header   *http.Header
+	keyFile  []byte
+	keystore map[string][]byte
+
+	ivStrategy IVStrategy
+}
+
+// newKeyCache returns the key cache of a download, keys are fetched with the key client
+// and header when set, otherwise with the ones of the segments
+func (h *hlsDownloader) newKeyCache() *keyCache {
+	c := &keyCache{
+		ctx:      h.ctx,
+		calls:    make(map[string]*keyCall),
+		provider: h.keyProvider,
+		fetcher:  h.fetcher,
+		header:   h.keyHeader,
+		keyFile:  h.keyFile,
+		keystore: h.keystore,
+
+		ivStrategy: h.ivStrategy,
+	}
+	if h.keyClient != nil {
+		c.fetcher = h.decorate(clientFetcher{h.keyClient})
+	}
+	if c.header == nil {
+		c.header = h.header
+	}
+	return c
+}
+
+func (c *keyCache) get(uri string) ([]byte, error) {
+	c.mu.Lock()
+	if call, ok := c.calls[uri]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.key, call.err
+	}
+	call := &keyCall{done: make(chan struct{})}
+	c.calls[uri] = call
+	c.mu.Unlock()
+
+	call.key, call.err = c.fetch(uri)
+	if call.err != nil {
+		call.err = fmt.Errorf("%w %s: %w", ErrKeyFetch, uri, call.err)
+		c.mu.Lock()
+		delete(c.calls, uri)
+		c.mu.Unlock()
+	}
+	close(call.done)
+	return call.key, call.err
+}
+
+func (c *keyCache) fetch(uri string) ([]byte, error) {
+	if key, ok := c.localKey(uri); ok {
+		return key, nil
+	}
+	if isDataURI(uri) {
+		return decodeDataURI(uri)
+	}
+	req, err := newRequest(c.ctx, uri, c.header)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.fetcher.Do(c.ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, newStatusError(res)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// sessionKeys returns the URIs of the EXT-X-SESSION-KEY tags of a raw master playlist,
+// which the m3u8 parser ignores
+func sessionKeys(baseURL *url.URL, data []byte) []string {
+	var uris []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#EXT-X-SESSION-KEY:") {
+			continue
+		}
+		attrs := m3u8.DecodeAttributeList(line[len("#EXT-X-SESSION-KEY:"):])
+		if attrs["METHOD"] == "NONE" || attrs["URI"] == "" {
+			continue
+		}
+		keyURL, err := baseURL.Parse(attrs["URI"])
+		if err != nil || (keyURL.Scheme != "http" && keyURL.Scheme != "https") {
+			// e.g. skd:// keys of FairPlay streams
+			continue
+		}
+		uris = append(uris, keyURL.String())
+	}
+	return uris
+}
+
+// prefetchSessionKeys fetches the EXT-X-SESSION-KEY keys of the master playlist before
+// any segment is downloaded, some servers only hand keys out early
+func (h *hlsDownloader) prefetchSessionKeys(baseURL *url.URL, data []byte) {
+	for _, uri := range sessionKeys(baseURL, data) {
+		uri = withQuery(uri, h.propagatedQuery())
+		if _, err := h.keys.get(uri); err != nil {
+			h.log().warnf("Failed to prefetch session key %s: %s\n", uri, err.Error())
+			continue
+		}
+		h.log().debugf("Prefetched session key %s\n", uri)
+	}
+}
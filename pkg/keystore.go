@@ -0,0 +1,93 @@
+package HLSDownloader
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// SetKeyFile sets the file holding the key used instead of fetching any key URI, for offline
+// decryption of captured streams. The file holds the 16 bytes of the key or their hexadecimal form.
+func (h *hlsDownloader) SetKeyFile(path string) error {
+	if h == nil {
+		return errors.New("attempt to set key file on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key, err := parseKey(data)
+	if err != nil {
+		return fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+	h.keyFile = key
+	return nil
+}
+
+// SetKeystore sets the JSON keystore mapping key URIs to hexadecimal keys, the keys it holds are
+// used instead of fetching their URI. Its URIs are matched with and without their query.
+func (h *hlsDownloader) SetKeystore(path string) error {
+	if h == nil {
+		return errors.New("attempt to set keystore on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]string)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid keystore %s: %w", path, err)
+	}
+	keystore := make(map[string][]byte)
+	for uri, value := range entries {
+		key, err := parseKey([]byte(value))
+		if err != nil {
+			return fmt.Errorf("invalid key of %s in keystore %s: %w", uri, path, err)
+		}
+		keystore[uri] = key
+	}
+	h.keystore = keystore
+	return nil
+}
+
+// parseKey decodes a key given as its 16 bytes or as hexadecimal text
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == 16 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	text = strings.TrimPrefix(strings.TrimPrefix(text, "0x"), "0X")
+	key, err := hex.DecodeString(text)
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("a key is 16 bytes or 32 hexadecimal digits")
+	}
+	return key, nil
+}
+
+// localKey returns the key of the key file or the keystore for the key URI
+func (c *keyCache) localKey(uri string) ([]byte, bool) {
+	if c.keyFile != nil {
+		return c.keyFile, true
+	}
+	if key, ok := c.keystore[uri]; ok {
+		return key, true
+	}
+	if u, err := url.Parse(uri); err == nil && u.RawQuery != "" {
+		u.RawQuery = ""
+		key, ok := c.keystore[u.String()]
+		return key, ok
+	}
+	return nil, false
+}
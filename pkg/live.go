@@ -0,0 +1,199 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// SetLive enables recording of live (sliding window) playlists: the media playlist
+// is refreshed periodically and new segments are appended to the output until
+// EXT-X-ENDLIST appears or Stop is called
+func (h *hlsDownloader) SetLive(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set live on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.live = enabled
+	return nil
+}
+
+// Stop ends the running live recording, the segments already listed are still joined into the
+// output. The next download of the instance records again.
+func (h *hlsDownloader) Stop() {
+	if h == nil {
+		return
+	}
+	h.stopMu.Lock()
+	defer h.stopMu.Unlock()
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+}
+
+// Following reports whether the running download follows a live or EVENT playlist for new
+// segments, a recording that Stop ends. It can be called from any goroutine.
+func (h *hlsDownloader) Following() bool {
+	if h == nil {
+		return false
+	}
+	return h.followed.Load()
+}
+
+// follows reports whether one of the tracks is followed for new segments
+func (h *hlsDownloader) follows(tracks []*track) bool {
+	for _, t := range tracks {
+		if h.following(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hlsDownloader) isStopped() bool {
+	select {
+	case <-h.stop:
+		return true
+	default:
+	}
+	return false
+}
+
+// following reports whether the track playlist must be refreshed for new segments.
+// EVENT playlists only grow, so they are always followed until EXT-X-ENDLIST.
+func (h *hlsDownloader) following(t *track) bool {
+	if t.playlist.Closed || t.windowDone || h.isStopped() {
+		return false
+	}
+	return h.live || t.playlist.MediaType == m3u8.EVENT
+}
+
+// refreshInterval follows the HLS client rules: wait a target duration after the
+// playlist changed, half of it when it did not
+func refreshInterval(targetDuration float64, changed bool) time.Duration {
+	if targetDuration <= 0 {
+		targetDuration = 2
+	}
+	interval := time.Duration(targetDuration * float64(time.Second))
+	if !changed {
+		interval /= 2
+	}
+	return interval
+}
+
+// refreshTrack waits for the playlist to list segments newer than the last one
+// downloaded and replaces the track segments with them. Low-Latency playlists are
+// reloaded as soon as the server publishes the next part, which is appended right away.
+func (h *hlsDownloader) refreshTrack(t *track) error {
+	changed := true
+	for {
+		playlistURL := t.url
+		wait := refreshInterval(t.playlist.TargetDuration, changed)
+		if h.usesParts(t) {
+			ll := t.playlist.lowLatency
+			wait = refreshInterval(ll.partTarget, changed)
+			if ll.canBlockReload {
+				wait = 0
+				if !changed {
+					wait = refreshInterval(ll.partTarget, false)
+				}
+				var err error
+				playlistURL, err = h.blockingReloadURL(t)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		select {
+		case <-h.stop:
+			t.segments = nil
+			return nil
+		case <-h.ctx.Done():
+			return h.ctx.Err()
+		case <-time.After(wait):
+		}
+
+		mediaList, segments, err := h.reloadPlaylist(t, playlistURL)
+		if err != nil {
+			if h.isStopped() {
+				t.segments = nil
+				return nil
+			}
+			return err
+		}
+		t.playlist = mediaList
+
+		var fresh []*segment
+		for _, segment := range segments {
+			if !t.started || segment.SeqId > t.lastSeq {
+				fresh = append(fresh, segment)
+			}
+		}
+		if t.partsActive && len(fresh) > 0 && fresh[0].SeqId == t.partMSN {
+			// the segment followed through its parts is now complete
+			if err := h.completeParts(t); err != nil {
+				return err
+			}
+			t.lastSeq = fresh[0].SeqId
+			t.started = true
+			fresh = fresh[1:]
+		}
+		if t.started && len(fresh) > 0 && fresh[0].SeqId > t.lastSeq+1 {
+			h.log().warnf("Live playlist (%s) moved past segments %d-%d before they were downloaded\n", t.name, t.lastSeq+1, fresh[0].SeqId-1)
+		}
+		if len(fresh) > 0 || mediaList.Closed {
+			h.log().debugf("Live playlist (%s) refreshed: %d new segments\n", t.name, len(fresh))
+			t.segments = fresh
+			total := atomic.AddInt64(&h.totalSegments, int64(len(fresh)))
+			if h.progress != nil {
+				h.progress.SetTotal(int(total), 0)
+			}
+			return nil
+		}
+
+		changed = false
+		if h.usesParts(t) {
+			written, err := h.appendParts(t)
+			if err != nil {
+				if h.isStopped() {
+					t.segments = nil
+					return nil
+				}
+				return err
+			}
+			changed = written > 0
+		}
+	}
+}
+
+// reloadPlaylist reloads the media playlist of the track, retrying the reloads failing with a
+// transient error so that a momentary server error does not end the recording. The waits
+// between the attempts are bounded by the target duration, the playlist moves on meanwhile.
+func (h *hlsDownloader) reloadPlaylist(t *track, playlistURL string) (*mediaPlaylist, []*segment, error) {
+	for attempt := 1; ; attempt++ {
+		mediaList, segments, err := h.loadMediaPlaylist(playlistURL, h.baseOverride(t.url))
+		if err == nil || !isRetryable(err) || attempt > maxRetries {
+			return mediaList, segments, err
+		}
+		wait := retryDelay(attempt)
+		if retryAfter, ok := rateLimited(err); ok && retryAfter > wait {
+			wait = retryAfter
+		}
+		if limit := refreshInterval(t.playlist.TargetDuration, true); wait > limit {
+			wait = limit
+		}
+		h.log().warnf("Reloading live playlist (%s) failed, retrying in %s: %s\n", t.name, wait, err.Error())
+		select {
+		case <-h.stop:
+			return nil, nil, err
+		case <-h.ctx.Done():
+			return nil, nil, h.ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package HLSDownloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tsSegment returns a transport stream packet standing for segment i
+func tsSegment(i int) []byte {
+	packet := bytes.Repeat([]byte{byte(i)}, 188)
+	packet[0] = syncByte
+	return packet
+}
+
+func livePlaylist(from, to int, closed bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", from)
+	for i := from; i <= to; i++ {
+		fmt.Fprintf(&b, "#EXTINF:1,\nseg%d.ts\n", i)
+	}
+	if closed {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+func TestRefreshRetriesTransientErrors(t *testing.T) {
+	var reloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/live.m3u8" {
+			var i int
+			if _, err := fmt.Sscanf(r.URL.Path, "/seg%d.ts", &i); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(tsSegment(i))
+			return
+		}
+		if r.Method != http.MethodGet {
+			return
+		}
+		switch atomic.AddInt32(&reloads, 1) {
+		case 1:
+			fmt.Fprint(w, livePlaylist(0, 1, false))
+		case 2:
+			// the first refresh fails with a transient error
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, livePlaylist(0, 2, true))
+		}
+	}))
+	defer srv.Close()
+
+	output := filepath.Join(t.TempDir(), "live.ts")
+	h, err := New(srv.URL+"/live.m3u8", output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetLive(true); err != nil {
+		t.Fatal(err)
+	}
+	result, err := h.DownloadContext(context.Background())
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if result.Segments != 3 {
+		t.Errorf("got %d segments, want 3", result.Segments)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(tsSegment(0), tsSegment(1)...), tsSegment(2)...)
+	if !bytes.Equal(data, want) {
+		t.Errorf("output is %d bytes, want the 3 segments (%d bytes)", len(data), len(want))
+	}
+	if n := atomic.LoadInt32(&reloads); n < 3 {
+		t.Errorf("playlist loaded %d times, want at least 3", n)
+	}
+}
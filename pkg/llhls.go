@@ -0,0 +1,393 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// partialSegment is an EXT-X-PART of a Low-Latency HLS playlist
+type partialSegment struct {
+	msn         uint64
+	index       int
+	uri         string
+	duration    float64
+	independent bool
+	gap         bool
+	limit       int64
+	offset      int64
+}
+
+// preloadHint is an EXT-X-PRELOAD-HINT of a Low-Latency HLS playlist
+type preloadHint struct {
+	hintType string
+	uri      string
+	offset   int64
+	limit    int64
+}
+
+// lowLatency holds the Low-Latency HLS tags of a media playlist, which the m3u8 parser ignores
+type lowLatency struct {
+	canBlockReload bool
+	partTarget     float64
+	parts          []*partialSegment
+	hint           *preloadHint
+	// nextMSN is the media sequence number following the last complete segment
+	nextMSN uint64
+}
+
+// partsOf returns the listed parts of the segment with the given media sequence number
+func (ll *lowLatency) partsOf(msn uint64) []*partialSegment {
+	var parts []*partialSegment
+	for _, part := range ll.parts {
+		if part.msn == msn {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func parseByteRange(value string) (limit int64, offset int64, err error) {
+	length, start, found := strings.Cut(value, "@")
+	limit, err = strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if found {
+		offset, err = strconv.ParseInt(start, 10, 64)
+	}
+	return limit, offset, err
+}
+
+// parseLowLatency scans the raw media playlist for EXT-X-PART, EXT-X-PRELOAD-HINT,
+// EXT-X-PART-INF and EXT-X-SERVER-CONTROL. It returns nil for regular playlists.
+func parseLowLatency(baseURL *url.URL, data []byte, mediaSequence uint64) (*lowLatency, error) {
+	ll := &lowLatency{}
+	isLowLatency := false
+	msn := mediaSequence
+	index := 0
+	var prevURI string
+	var prevEnd int64
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			attrs := m3u8.DecodeAttributeList(line[len("#EXT-X-SERVER-CONTROL:"):])
+			ll.canBlockReload = attrs["CAN-BLOCK-RELOAD"] == "YES"
+		case strings.HasPrefix(line, "#EXT-X-PART-INF:"):
+			attrs := m3u8.DecodeAttributeList(line[len("#EXT-X-PART-INF:"):])
+			ll.partTarget, _ = strconv.ParseFloat(attrs["PART-TARGET"], 64)
+			isLowLatency = true
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			attrs := m3u8.DecodeAttributeList(line[len("#EXT-X-PART:"):])
+			partURL, err := baseURL.Parse(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			part := &partialSegment{
+				msn:         msn,
+				index:       index,
+				uri:         partURL.String(),
+				independent: attrs["INDEPENDENT"] == "YES",
+				gap:         attrs["GAP"] == "YES",
+			}
+			part.duration, _ = strconv.ParseFloat(attrs["DURATION"], 64)
+			if byteRange, ok := attrs["BYTERANGE"]; ok {
+				if part.limit, part.offset, err = parseByteRange(byteRange); err != nil {
+					return nil, fmt.Errorf("invalid EXT-X-PART byte range %q", byteRange)
+				}
+				if !strings.Contains(byteRange, "@") && part.uri == prevURI {
+					part.offset = prevEnd
+				}
+				prevURI, prevEnd = part.uri, part.offset+part.limit
+			}
+			ll.parts = append(ll.parts, part)
+			index++
+		case strings.HasPrefix(line, "#EXT-X-PRELOAD-HINT:"):
+			attrs := m3u8.DecodeAttributeList(line[len("#EXT-X-PRELOAD-HINT:"):])
+			hintURL, err := baseURL.Parse(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			hint := &preloadHint{hintType: attrs["TYPE"], uri: hintURL.String()}
+			hint.offset, _ = strconv.ParseInt(attrs["BYTERANGE-START"], 10, 64)
+			hint.limit, _ = strconv.ParseInt(attrs["BYTERANGE-LENGTH"], 10, 64)
+			ll.hint = hint
+		case line != "" && !strings.HasPrefix(line, "#"):
+			// a segment URI completes the current media sequence number
+			msn++
+			index = 0
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !isLowLatency {
+		return nil, nil
+	}
+	ll.nextMSN = msn
+	return ll, nil
+}
+
+// SetLowLatency enables or disables following Low-Latency HLS live playlists through
+// partial segments and blocking playlist reloads (enabled by default)
+func (h *hlsDownloader) SetLowLatency(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set low latency on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.lowLatency = enabled
+	return nil
+}
+
+// usesParts reports whether the partial segments of the track playlist can be followed.
+// Parts of AES-128 encrypted segments can not be decrypted on their own, so those
+// streams are followed through complete segments only.
+func (h *hlsDownloader) usesParts(t *track) bool {
+	if !h.lowLatency || !h.live || t.subtitles || t.playlist.lowLatency == nil {
+		return false
+	}
+	for _, segment := range t.playlist.Segments {
+		if segment != nil && segment.Key != nil && segment.Key.Method != "NONE" {
+			return false
+		}
+	}
+	return true
+}
+
+// blockingReloadURL adds the _HLS_msn/_HLS_part directives asking the server to
+// hold the playlist response until the next expected part is available
+func (h *hlsDownloader) blockingReloadURL(t *track) (string, error) {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if t.partsActive {
+		query.Set("_HLS_msn", strconv.FormatUint(t.partMSN, 10))
+		query.Set("_HLS_part", strconv.Itoa(t.partsDone))
+	} else {
+		query.Set("_HLS_msn", strconv.FormatUint(t.playlist.lowLatency.nextMSN, 10))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// hintedPart is the part of a preload hint, fetched before the playlist lists it. It is
+// only written once a listed part has the same URI and byte range, the server can publish
+// the part differently from its hint or drop the hint.
+type hintedPart struct {
+	index  int
+	uri    string
+	limit  int64
+	offset int64
+	data   []byte
+}
+
+// matches reports whether the listed part is the hinted one, a hint without
+// BYTERANGE-LENGTH runs up to the end of the part
+func (p *hintedPart) matches(part *partialSegment) bool {
+	if p.index != part.index || p.uri != part.uri || p.offset != part.offset {
+		return false
+	}
+	return p.limit == part.limit || (p.limit == 0 && int64(len(p.data)) == part.limit)
+}
+
+// fetchPart fetches a part the way the workers fetch segments: in a worker slot, through
+// the rate limiters and the statistics, retrying transient errors. Parts are not recorded
+// as segments in the progress, the state file, the report or the kept segments, the
+// segment they make up is only written to the output.
+func (h *hlsDownloader) fetchPart(t *track, part *partialSegment) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		if !h.backoff.wait(h.ctx.Done()) {
+			return nil, h.ctx.Err()
+		}
+		data, err := h.fetchPartOnce(part)
+		if err == nil || h.ctx.Err() != nil || !isRetryable(err) {
+			return data, err
+		}
+		limit, wait := maxRetries, retryDelay(attempt)
+		if retryAfter, limited := rateLimited(err); limited {
+			limit = maxRateLimitRetries
+			if retryAfter > 0 {
+				wait = retryAfter
+			}
+			h.backoff.delay(wait)
+		}
+		if attempt > limit {
+			return nil, err
+		}
+		h.log().debugf("Error downloading part %d of segment %d (%s): %s, retrying in %s. Attempt #%d\n", part.index, part.msn, t.name, err.Error(), wait.Round(time.Millisecond), attempt)
+		select {
+		case <-h.stop:
+			return nil, err
+		case <-h.ctx.Done():
+			return nil, h.ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (h *hlsDownloader) fetchPartOnce(part *partialSegment) ([]byte, error) {
+	if isDataURI(part.uri) {
+		return fetchResource(h.ctx, part.uri, part.limit, part.offset, h.header, h.fetcher)
+	}
+	var slot int
+	select {
+	case slot = <-h.slots:
+	case <-h.ctx.Done():
+		return nil, h.ctx.Err()
+	}
+	defer func() { h.slots <- slot }()
+	if h.manager != nil {
+		if !h.manager.acquireSlot(h.ctx.Done()) {
+			return nil, h.ctx.Err()
+		}
+		defer h.manager.releaseSlot()
+	}
+	h.stats.Load().acquired(slot)
+	defer h.stats.Load().released(slot)
+
+	req, err := newRequest(h.ctx, part.uri, h.header)
+	if err != nil {
+		return nil, err
+	}
+	if part.limit > 0 {
+		setRange(req, part.offset, part.limit)
+	}
+	res, err := h.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && !(res.StatusCode == http.StatusPartialContent && part.limit > 0) {
+		return nil, newStatusError(res)
+	}
+	data, err := io.ReadAll(h.throttle(h.ctx, res.Body))
+	if err != nil {
+		return nil, err
+	}
+	if part.limit > 0 && res.StatusCode == http.StatusOK {
+		// the server ignored the Range header and sent the whole resource
+		if int64(len(data)) < part.offset+part.limit {
+			return nil, errors.New("byte range out of the part resource")
+		}
+		data = data[part.offset : part.offset+part.limit]
+	}
+	return data, nil
+}
+
+// writePart writes a listed part to the output, using the hinted part fetched ahead when it
+// is the same part and fetching the part again otherwise
+func (h *hlsDownloader) writePart(t *track, part *partialSegment) error {
+	var data []byte
+	hinted := t.hinted != nil && t.hinted.index == part.index
+	if hinted {
+		if t.hinted.matches(part) {
+			data = t.hinted.data
+		} else {
+			h.log().debugf("Part %d of segment %d differs from its preload hint, fetching it again\n", part.index, part.msn)
+			hinted = false
+		}
+		t.hinted = nil
+	}
+	if !hinted {
+		var err error
+		if data, err = h.fetchPart(t, part); err != nil {
+			return err
+		}
+	}
+	_, err := t.out.Write(data)
+	return err
+}
+
+// appendParts writes the already published parts of the segment following the last
+// complete one, then fetches the hinted part ahead, which the server delivers as soon as
+// it exists. It returns the number of parts written or fetched ahead.
+func (h *hlsDownloader) appendParts(t *track) (int, error) {
+	ll := t.playlist.lowLatency
+	next := ll.nextMSN
+	parts := ll.partsOf(next)
+	if !t.partsActive || t.partMSN != next {
+		// only start following a segment from its first part
+		if len(parts) == 0 || parts[0].index != 0 || (t.started && next != t.lastSeq+1) {
+			return 0, nil
+		}
+		t.partsActive = true
+		t.partMSN = next
+		t.partsDone = 0
+		t.hinted = nil
+	}
+
+	written := 0
+	for _, part := range parts {
+		if part.index < t.partsDone {
+			continue
+		}
+		if err := h.appendPart(t, part); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	hint := ll.hint
+	if hint != nil && hint.hintType == "PART" && t.partsDone == len(parts) && len(parts) > 0 && (t.hinted == nil || t.hinted.index != t.partsDone) {
+		part := &partialSegment{msn: next, index: t.partsDone, uri: hint.uri, limit: hint.limit, offset: hint.offset}
+		data, err := h.fetchPart(t, part)
+		if err != nil {
+			h.log().debugf("Failed to preload hinted part of segment %d: %s\n", next, err.Error())
+			return written, nil
+		}
+		t.hinted = &hintedPart{index: part.index, uri: part.uri, limit: part.limit, offset: part.offset, data: data}
+		written++
+	}
+	return written, nil
+}
+
+// appendPart writes a listed part unless it is a gap, and counts it as done
+func (h *hlsDownloader) appendPart(t *track, part *partialSegment) error {
+	if part.gap {
+		if t.hinted != nil && t.hinted.index == part.index {
+			t.hinted = nil
+		}
+	} else if err := h.writePart(t, part); err != nil {
+		return err
+	}
+	t.partsDone++
+	return nil
+}
+
+// completeParts writes the parts of a followed segment that were not written yet,
+// once the segment is listed as complete
+func (h *hlsDownloader) completeParts(t *track) error {
+	parts := t.playlist.lowLatency.partsOf(t.partMSN)
+	t.partsActive = false
+	defer func() { t.hinted = nil }()
+	if len(parts) == 0 {
+		h.log().warnf("Parts of segment %d are no longer listed, the segment may be incomplete\n", t.partMSN)
+		return nil
+	}
+	for _, part := range parts {
+		if part.index < t.partsDone {
+			continue
+		}
+		if err := h.appendPart(t, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
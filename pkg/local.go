@@ -0,0 +1,96 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isLocalPlaylist reports whether URL is a file:// URI or a path on disk instead of a http URL
+func isLocalPlaylist(URL string) bool {
+	u, err := url.Parse(URL)
+	if err != nil {
+		// e.g. Windows paths with backslashes
+		return true
+	}
+	// a one letter scheme is a Windows drive
+	return u.Scheme == "" || u.Scheme == "file" || len(u.Scheme) == 1
+}
+
+// fileURL turns a local path or file:// URI into an absolute file:// URL
+func fileURL(URL string) (string, error) {
+	if strings.HasPrefix(URL, "file://") {
+		u, err := url.Parse(URL)
+		if err != nil {
+			return "", err
+		}
+		URL = localPath(u)
+	}
+	path, err := filepath.Abs(URL)
+	if err != nil {
+		return "", err
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String(), nil
+}
+
+// localPath returns the path on disk of a file:// URL
+func localPath(u *url.URL) string {
+	path := u.Path
+	if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		// file:///C:/...
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+func validateLocalPlaylist(URL string) error {
+	path := URL
+	if u, err := url.Parse(URL); err == nil && u.Scheme == "file" {
+		path = localPath(u)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("playlist path is a directory")
+	}
+	return nil
+}
+
+// SetBaseURL sets the URL the relative URIs of the playlist passed to New are resolved
+// against instead of the playlist location, typically for playlists saved to disk
+func (h *hlsDownloader) SetBaseURL(baseURL string) error {
+	if h == nil {
+		return errors.New("attempt to set base url on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if baseURL == "" {
+		h.baseURL = nil
+		return nil
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || !u.IsAbs() {
+		return errors.New("base url must be an absolute url")
+	}
+	h.baseURL = u
+	return nil
+}
+
+// baseOverride returns the base URL set for the playlist, nil when its relative URIs
+// are resolved against its own URL
+func (h *hlsDownloader) baseOverride(playlistURL string) *url.URL {
+	if playlistURL == h.url {
+		return h.baseURL
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Logger receives the logs of a downloader, a *log.Logger is one
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+const (
+	// LogDebug messages follow every segment and request
+	LogDebug LogLevel = iota
+	// LogInfo messages follow the steps of the download (default)
+	LogInfo
+	// LogWarn messages report a problem the download works around
+	LogWarn
+	// LogError messages report a failure
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel converts a textual level ("debug", "info", "warn", "error") into a LogLevel
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch s {
+	case "debug":
+		return LogDebug, nil
+	case "", "info":
+		return LogInfo, nil
+	case "warn", "warning":
+		return LogWarn, nil
+	case "error":
+		return LogError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// nopLogger discards the logs, the default of the library
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...any) {}
+
+// loggerHolder keeps the same type in packageLogger whatever the logger
+type loggerHolder struct {
+	logger Logger
+}
+
+// packageLogger logs for the downloaders without a logger of their own and before a downloader
+// exists, e.g. while New checks the output, see EnableLogs
+var packageLogger atomic.Value
+
+func init() {
+	packageLogger.Store(loggerHolder{nopLogger{}})
+}
+
+// EnableLogs prints the logs of the downloaders without a logger of their own to stdout
+func EnableLogs() {
+	packageLogger.Store(loggerHolder{log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)})
+}
+
+// DisableLogs discards the logs of the downloaders without a logger of their own (default)
+func DisableLogs() {
+	packageLogger.Store(loggerHolder{nopLogger{}})
+}
+
+// defaultLog returns the package logger, logging from LogInfo on
+func defaultLog() levelLogger {
+	return levelLogger{logger: packageLogger.Load().(loggerHolder).logger, level: LogInfo}
+}
+
+// SetLogger sets the logger of the downloader, nil restores the one of EnableLogs and
+// DisableLogs. The global logger of the log package is never used.
+func (h *hlsDownloader) SetLogger(logger Logger) error {
+	if h == nil {
+		return errors.New("attempt to set logger on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.logger = logger
+	return nil
+}
+
+// SetLogLevel sets the lowest level of the messages logged, LogInfo by default. The messages
+// about every segment are only logged at LogDebug.
+func (h *hlsDownloader) SetLogLevel(level LogLevel) error {
+	if h == nil {
+		return errors.New("attempt to set log level on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if level < LogDebug || level > LogError {
+		return fmt.Errorf("invalid log level %d", int(level))
+	}
+	h.logLevel = level
+	return nil
+}
+
+// log returns the logger of the downloader
+func (h *hlsDownloader) log() levelLogger {
+	logger := h.logger
+	if logger == nil {
+		logger = packageLogger.Load().(loggerHolder).logger
+	}
+	return levelLogger{logger: logger, level: h.logLevel}
+}
+
+// levelLogger logs the messages from level on, prefixed with their level
+type levelLogger struct {
+	logger Logger
+	level  LogLevel
+}
+
+func (l levelLogger) debugf(format string, v ...any) { l.logf(LogDebug, format, v) }
+func (l levelLogger) infof(format string, v ...any)  { l.logf(LogInfo, format, v) }
+func (l levelLogger) warnf(format string, v ...any)  { l.logf(LogWarn, format, v) }
+func (l levelLogger) errorf(format string, v ...any) { l.logf(LogError, format, v) }
+
+func (l levelLogger) logf(level LogLevel, format string, v []any) {
+	if level < l.level {
+		return
+	}
+	if _, ok := l.logger.(nopLogger); ok {
+		return
+	}
+	message := strings.ToUpper(level.String()) + ": " + fmt.Sprintf(format, v...)
+	// a *log.Logger reports the file and line of the caller of debugf, infof, etc.
+	if std, ok := l.logger.(*log.Logger); ok {
+		std.Output(3, message)
+		return
+	}
+	l.logger.Printf("%s", message)
+}
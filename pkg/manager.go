@@ -0,0 +1,379 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ManagerOptions configures a Manager, see NewManager
+type ManagerOptions struct {
+	// Jobs is how many downloads run at once, 1 by default
+	Jobs int
+	// Workers bounds the segment requests of every running download together, each download
+	// keeping its own limit as well. Zero leaves every download to its own workers.
+	Workers int
+	// RateLimit caps the bandwidth of every running download together, in bytes per second
+	RateLimit int64
+	// Client sends the requests of every download, so that they share its connections. It replaces
+	// the client of the downloads, the downloads with timeouts, transport, DNS, proxy or TLS
+	// options are refused by Add.
+	// A client with a copy of the default transport is used by default.
+	Client *http.Client
+}
+
+// Manager runs queued downloads with a shared budget of workers, bandwidth and connections.
+// Its methods can be called from any goroutine.
+type Manager struct {
+	jobs    int
+	slots   chan struct{}
+	limiter *rateLimiter
+	client  *http.Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu sync.Mutex
+	// queue holds the jobs waiting to start by priority, running the ones started, paused the
+	// ones preempted by a job of higher priority
+	queue   []*Job
+	running []*Job
+	paused  []*Job
+	all     []*Job
+	nextID  int
+	closed  bool
+}
+
+// NewManager creates a Manager, see ManagerOptions
+func NewManager(options ManagerOptions) (*Manager, error) {
+	if options.Jobs < 0 || options.Workers < 0 || options.RateLimit < 0 {
+		return nil, errors.New("manager options must not be negative")
+	}
+	m := &Manager{jobs: options.Jobs, client: options.Client}
+	if m.jobs == 0 {
+		m.jobs = 1
+	}
+	if options.Workers > 0 {
+		m.slots = make(chan struct{}, options.Workers)
+	}
+	if options.RateLimit > 0 {
+		m.limiter = newRateLimiter(options.RateLimit)
+	}
+	if m.client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if options.Workers > transport.MaxIdleConnsPerHost {
+			transport.MaxIdleConnsPerHost = options.Workers
+		}
+		m.client = &http.Client{Transport: transport}
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m, nil
+}
+
+// JobStatus is the state of a Job
+type JobStatus int
+
+const (
+	// JobQueued jobs wait for a running one to end
+	JobQueued JobStatus = iota
+	// JobRunning jobs are downloading
+	JobRunning
+	// JobPaused jobs were preempted by a job of higher priority, they resume once it ends
+	JobPaused
+	// JobDone jobs ended successfully, including the aborted ones whose partial output was kept
+	JobDone
+	// JobFailed jobs ended with an error, see Job.Wait
+	JobFailed
+	// JobCancelled jobs were cancelled, or the manager closed, before they ended
+	JobCancelled
+)
+
+func (s JobStatus) String() string {
+	switch s {
+	case JobQueued:
+		return "queued"
+	case JobRunning:
+		return "running"
+	case JobPaused:
+		return "paused"
+	case JobDone:
+		return "done"
+	case JobFailed:
+		return "failed"
+	case JobCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("JobStatus(%d)", int(s))
+}
+
+// Job is a download added to a Manager
+type Job struct {
+	id       int
+	priority int
+	d        *hlsDownloader
+	manager  *Manager
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu     sync.Mutex
+	status JobStatus
+	result Result
+	err    error
+}
+
+// Add queues the download with priority 0, see AddWithPriority
+func (m *Manager) Add(d *hlsDownloader) (*Job, error) {
+	return m.AddWithPriority(d, 0)
+}
+
+// AddWithPriority queues the download, it starts once fewer jobs than ManagerOptions.Jobs run,
+// before the queued jobs of lower priority. When every job allowed runs, a job of higher priority
+// than one of them pauses the running job of lowest priority and takes its place, e.g. a live
+// recording that must start immediately. The settings of the downloader can not change until the
+// job ends. A downloader with timeouts, transport, DNS, proxy or TLS options is refused, as the
+// client of the manager sends its requests: they are set on ManagerOptions.Client instead.
+func (m *Manager) AddWithPriority(d *hlsDownloader, priority int) (*Job, error) {
+	if m == nil {
+		return nil, errors.New("manager is nil")
+	}
+	if d == nil {
+		return nil, errors.New("instance is nil")
+	}
+	if err := d.start(); err != nil {
+		return nil, err
+	}
+	if settings := d.transportSettings(); len(settings) > 0 && d.customFetcher == nil {
+		d.finish()
+		return nil, fmt.Errorf("settings not applied by the client of the manager: %s", strings.Join(settings, ", "))
+	}
+	d.manager = m
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		d.manager = nil
+		d.finish()
+		return nil, errors.New("manager is closed")
+	}
+	m.nextID++
+	j := &Job{id: m.nextID, priority: priority, d: d, manager: m, done: make(chan struct{})}
+	j.ctx, j.cancel = context.WithCancel(m.ctx)
+	// the queue is kept by priority, in the order the jobs were added within a priority
+	i := sort.Search(len(m.queue), func(i int) bool { return m.queue[i].priority < priority })
+	m.queue = append(m.queue[:i], append([]*Job{j}, m.queue[i:]...)...)
+	m.all = append(m.all, j)
+	m.schedule()
+	return j, nil
+}
+
+// Jobs returns every job added, in the order they were added
+func (m *Manager) Jobs() []*Job {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Job(nil), m.all...)
+}
+
+// Wait blocks until every job added so far ended
+func (m *Manager) Wait() {
+	for _, j := range m.Jobs() {
+		<-j.done
+	}
+}
+
+// Close cancels the queued and running jobs, waits for them to end and rejects new ones
+func (m *Manager) Close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.cancel()
+	m.Wait()
+}
+
+// schedule resumes the paused jobs and starts the queued ones while the budget allows it, and
+// preempts the running jobs of lower priority, m.mu is held
+func (m *Manager) schedule() {
+	for {
+		// cancelled while queued
+		if len(m.queue) > 0 && m.queue[0].ctx.Err() != nil {
+			j := m.queue[0]
+			m.queue = m.queue[1:]
+			j.end(Result{}, j.ctx.Err())
+			continue
+		}
+		next, paused := m.nextJob()
+		if next == nil {
+			return
+		}
+		if len(m.running) >= m.jobs {
+			lowest := m.lowestRunning()
+			if next.priority <= lowest.priority {
+				return
+			}
+			lowest.d.Pause()
+			lowest.setStatus(JobPaused)
+			m.running = removeJob(m.running, lowest)
+			m.paused = append(m.paused, lowest)
+		}
+		m.running = append(m.running, next)
+		next.setStatus(JobRunning)
+		if paused {
+			m.paused = removeJob(m.paused, next)
+			next.d.Resume()
+			continue
+		}
+		m.queue = m.queue[1:]
+		go next.run()
+	}
+}
+
+// nextJob returns the job of highest priority waiting to run, and whether it is a paused one.
+// The paused jobs started first, they come first within a priority.
+func (m *Manager) nextJob() (*Job, bool) {
+	var next *Job
+	for _, j := range m.paused {
+		if next == nil || j.priority > next.priority {
+			next = j
+		}
+	}
+	if len(m.queue) > 0 && (next == nil || m.queue[0].priority > next.priority) {
+		return m.queue[0], false
+	}
+	return next, next != nil
+}
+
+// lowestRunning returns the running job of lowest priority, the last one started within a priority
+func (m *Manager) lowestRunning() *Job {
+	lowest := m.running[0]
+	for _, j := range m.running[1:] {
+		if j.priority <= lowest.priority {
+			lowest = j
+		}
+	}
+	return lowest
+}
+
+func removeJob(jobs []*Job, j *Job) []*Job {
+	for i, job := range jobs {
+		if job == j {
+			return append(jobs[:i:i], jobs[i+1:]...)
+		}
+	}
+	return jobs
+}
+
+func (j *Job) run() {
+	// the job holds the running flag of the downloader since it was added
+	result, err := j.d.runDownload(j.ctx)
+	j.end(result, err)
+
+	m := j.manager
+	m.mu.Lock()
+	m.running = removeJob(m.running, j)
+	m.paused = removeJob(m.paused, j)
+	m.schedule()
+	m.mu.Unlock()
+}
+
+// end records the result of the job and releases its downloader
+func (j *Job) end(result Result, err error) {
+	status := JobDone
+	switch {
+	case j.ctx.Err() != nil && !errors.Is(err, ErrInterrupted):
+		status = JobCancelled
+	case err != nil && !errors.Is(err, ErrInterrupted):
+		status = JobFailed
+	}
+	j.mu.Lock()
+	j.status, j.result, j.err = status, result, err
+	j.mu.Unlock()
+	j.cancel()
+	j.d.manager = nil
+	j.d.finish()
+	close(j.done)
+}
+
+func (j *Job) setStatus(status JobStatus) {
+	j.mu.Lock()
+	j.status = status
+	j.mu.Unlock()
+}
+
+// ID returns the number of the job, counting from 1 in the order the jobs were added
+func (j *Job) ID() int {
+	return j.id
+}
+
+// Status returns the state of the job
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Stats returns the progress of the job, see Stats
+func (j *Job) Stats() Stats {
+	return j.d.Stats()
+}
+
+// Cancel cancels the job, a queued job never starts
+func (j *Job) Cancel() {
+	j.cancel()
+	m := j.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, queued := range m.queue {
+		if queued == j {
+			m.queue = removeJob(m.queue, j)
+			j.end(Result{}, context.Canceled)
+			return
+		}
+	}
+}
+
+// Priority returns the priority the job was added with
+func (j *Job) Priority() int {
+	return j.priority
+}
+
+// Done is closed once the job ended
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait blocks until the job ended and returns its result, like DownloadContext
+func (j *Job) Wait() (Result, error) {
+	<-j.done
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.result, j.err
+}
+
+// acquireSlot takes one of the workers shared by the downloads of the manager, it returns false
+// when abort is closed meanwhile
+func (m *Manager) acquireSlot(abort <-chan struct{}) bool {
+	if m.slots == nil {
+		return true
+	}
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+func (m *Manager) releaseSlot() {
+	if m.slots != nil {
+		<-m.slots
+	}
+}
@@ -0,0 +1,277 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// SetMemoryBuffer keeps the downloaded segments in memory until they are joined, up to limit
+// bytes for all of them, instead of writing each one to the temp dir and reading it back.
+// Segments that do not fit spill to disk, the temp dir is only created then. Zero disables it.
+// Resumable downloads always keep their segments on disk.
+func (h *hlsDownloader) SetMemoryBuffer(limit int64) error {
+	if h == nil {
+		return errors.New("attempt to set memory buffer on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if limit < 0 {
+		return errors.New("memory buffer must not be negative")
+	}
+	h.memoryBufferLimit = limit
+	return nil
+}
+
+// SetMemoryLimit bounds the memory taken by segment data, so that the download can run in a
+// memory constrained service: half of it at most for the segments buffered in memory, see
+// SetMemoryBuffer, and the rest for the buffers segments are verified and decrypted in, which
+// wait for room when needed. A single segment larger than that is still processed on its own.
+// The read ahead is reduced to the segments fitting in the memory buffer. Zero removes the limit.
+func (h *hlsDownloader) SetMemoryLimit(limit int64) error {
+	if h == nil {
+		return errors.New("attempt to set memory limit on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if limit < 0 {
+		return errors.New("memory limit must not be negative")
+	}
+	h.memoryLimit = limit
+	return nil
+}
+
+// setupMemory prepares the memory buffer and budget of the download
+func (h *hlsDownloader) setupMemory() {
+	h.memory = nil
+	bufferLimit := h.memoryBufferLimit
+	if bufferLimit > 0 && h.resumable() {
+		h.log().warnf("Resumable downloads keep their segments on disk, memory buffer is not used\n")
+		bufferLimit = 0
+	}
+	if h.memoryLimit > 0 && bufferLimit > h.memoryLimit/2 {
+		bufferLimit = h.memoryLimit / 2
+	}
+	if bufferLimit > 0 {
+		h.memory = &memoryBuffer{limit: bufferLimit}
+	}
+	h.decryptMemory = nil
+	if h.memoryLimit > 0 {
+		h.decryptMemory = newMemoryBudget(h.memoryLimit - bufferLimit)
+	}
+}
+
+// memoryBuffer accounts for the segments buffered in memory by the workers
+type memoryBuffer struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// reserve takes n bytes of the buffer, it returns false when they do not fit
+func (m *memoryBuffer) reserve(n int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used+int64(n) > m.limit {
+		return false
+	}
+	m.used += int64(n)
+	return true
+}
+
+func (m *memoryBuffer) release(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used -= int64(n)
+}
+
+// memoryBudget bounds the memory of the buffers segments are verified and decrypted in
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	// freed is closed, and replaced, whenever memory is released
+	freed chan struct{}
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit, freed: make(chan struct{})}
+}
+
+// acquire takes n bytes of the budget, waiting for them to be released by the other buffers
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		// a buffer larger than the whole budget is granted once nothing else is taken
+		if b.used+n <= b.limit || b.used == 0 {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// reserveDecryption takes the memory a segment is decrypted in from the budget, the returned
+// size must be released once the buffer is no longer used
+func (h *hlsDownloader) reserveDecryption(segment *segment) (int64, error) {
+	if h.decryptMemory == nil {
+		return 0, nil
+	}
+	size := segmentSize(segment)
+	return size, h.decryptMemory.acquire(h.ctx, size)
+}
+
+// tmpDir returns the temp dir of the track, creating it the first time a segment is written to disk
+func (h *hlsDownloader) tmpDir(t *track) (string, error) {
+	t.tmpDirMu.Lock()
+	defer t.tmpDirMu.Unlock()
+	if t.tmpDir == "" {
+		dir, err := os.MkdirTemp("", "*-segments")
+		if err != nil {
+			return "", err
+		}
+		t.tmpDir = dir
+		h.log().debugf("Temp Dir (%s): %s", t.name, t.tmpDir)
+	}
+	return t.tmpDir, nil
+}
+
+// existingTmpDir returns the temp dir of the track, empty while no segment was written to disk
+func (t *track) existingTmpDir() string {
+	t.tmpDirMu.Lock()
+	defer t.tmpDirMu.Unlock()
+	return t.tmpDir
+}
+
+// segmentSink streams the content of a segment being downloaded into the store of its track
+type segmentSink struct {
+	h       *hlsDownloader
+	t       *track
+	segment *segment
+	// w feeds the running Put of the store, which sends its result to done
+	w    *io.PipeWriter
+	done chan error
+	// written is how many bytes of the segment were received, validator identifies the version
+	// of the resource they belong to, see resumable
+	written   int64
+	validator string
+}
+
+func (h *hlsDownloader) newSegmentSink(t *track, segment *segment) *segmentSink {
+	s := &segmentSink{h: h, t: t, segment: segment}
+	s.put()
+	return s
+}
+
+// put starts putting the segment into the store
+func (s *segmentSink) put() {
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	s.w, s.done = w, done
+	go func(store SegmentStore, seqID uint64) {
+		err := store.Put(seqID, r)
+		// the writes a store stopped reading fail instead of blocking
+		r.CloseWithError(err)
+		done <- err
+	}(s.t.store, s.segment.SeqId)
+}
+
+func (s *segmentSink) Write(p []byte) (n int, err error) {
+	n, err = s.w.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// reset drops the content received so far and starts the segment over
+func (s *segmentSink) reset() error {
+	s.written, s.validator = 0, ""
+	s.w.CloseWithError(errors.New("segment started over"))
+	<-s.done
+	s.put()
+	return nil
+}
+
+// close completes the segment, the content of a failed download is dropped
+func (s *segmentSink) close(err error) error {
+	if err != nil {
+		s.discard()
+		return err
+	}
+	s.w.Close()
+	if err := <-s.done; err != nil {
+		s.t.store.Delete(s.segment.SeqId)
+		return err
+	}
+	s.segment.store, s.segment.size = s.t.store, s.written
+	return nil
+}
+
+// discard drops the content received so far
+func (s *segmentSink) discard() {
+	s.w.CloseWithError(errors.New("segment discarded"))
+	<-s.done
+	if err := s.t.store.Delete(s.segment.SeqId); err != nil {
+		s.h.log().warnf("Failed to delete segment %d of %s: %s\n", s.segment.SeqId, s.t.name, err.Error())
+	}
+}
+
+// openSegment opens the content of a downloaded segment
+func openSegment(segment *segment) (io.ReadCloser, error) {
+	if segment.store == nil {
+		return nil, fmt.Errorf("segment %d is not stored", segment.SeqId)
+	}
+	return segment.store.Get(segment.SeqId)
+}
+
+// readSegment returns the content of a downloaded segment
+func readSegment(segment *segment) ([]byte, error) {
+	r, err := openSegment(segment)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// segmentSize returns the size of a downloaded segment
+func segmentSize(segment *segment) int64 {
+	return segment.size
+}
+
+// releaseSegment drops a segment once written, removing it from its store
+func (h *hlsDownloader) releaseSegment(segment *segment) error {
+	if segment.store == nil {
+		return nil
+	}
+	store := segment.store
+	segment.store = nil
+	return store.Delete(segment.SeqId)
+}
@@ -0,0 +1,73 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SetMirrors sets alternate base URLs serving the same segments, e.g. other CDNs. A segment that
+// keeps failing on its own URL (404 or 410, timeouts, server errors) is downloaded from the mirrors
+// in turn before the download fails, unreachable mirrors being skipped. Segments below the directory
+// of their playlist, or of the base URL, are resolved against the mirror, the others keep their path
+// on the host of the mirror.
+func (h *hlsDownloader) SetMirrors(baseURLs ...string) error {
+	if h == nil {
+		return errors.New("attempt to set mirrors on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	var mirrors []*url.URL
+	for _, baseURL := range baseURLs {
+		u, err := url.Parse(baseURL)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("mirror %q must be an absolute url", baseURL)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		mirrors = append(mirrors, u)
+	}
+	h.mirrors = mirrors
+	return nil
+}
+
+// segmentURL returns the URL the segment is downloaded from, on the mirror it was moved to if any
+func (h *hlsDownloader) segmentURL(t *track, segment *segment) string {
+	if segment.mirror == 0 {
+		return segment.URI
+	}
+	mirror := h.mirrors[segment.mirror-1]
+	u, err := url.Parse(segment.URI)
+	if err != nil {
+		return segment.URI
+	}
+	base := h.baseURL
+	if base == nil {
+		if base, err = url.Parse(t.url); err != nil {
+			return segment.URI
+		}
+	}
+	dir := base.Path[:strings.LastIndex(base.Path, "/")+1]
+	m := *u
+	if u.Scheme == base.Scheme && u.Host == base.Host && strings.HasPrefix(u.Path, dir) {
+		m.Path = mirror.Path + strings.TrimPrefix(u.Path, dir)
+		m.RawPath = ""
+	}
+	m.Scheme, m.Host, m.User = mirror.Scheme, mirror.Host, mirror.User
+	return m.String()
+}
+
+// nextMirror moves a segment that failed on its URL, or on its current mirror, to the next mirror,
+// whatever the error as long as the download goes on. It returns false when there is none left.
+func (h *hlsDownloader) nextMirror(segment *segment) bool {
+	if segment.mirror >= len(h.mirrors) || isDataURI(segment.URI) || h.ctx.Err() != nil {
+		return false
+	}
+	h.dropPartial(segment)
+	segment.mirror++
+	return true
+}
@@ -1,14 +1,16 @@
 package HLSDownloader
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"encoding/binary"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/grafov/m3u8"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -20,21 +22,69 @@ import (
 
 type segment struct {
 	*m3u8.MediaSegment
-	path string
+	// store holds the content of the downloaded segment, of size bytes, see openStore
+	store SegmentStore
+	size  int64
+	// partial is the interrupted transfer of the segment, resumed by its next attempt
+	partial *segmentSink
+	// mirror is the position, from 1, of the mirror the segment is downloaded from, 0 for its own URL
+	mirror int
+	// skipReason is set when the segment is left out of the output
+	skipReason string
+	// adBreak is the identifier of the ad break the segment belongs to
+	adBreak string
+	// mediaSequence is the EXT-X-MEDIA-SEQUENCE of the playlist listing the segment
+	mediaSequence uint64
+	// bitrate is the approximate bits per second of the segment from EXT-X-BITRATE, zero when unknown
+	bitrate int64
+	// attempts counts the requests of the segment, the first one sent at fetchStart, fetchTime
+	// after it the last one ended
+	attempts   int
+	fetchStart time.Time
+	fetchTime  time.Duration
+}
+
+// isAES128 reports whether the whole segment is encrypted with AES-128, SAMPLE-AES
+// segments are left as is unless their samples are decrypted with content keys
+func (s *segment) isAES128() bool {
+	return s.Key != nil && s.Key.Method == "AES-128"
+}
+
+// isFMP4 reports whether the segment is a fragmented MP4 (CMAF) fragment,
+// which is the case whenever it has a Media Initialization Section
+func (s *segment) isFMP4() bool {
+	return s.Map != nil
 }
 
 type downloadResult struct {
 	err           error
 	seqId         uint64
 	totalSegments uint64
+	// bytes is the size of the segment downloaded
+	bytes int64
+	// failure is the error of a segment skipped because it could not be downloaded
+	failure error
 }
 
 type workerController struct {
+	track          *track
 	segments       chan *segment
 	downloadResult chan *downloadResult
 	abort          chan struct{}
 	success        chan struct{}
 	wg             sync.WaitGroup
+	// writer appends the segments of the batch as they are downloaded, nil when the batch is
+	// written once complete
+	writer *segmentWriter
+}
+
+// sendResult reports the result of a segment unless the download was aborted, in which
+// case nobody receives it anymore
+func (wc *workerController) sendResult(result *downloadResult) {
+	select {
+	case wc.downloadResult <- result:
+	case <-wc.abort:
+	}
 }
 
 type outParams struct {
@@ -42,26 +92,19 @@ type outParams struct {
 	path      string
 	filename  string
 	extension string
+	// base is the output without extension when none was requested
+	base string
 }
 
 const (
 	syncByte = uint8(71) //0x47
 )
 
-func EnableLogs() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetOutput(os.Stdout)
-}
-
-func DisableLogs() {
-	log.SetOutput(io.Discard)
-}
-
 func testFileWrite(out outParams) error {
 	file, err := os.Create(out.output)
 	if err != nil {
 		if os.IsPermission(err) {
-			return os.ErrPermission
+			return ErrOutputPermission
 		}
 	}
 	defer os.Remove(out.output)
@@ -81,7 +124,7 @@ func validateOutputPermission(out outParams) error {
 	}
 	if info.IsDir() {
 		if info.Mode().Perm()&(1<<7) == 0 {
-			return os.ErrPermission
+			return ErrOutputPermission
 		}
 	} else {
 		if !info.Mode().IsRegular() {
@@ -89,20 +132,30 @@ func validateOutputPermission(out outParams) error {
 		}
 
 		if info.Mode().Perm()&0200 == 0 {
-			return os.ErrPermission
+			return ErrOutputPermission
 		}
-		return testFileWrite(out)
+		// the existing output is replaced once the download completes, it is left as is meanwhile
+		file, err := os.OpenFile(out.output, os.O_WRONLY, 0)
+		if err != nil {
+			if os.IsPermission(err) {
+				return ErrOutputPermission
+			}
+			return err
+		}
+		return file.Close()
 	}
 	return nil
 }
 
-func validateOutput(output string) (outParams, error) {
+// validateOutput completes the output requested with the current directory, a name and an
+// extension, and applies the policy when it already exists
+func validateOutput(output string, policy OverwritePolicy, log levelLogger) (outParams, error) {
 	var err error
 	now := time.Now().Unix()
-	nowFilename := fmt.Sprintf("%d.ts", now)
+	nowFilename := fmt.Sprintf("%d", now)
 
 	if output == "" {
-		log.Printf("No output file specified, saving to current directory as %s\n", nowFilename)
+		log.infof("No output file specified, saving to current directory as %s\n", nowFilename)
 		output, err = os.Getwd()
 		if err != nil {
 			return outParams{}, err
@@ -120,219 +173,496 @@ func validateOutput(output string) (outParams, error) {
 		filename = nowFilename
 	}
 	extension := filepath.Ext(filename)
+	base := ""
 	if extension == "" {
-		output += ".ts"
+		// the extension is picked from the first segment once the playlist is loaded
+		base = filepath.Join(path, filename)
 		filename += ".ts"
 		extension = ".ts"
 	}
-	output = filepath.Join(path, filename)
-	_, err = os.Stat(output)
+	output, err = availablePath(filepath.Join(path, filename), policy, log)
 	if err != nil {
-		inputParams := outParams{
-			output:    output,
-			path:      path,
-			filename:  filename,
-			extension: extension,
-		}
-		return inputParams, nil
+		return outParams{}, err
+	}
+	inputParams := outParams{
+		output:    output,
+		path:      path,
+		filename:  filepath.Base(output),
+		extension: extension,
+		base:      base,
 	}
-	log.Printf("File %s already exists\n", filename)
-	filename = fmt.Sprintf("%d%s", time.Now().Unix(), extension)
-	output = filepath.Join(path, filename)
-	log.Printf("Saving file as %s instead\n", filename)
-	return validateOutput(output)
+	return inputParams, nil
 }
 
-func validateURL(URL string) error {
-	resp, err := http.Head(URL)
+// validateURL checks that the playlist can be fetched, with a HEAD request
+func (h *hlsDownloader) validateURL(ctx context.Context) error {
+	if isLocalPlaylist(h.url) {
+		return validateLocalPlaylist(h.url)
+	}
+	req, err := newMethodRequest(ctx, http.MethodHead, h.url, h.header)
 	if err != nil {
 		return err
 	}
+	fetcher := h.newFetcher()
+	resp, err := fetcher.Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// many origins reject HEAD requests (403, 405, 501), the first byte of the playlist is
+	// requested instead
 	if resp.StatusCode != http.StatusOK {
+		req, err = newRequest(ctx, h.url, h.header)
+		if err != nil {
+			return err
+		}
+		setRange(req, 0, 1)
+		resp, err = fetcher.Do(ctx, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		errorMessage := fmt.Sprintf("url is not valid. %s", resp.Status)
 		return errors.New(errorMessage)
 	}
 	return nil
 }
 
-func validateParameters(URL string, output string) (outParams, error) {
-	err := validateURL(URL)
+func newRequest(ctx context.Context, url string, header *http.Header) (*http.Request, error) {
+	return newMethodRequest(ctx, http.MethodGet, url, header)
+}
+
+// newMethodRequest builds a request of the method, the request hooks see it as sent
+func newMethodRequest(ctx context.Context, method string, url string, header *http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
-		return outParams{}, err
+		return nil, err
+	}
+	req.Header = *header
+	if err := applyRequestHooks(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// setRange requests the byte range [offset, offset+limit) of the resource
+func setRange(req *http.Request, offset int64, limit int64) {
+	cloneRequestHeader(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+limit-1))
+}
+
+// getM3u8ListType fetches and decodes the playlist, it also returns the URL the playlist
+// was served from once redirects are followed. imports are the variables a media playlist
+// can import from its master playlist.
+func getM3u8ListType(ctx context.Context, URL string, header *http.Header, fetcher Fetcher, imports map[string]string, strict bool, logger levelLogger) (m3u8.Playlist, m3u8.ListType, []byte, *url.URL, error) {
+	data, finalURL, err := readPlaylist(ctx, URL, header, fetcher, logger)
+	if err != nil {
+		return nil, 0, nil, nil, err
 	}
-	out, err := validateOutput(output)
+	data, err = resolveVariables(data, URL, imports)
 	if err != nil {
-		return out, err
+		return nil, 0, nil, nil, err
 	}
-	err = validateOutputPermission(out)
+
+	p, t, err := decodePlaylist(URL, data, strict, logger)
 	if err != nil {
-		return out, err
+		return nil, 0, nil, nil, err
 	}
 
-	return out, nil
+	return p, t, data, finalURL, nil
 }
 
-func newRequest(url string, header *http.Header) (*http.Request, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+// decodePlaylist decodes the playlist strictly, unless strict is set a playlist with syntax
+// errors is decoded again skipping the faulty lines
+func decodePlaylist(URL string, data []byte, strict bool, logger levelLogger) (m3u8.Playlist, m3u8.ListType, error) {
+	p, t, err := m3u8.DecodeWith(*bytes.NewBuffer(data), true, customDecoders)
+	if err == nil || strict {
+		return p, t, err
 	}
-	req.Header = *header
-	return req, nil
+	logger.warnf("Playlist %s is malformed (%v), skipping the invalid lines\n", URL, err)
+	return m3u8.DecodeWith(*bytes.NewBuffer(data), false, customDecoders)
 }
 
-func getM3u8ListType(url string, header *http.Header) (m3u8.Playlist, m3u8.ListType, error) {
+// readPlaylist fetches the playlist, file:// URLs are read from disk
+func readPlaylist(ctx context.Context, URL string, header *http.Header, fetcher Fetcher, logger levelLogger) ([]byte, *url.URL, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return nil, nil, errors.New("invalid url")
+	}
+	if u.Scheme == "file" {
+		data, err := os.ReadFile(localPath(u))
+		return data, u, err
+	}
 
-	req, err := newRequest(url, header)
+	req, err := newRequest(ctx, URL, header)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := fetcher.Do(ctx, req)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, 0, errors.New(res.Status)
+		return nil, nil, newStatusError(res)
 	}
-
-	p, t, err := m3u8.DecodeFrom(res.Body, false)
+	data, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
+	// relative URIs are resolved against the playlist location after redirects
+	if finalURL := res.Request.URL.String(); finalURL != URL {
+		logger.debugf("Playlist %s redirected to %s\n", URL, finalURL)
+	}
+	return data, res.Request.URL, nil
+}
 
-	return p, t, nil
+// mediaPlaylist is a decoded media playlist along with the tags the m3u8 parser does not handle
+type mediaPlaylist struct {
+	*m3u8.MediaPlaylist
+	lowLatency *lowLatency
+	adBreaks   *adBreaks
 }
 
-func parseHLSSegments(URL string, header *http.Header) ([]*segment, error) {
-	baseURL, err := url.Parse(URL)
+// decodeMediaPlaylist builds the segments of a decoded media playlist, data is the
+// raw playlist scanned for the tags the m3u8 parser ignores
+func decodeMediaPlaylist(baseURL *url.URL, p *m3u8.MediaPlaylist, data []byte) (*mediaPlaylist, []*segment, error) {
+	lowLatency, err := parseLowLatency(baseURL, data, p.SeqNo)
 	if err != nil {
-		return nil, errors.New("invalid url")
+		return nil, nil, err
+	}
+	mediaList := &mediaPlaylist{
+		MediaPlaylist: p,
+		lowLatency:    lowLatency,
+		adBreaks:      parseAdBreaks(data, p.SeqNo),
 	}
+	segments, err := mediaSegments(baseURL, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	mediaList.adBreaks.mark(segments)
+	return mediaList, segments, nil
+}
 
-	p, t, err := getM3u8ListType(URL, header)
+// parseHLSSegments fetches the media playlist at URL. Its relative URIs are resolved against
+// baseURL, or the URL the playlist was served from when baseURL is nil.
+func parseHLSSegments(ctx context.Context, URL string, baseURL *url.URL, header *http.Header, fetcher Fetcher, imports map[string]string, strict bool, logger levelLogger) (*mediaPlaylist, []*segment, error) {
+	p, t, data, finalURL, err := getM3u8ListType(ctx, URL, header, fetcher, imports, strict, logger)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if baseURL == nil {
+		baseURL = finalURL
 	}
 	if t != m3u8.MEDIA {
-		return nil, errors.New("M38U is not media type")
+		return nil, nil, ErrNotMediaPlaylist
 	}
+	return decodeMediaPlaylist(baseURL, p.(*m3u8.MediaPlaylist), data)
+}
 
-	mediaList := p.(*m3u8.MediaPlaylist)
+func mediaSegments(baseURL *url.URL, mediaList *m3u8.MediaPlaylist) ([]*segment, error) {
 	var segments []*segment
+	var initMap *m3u8.Map
+	var key *m3u8.Key
+	var prevURI string
+	var prevEnd int64
+	var bitrate int64
 	for _, seg := range mediaList.Segments {
 		if seg == nil {
 			continue
 		}
 
-		if !strings.Contains(seg.URI, "http") {
-			segmentURL, err := baseURL.Parse(seg.URI)
-			if err != nil {
-				return nil, err
+		// EXT-X-BYTERANGE without an offset starts right after the previous sub-range of the same resource
+		if seg.Limit > 0 {
+			if seg.Offset == 0 && seg.URI == prevURI {
+				seg.Offset = prevEnd
 			}
-
-			seg.URI = segmentURL.String()
+			prevURI = seg.URI
+			prevEnd = seg.Offset + seg.Limit
+		} else {
+			prevURI = ""
+			prevEnd = 0
 		}
 
-		if seg.Key == nil && mediaList.Key != nil {
-			seg.Key = mediaList.Key
-		}
-
-		if seg.Key != nil && !strings.Contains(seg.Key.URI, "http") {
-			keyURL, err := baseURL.Parse(seg.Key.URI)
+		// EXT-X-MAP applies to every following segment until the next EXT-X-MAP
+		if seg.Map != nil {
+			mapURL, err := baseURL.Parse(seg.Map.URI)
 			if err != nil {
 				return nil, err
 			}
+			seg.Map.URI = mapURL.String()
+			initMap = seg.Map
+		}
+		seg.Map = initMap
 
-			seg.Key.URI = keyURL.String()
+		segmentURL, err := baseURL.Parse(seg.URI)
+		if err != nil {
+			return nil, err
+		}
+		seg.URI = segmentURL.String()
+
+		// the parser only attaches EXT-X-KEY to the segment following it, while it applies
+		// to every segment until the next EXT-X-KEY. METHOD=NONE segments are left clear.
+		if seg.Key != nil {
+			key = seg.Key
+			if key.Method == "NONE" {
+				key = nil
+			} else if key.URI != "" {
+				keyURL, err := baseURL.Parse(key.URI)
+				if err != nil {
+					return nil, err
+				}
+				key.URI = keyURL.String()
+			}
 		}
+		seg.Key = key
 
-		segment := &segment{MediaSegment: seg}
+		segment := &segment{MediaSegment: seg, mediaSequence: mediaList.SeqNo}
+		if _, gap := seg.Custom[gapTagName]; gap {
+			segment.skipReason = SkipGap
+		}
+		// EXT-X-BITRATE applies to every following segment until the next EXT-X-BITRATE
+		if tag, ok := seg.Custom[bitrateTagName].(bitrateTag); ok {
+			bitrate = tag.kbps * 1000
+		}
+		segment.bitrate = bitrate
 		segments = append(segments, segment)
 	}
+	fillProgramDateTime(segments)
 
 	return segments, nil
 }
 
-func decryptAES128(crypted, key, iv []byte) ([]byte, error) {
+// decryptAES128 decrypts AES-128 CBC data, removing the padding of the last block when unpad is set
+func decryptAES128(crypted, key, iv []byte, unpad bool, log levelLogger) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	blockSize := block.BlockSize()
-	blockMode := cipher.NewCBCDecrypter(block, iv[:blockSize])
+	if len(iv) != blockSize {
+		return nil, fmt.Errorf("invalid IV length %d", len(iv))
+	}
+	if len(crypted) == 0 || len(crypted)%blockSize != 0 {
+		return nil, fmt.Errorf("encrypted data length %d is not a multiple of the block size", len(crypted))
+	}
+	blockMode := cipher.NewCBCDecrypter(block, iv)
 	origData := make([]byte, len(crypted))
 	blockMode.CryptBlocks(origData, crypted)
-	origData = pkcs5UnPadding(origData)
+	if unpad {
+		origData = pkcs7UnPadding(origData, log)
+	}
 	return origData, nil
 }
 
-func pkcs5UnPadding(origData []byte) []byte {
+// pkcs7UnPadding removes the PKCS#7 padding of the last block. Data with an invalid padding is
+// kept as is with a warning to log, some encoders do not pad the last block.
+func pkcs7UnPadding(origData []byte, log levelLogger) []byte {
 	length := len(origData)
+	if length == 0 {
+		return origData
+	}
 	unPadding := int(origData[length-1])
+	valid := unPadding > 0 && unPadding <= aes.BlockSize && unPadding <= length
+	for i := length - unPadding; valid && i < length; i++ {
+		valid = int(origData[i]) == unPadding
+	}
+	if !valid {
+		log.warnf("Invalid PKCS#7 padding, keeping the last block as is\n")
+		return origData
+	}
 	return origData[:(length - unPadding)]
 }
 
-func decrypt(segment *segment, client *http.Client) ([]byte, error) {
-
-	file, err := os.Open(segment.path)
+// decrypt writes the segment to w, AES-128 segments are decrypted in chunks as they are written
+func decrypt(w io.Writer, segment *segment, keys *keyCache, unpad bool, log levelLogger) error {
+	file, err := openSegment(segment)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
 
-	data, err := io.ReadAll(file)
+	var r io.Reader = file
+	if segment.isAES128() {
+		key, iv, err := getKey(segment, keys)
+		if err != nil {
+			return err
+		}
+		cbc, err := newCBCReader(file, key, iv, unpad, log)
+		if err != nil {
+			return err
+		}
+		defer cbc.release()
+		r = cbc
+	}
+
+	br := getReader()
+	defer putReader(br)
+	br.Reset(r)
+	if !segment.isFMP4() {
+		// transport streams start at the first sync byte of their head
+		head, err := br.Peek(cbcChunkSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !isPackedAudio(head) {
+			if j := bytes.IndexByte(head, syncByte); j > 0 {
+				if _, err := br.Discard(j); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err = br.WriteTo(w)
+	return err
+}
+
+// isPackedAudio reports whether data is a raw audio segment (AAC, MP3, AC-3) rather than a
+// transport stream, packed audio segments start with an ID3 tag or a frame sync word
+func isPackedAudio(data []byte) bool {
+	if id3Size(data) > 0 {
+		return true
+	}
+	if len(data) < 2 {
+		return false
+	}
+	// ADTS and MPEG audio frames start with 11 set bits, AC-3 and E-AC-3 frames with 0x0B77
+	return (data[0] == 0xFF && data[1]&0xE0 == 0xE0) || (data[0] == 0x0B && data[1] == 0x77)
+}
+
+// fetchResource downloads a whole resource or, when limit is set, the byte range [offset, offset+limit) of it
+func fetchResource(ctx context.Context, URI string, limit int64, offset int64, header *http.Header, fetcher Fetcher) ([]byte, error) {
+	if isDataURI(URI) {
+		data, err := decodeDataURI(URI)
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 {
+			if int64(len(data)) < offset+limit {
+				return nil, errors.New("byte range out of the data URI")
+			}
+			data = data[offset : offset+limit]
+		}
+		return data, nil
+	}
+	req, err := newRequest(ctx, URI, header)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		setRange(req, offset, limit)
+	}
+	res, err := fetcher.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return nil, newStatusError(res)
+	}
+	data, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
+	if limit > 0 && res.StatusCode == http.StatusOK && int64(len(data)) >= offset+limit {
+		data = data[offset : offset+limit]
+	}
+	return data, nil
+}
+
+func isDataURI(URI string) bool {
+	return len(URI) >= 5 && strings.EqualFold(URI[:5], "data:")
+}
 
-	if segment.Key != nil {
-		key, iv, err := getKey(segment, client)
+// decodeDataURI returns the data embedded in a data: URI (RFC 2397), base64 or percent encoded
+func decodeDataURI(URI string) ([]byte, error) {
+	mediaType, data, found := strings.Cut(URI[len("data:"):], ",")
+	if !found {
+		return nil, errors.New("invalid data URI")
+	}
+	if strings.HasSuffix(strings.ToLower(mediaType), ";base64") {
+		data, err := url.PathUnescape(data)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid data URI: %w", err)
 		}
-		data, err = decryptAES128(data, key, iv)
+		decoded, err := base64.StdEncoding.DecodeString(data)
 		if err != nil {
-			return nil, err
+			// some encoders leave the padding out
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid data URI: %w", err)
 		}
+		return decoded, nil
+	}
+	decoded, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data URI: %w", err)
 	}
+	return []byte(decoded), nil
+}
 
-	for j := 0; j < len(data); j++ {
-		if data[j] == syncByte {
-			data = data[j:]
-			break
+// getInitSegment fetches the Media Initialization Section (EXT-X-MAP) of the segment,
+// decrypting it with the segment key when the stream is encrypted
+func getInitSegment(ctx context.Context, segment *segment, keys *keyCache, unpad bool, log levelLogger, header *http.Header, fetcher Fetcher) ([]byte, error) {
+	data, err := fetchResource(ctx, segment.Map.URI, segment.Map.Limit, segment.Map.Offset, header, fetcher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get init segment: %w", err)
+	}
+	if segment.isAES128() {
+		key, iv, err := getKey(segment, keys)
+		if err != nil {
+			return nil, err
+		}
+		data, err = decryptAES128(data, key, iv, unpad, log)
+		if err != nil {
+			return nil, err
 		}
 	}
-
 	return data, nil
 }
 
-func getKey(segment *segment, client *http.Client) (key []byte, iv []byte, err error) {
-	res, err := client.Get(segment.Key.URI)
-	if err != nil {
-		return nil, nil, err
+// getKey returns the key and IV of the segment, the key provider is asked before the key URI is fetched
+func getKey(segment *segment, keys *keyCache) (key []byte, iv []byte, err error) {
+	if keys.provider != nil {
+		key, iv, err = keys.provider.GetKey(keys.ctx, segment.Key.URI, segment.SeqId)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w from key provider: %w", ErrKeyFetch, err)
+		}
 	}
-
-	if res.StatusCode != 200 {
-		return nil, nil, errors.New("Failed to get descryption key")
+	if key == nil {
+		key, err = keys.get(segment.Key.URI)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	key, err = io.ReadAll(res.Body)
-	if err != nil {
-		return nil, nil, err
+	if iv != nil {
+		return key, iv, nil
 	}
-
-	iv = []byte(segment.Key.IV)
-	if len(iv) == 0 {
-		iv = defaultIV(segment.SeqId)
+	if segment.Key.IV == "" {
+		return key, keys.ivStrategy.iv(segment), nil
 	}
-	return
+	iv, err = parseIV(segment.Key.IV)
+	return key, iv, err
 }
 
-func defaultIV(seqID uint64) []byte {
-	buf := make([]byte, 16)
-	binary.BigEndian.PutUint64(buf[8:], seqID)
-	return buf
+// parseIV decodes the hexadecimal IV attribute of EXT-X-KEY into a 16 bytes IV
+func parseIV(value string) ([]byte, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	if len(digits)%2 == 1 {
+		digits = "0" + digits
+	}
+	b, err := hex.DecodeString(digits)
+	if err != nil || len(b) == 0 || len(b) > aes.BlockSize {
+		return nil, fmt.Errorf("invalid key IV %q", value)
+	}
+	// shorter values are the low order bytes of the 128 bits IV
+	iv := make([]byte, aes.BlockSize)
+	copy(iv[aes.BlockSize-len(b):], b)
+	return iv, nil
 }
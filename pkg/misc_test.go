@@ -0,0 +1,101 @@
+package HLSDownloader
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestMediaSegmentsKeys(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin"
+#EXTINF:4,
+seg10.ts
+#EXTINF:4,
+seg11.ts
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.com/key2.bin",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:4,
+seg12.ts
+#EXTINF:4,
+seg13.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+seg14.ts
+#EXTINF:4,
+seg15.ts
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/key3.bin"
+#EXTINF:4,
+seg16.ts
+#EXT-X-ENDLIST
+`
+	p, listType, err := decodePlaylist("test", []byte(playlist), true, defaultLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listType != m3u8.MEDIA {
+		t.Fatalf("got list type %v, want a media playlist", listType)
+	}
+	base, _ := url.Parse("https://cdn.example.com/live/index.m3u8")
+	segments, err := mediaSegments(base, p.(*m3u8.MediaPlaylist))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		seqID uint64
+		uri   string
+		// keyURI is empty for a clear segment
+		keyURI string
+		iv     string
+	}{
+		{10, "https://cdn.example.com/live/seg10.ts", "https://cdn.example.com/live/key1.bin", ""},
+		{11, "https://cdn.example.com/live/seg11.ts", "https://cdn.example.com/live/key1.bin", ""},
+		{12, "https://cdn.example.com/live/seg12.ts", "https://keys.example.com/key2.bin", "0x000102030405060708090a0b0c0d0e0f"},
+		{13, "https://cdn.example.com/live/seg13.ts", "https://keys.example.com/key2.bin", "0x000102030405060708090a0b0c0d0e0f"},
+		{14, "https://cdn.example.com/live/seg14.ts", "", ""},
+		{15, "https://cdn.example.com/live/seg15.ts", "", ""},
+		{16, "https://cdn.example.com/live/seg16.ts", "https://cdn.example.com/keys/key3.bin", ""},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i, w := range want {
+		s := segments[i]
+		if s.SeqId != w.seqID || s.URI != w.uri {
+			t.Errorf("segment %d: got %d %s, want %d %s", i, s.SeqId, s.URI, w.seqID, w.uri)
+		}
+		if w.keyURI == "" {
+			if s.Key != nil || s.isAES128() {
+				t.Errorf("segment %d: got key %+v, want a clear segment", w.seqID, s.Key)
+			}
+			continue
+		}
+		if s.Key == nil || !s.isAES128() {
+			t.Errorf("segment %d: got no AES-128 key, want %s", w.seqID, w.keyURI)
+			continue
+		}
+		if s.Key.URI != w.keyURI || s.Key.IV != w.iv {
+			t.Errorf("segment %d: got key %s IV %q, want %s IV %q", w.seqID, s.Key.URI, s.Key.IV, w.keyURI, w.iv)
+		}
+	}
+
+	// segments without an explicit IV derive it from their sequence number
+	if iv, want := SequenceIV.iv(segments[1]), []byte{15: 11}; !bytes.Equal(iv, want) {
+		t.Errorf("segment 11: got IV %x, want %x", iv, want)
+	}
+	if iv, want := OffsetIV.iv(segments[1]), []byte{15: 1}; !bytes.Equal(iv, want) {
+		t.Errorf("segment 11: got offset IV %x, want %x", iv, want)
+	}
+	iv, err := parseIV(segments[3].Key.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}; !bytes.Equal(iv, want) {
+		t.Errorf("segment 13: got IV %x, want %x", iv, want)
+	}
+}
@@ -0,0 +1,456 @@
+package HLSDownloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var errNotFMP4 = errors.New("not a fragmented MP4")
+
+// mp4Box locates a box of a file, size includes the header
+type mp4Box struct {
+	boxType string
+	offset  int64
+	size    int64
+	header  int64
+}
+
+// fmp4Fragment is a moof box along with the mdat following it
+type fmp4Fragment struct {
+	file       *os.File
+	moof       []byte
+	mdat       mp4Box
+	decodeTime float64
+}
+
+// fmp4Track is a single track fragmented MP4 file
+type fmp4Track struct {
+	ftyp      []byte
+	moov      []byte
+	trackID   uint32
+	timescale uint32
+	fragments []*fmp4Fragment
+}
+
+// readBoxHeader reads the header of the box at offset, size 0 boxes extend to the end of the file
+func readBoxHeader(r io.ReaderAt, offset int64, end int64) (mp4Box, error) {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header[:8], offset); err != nil {
+		return mp4Box{}, err
+	}
+	box := mp4Box{
+		boxType: string(header[4:8]),
+		offset:  offset,
+		size:    int64(binary.BigEndian.Uint32(header)),
+		header:  8,
+	}
+	switch box.size {
+	case 0:
+		box.size = end - offset
+	case 1:
+		if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+			return mp4Box{}, err
+		}
+		box.size = int64(binary.BigEndian.Uint64(header[8:16]))
+		box.header = 16
+	}
+	if box.size < box.header || offset+box.size > end {
+		return mp4Box{}, fmt.Errorf("invalid %q box at offset %d", box.boxType, offset)
+	}
+	return box, nil
+}
+
+// childBoxes returns the boxes contained in the payload of a box held in memory
+func childBoxes(data []byte, header int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	r := bytes.NewReader(data)
+	for offset := header; offset < int64(len(data)); {
+		box, err := readBoxHeader(r, offset, int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+		offset += box.size
+	}
+	return boxes, nil
+}
+
+func findBox(data []byte, header int64, path ...string) ([]byte, error) {
+	boxes, err := childBoxes(data, header)
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range boxes {
+		if box.boxType != path[0] {
+			continue
+		}
+		child := data[box.offset : box.offset+box.size]
+		if len(path) == 1 {
+			return child, nil
+		}
+		return findBox(child, box.header, path[1:]...)
+	}
+	return nil, fmt.Errorf("missing %q box", path[0])
+}
+
+// readFMP4 indexes the init segment and the fragments of a fragmented MP4 file
+func readFMP4(file *os.File) (*fmp4Track, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+	track := &fmp4Track{}
+
+	var moof []byte
+	for offset := int64(0); offset < end; {
+		box, err := readBoxHeader(file, offset, end)
+		if err != nil {
+			if offset == 0 {
+				return nil, errNotFMP4
+			}
+			return nil, err
+		}
+		if offset == 0 && box.boxType != "ftyp" && box.boxType != "moov" && box.boxType != "styp" {
+			return nil, errNotFMP4
+		}
+		offset += box.size
+
+		switch box.boxType {
+		case "ftyp", "moov", "moof":
+			data := make([]byte, box.size)
+			if _, err := file.ReadAt(data, box.offset); err != nil {
+				return nil, err
+			}
+			switch {
+			case box.boxType == "ftyp" && track.ftyp == nil:
+				track.ftyp = data
+			case box.boxType == "moov" && track.moov == nil:
+				track.moov = data
+			case box.boxType == "moof":
+				moof = data
+			}
+		case "mdat":
+			if moof == nil {
+				continue
+			}
+			fragment := &fmp4Fragment{file: file, moof: moof, mdat: box}
+			track.fragments = append(track.fragments, fragment)
+			moof = nil
+		default:
+			if box.boxType != "styp" && box.boxType != "sidx" && moof != nil {
+				return nil, fmt.Errorf("unexpected %q box between moof and mdat", box.boxType)
+			}
+		}
+	}
+	if track.moov == nil {
+		return nil, errNotFMP4
+	}
+
+	traks := 0
+	boxes, err := childBoxes(track.moov, 8)
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range boxes {
+		if box.boxType == "trak" {
+			traks++
+		}
+	}
+	if traks != 1 {
+		return nil, fmt.Errorf("only single track renditions can be muxed, found %d tracks", traks)
+	}
+	tkhd, err := findBox(track.moov, 8, "trak", "tkhd")
+	if err != nil {
+		return nil, err
+	}
+	offset, err := tkhdTrackIDOffset(tkhd)
+	if err != nil {
+		return nil, err
+	}
+	track.trackID = binary.BigEndian.Uint32(tkhd[offset:])
+	mdhd, err := findBox(track.moov, 8, "trak", "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFullBox(mdhd, 24, 32); err != nil {
+		return nil, err
+	}
+	if mdhd[8] == 1 {
+		track.timescale = binary.BigEndian.Uint32(mdhd[28:])
+	} else {
+		track.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	}
+	if track.timescale == 0 {
+		return nil, errors.New("invalid media timescale")
+	}
+
+	for _, fragment := range track.fragments {
+		tfdt, err := findBox(fragment.moof, 8, "traf", "tfdt")
+		if err != nil {
+			return nil, err
+		}
+		if err := checkFullBox(tfdt, 16, 20); err != nil {
+			return nil, err
+		}
+		var decodeTime uint64
+		if tfdt[8] == 1 {
+			decodeTime = binary.BigEndian.Uint64(tfdt[12:])
+		} else {
+			decodeTime = uint64(binary.BigEndian.Uint32(tfdt[12:]))
+		}
+		fragment.decodeTime = float64(decodeTime) / float64(track.timescale)
+	}
+	return track, nil
+}
+
+// checkFullBox verifies that a full box holds the fields read from it, which take v0 bytes,
+// header included, in version 0 boxes and v1 bytes in version 1 ones
+func checkFullBox(box []byte, v0 int, v1 int) error {
+	if len(box) < 12 {
+		return errors.New("invalid full box")
+	}
+	size := v0
+	if box[8] == 1 {
+		size = v1
+	}
+	if len(box) < size {
+		return fmt.Errorf("invalid %s box", box[4:8])
+	}
+	return nil
+}
+
+// tkhdTrackIDOffset returns where the track_ID of a tkhd box is, which depends on its version
+func tkhdTrackIDOffset(tkhd []byte) (int, error) {
+	if err := checkFullBox(tkhd, 24, 32); err != nil {
+		return 0, err
+	}
+	if tkhd[8] == 1 {
+		return 28, nil
+	}
+	return 20, nil
+}
+
+func boxHeader(boxType string, payload int) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+payload))
+	copy(header[4:], boxType)
+	return header
+}
+
+// setTrackID renumbers the tracks of the tfhd boxes of a moof
+func setTrackID(moof []byte, trackID uint32) error {
+	boxes, err := childBoxes(moof, 8)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		if box.boxType != "traf" {
+			continue
+		}
+		tfhd, err := findBox(moof[box.offset:box.offset+box.size], box.header, "tfhd")
+		if err != nil {
+			return err
+		}
+		if err := checkFullBox(tfhd, 16, 16); err != nil {
+			return err
+		}
+		if tfhd[11]&0x01 != 0 {
+			return errors.New("fragments with an explicit base data offset can not be muxed")
+		}
+		binary.BigEndian.PutUint32(tfhd[12:], trackID)
+	}
+	return nil
+}
+
+// muxedMoov builds a moov holding the track of video and the track of audio
+func muxedMoov(video *fmp4Track, audio *fmp4Track, audioID uint32) ([]byte, error) {
+	boxes, err := childBoxes(video.moov, 8)
+	if err != nil {
+		return nil, err
+	}
+	audioTrak, err := findBox(audio.moov, 8, "trak")
+	if err != nil {
+		return nil, err
+	}
+	audioTrak = append([]byte(nil), audioTrak...)
+	tkhd, err := findBox(audioTrak, 8, "tkhd")
+	if err != nil {
+		return nil, err
+	}
+	offset, err := tkhdTrackIDOffset(tkhd)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(tkhd[offset:], audioID)
+
+	var payload []byte
+	for _, box := range boxes {
+		data := append([]byte(nil), video.moov[box.offset:box.offset+box.size]...)
+		switch box.boxType {
+		case "mvhd":
+			if err := checkFullBox(data, 108, 120); err != nil {
+				return nil, err
+			}
+			// next_track_ID closes the box
+			binary.BigEndian.PutUint32(data[len(data)-4:], audioID+1)
+			payload = append(payload, data...)
+		case "trak":
+			payload = append(payload, data...)
+			payload = append(payload, audioTrak...)
+		case "mvex":
+			trex, err := findBox(audio.moov, 8, "mvex", "trex")
+			if err != nil {
+				return nil, err
+			}
+			if err := checkFullBox(trex, 16, 16); err != nil {
+				return nil, err
+			}
+			trex = append([]byte(nil), trex...)
+			binary.BigEndian.PutUint32(trex[12:], audioID)
+			data = append(data, trex...)
+			binary.BigEndian.PutUint32(data, uint32(len(data)))
+			payload = append(payload, data...)
+		default:
+			payload = append(payload, data...)
+		}
+	}
+	return append(boxHeader("moov", len(payload)), payload...), nil
+}
+
+// muxFMP4 interleaves the fragments of a video and an audio fragmented MP4 file
+// by decode time into a single two tracks fragmented MP4 file
+func muxFMP4(videoPath string, audioPath string, output string) error {
+	videoFile, err := os.Open(videoPath)
+	if err != nil {
+		return err
+	}
+	defer videoFile.Close()
+	audioFile, err := os.Open(audioPath)
+	if err != nil {
+		return err
+	}
+	defer audioFile.Close()
+
+	video, err := readFMP4(videoFile)
+	if err != nil {
+		return err
+	}
+	audio, err := readFMP4(audioFile)
+	if err != nil {
+		return err
+	}
+	audioID := video.trackID + 1
+	for _, fragment := range audio.fragments {
+		if err := setTrackID(fragment.moof, audioID); err != nil {
+			return err
+		}
+	}
+	moov, err := muxedMoov(video, audio, audioID)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(video.ftyp); err != nil {
+		return err
+	}
+	if _, err := file.Write(moov); err != nil {
+		return err
+	}
+
+	sequence := uint32(1)
+	write := func(fragment *fmp4Fragment) error {
+		mfhd, err := findBox(fragment.moof, 8, "mfhd")
+		if err != nil {
+			return err
+		}
+		if err := checkFullBox(mfhd, 16, 16); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(mfhd[12:], sequence)
+		sequence++
+		if _, err := file.Write(fragment.moof); err != nil {
+			return err
+		}
+		_, err = io.Copy(file, io.NewSectionReader(fragment.file, fragment.mdat.offset, fragment.mdat.size))
+		return err
+	}
+	v, a := 0, 0
+	for v < len(video.fragments) || a < len(audio.fragments) {
+		if a >= len(audio.fragments) || (v < len(video.fragments) && video.fragments[v].decodeTime <= audio.fragments[a].decodeTime) {
+			err = write(video.fragments[v])
+			v++
+		} else {
+			err = write(audio.fragments[a])
+			a++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMuxAudio muxes the alternate audio rendition into the main output when both are
+// fragmented MP4 (CMAF), instead of writing the audio into a separate file
+func (h *hlsDownloader) SetMuxAudio(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set mux audio on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.muxAudio = enabled
+	return nil
+}
+
+// muxTracks muxes the audio track into the main track output
+func (h *hlsDownloader) muxTracks(tracks []*track) error {
+	var main, audio *track
+	for _, t := range tracks {
+		switch t.name {
+		case "main":
+			main = t
+		case "audio":
+			audio = t
+		}
+	}
+	if main == nil || audio == nil {
+		return nil
+	}
+	if len(main.outputs) != 1 || len(audio.outputs) != 1 {
+		h.log().warnf("Audio can only be muxed into a single output file, keeping %s\n", audio.output)
+		return nil
+	}
+
+	muxed := main.outputs[0] + ".mux"
+	err := muxFMP4(main.outputs[0], audio.outputs[0], muxed)
+	if errors.Is(err, errNotFMP4) {
+		os.Remove(muxed)
+		h.log().warnf("Audio can only be muxed with fragmented MP4 renditions, keeping %s\n", audio.output)
+		return nil
+	}
+	if err != nil {
+		os.Remove(muxed)
+		return err
+	}
+	if err := os.Rename(muxed, main.outputs[0]); err != nil {
+		return err
+	}
+	if err := os.Remove(audio.outputs[0]); err != nil {
+		return err
+	}
+	h.log().infof("Muxed %s into %s\n", audio.outputs[0], main.outputs[0])
+	audio.outputs = nil
+	return nil
+}
@@ -0,0 +1,109 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutputExists is returned with OverwriteError when the output, or one of the files written
+// beside it, already exists
+var ErrOutputExists = errors.New("output already exists")
+
+// OverwritePolicy tells what to do when the output already exists
+type OverwritePolicy int
+
+const (
+	// OverwriteRename saves the output under another name, numbered after the one requested (default)
+	OverwriteRename OverwritePolicy = iota
+	// OverwriteError fails with ErrOutputExists
+	OverwriteError
+	// OverwriteReplace replaces the existing file once the download completes
+	OverwriteReplace
+	// OverwriteResume keeps the name and resumes the previous download into it, see SetResume.
+	// Without the job state of a previous run the file is replaced.
+	OverwriteResume
+)
+
+func (p OverwritePolicy) String() string {
+	switch p {
+	case OverwriteRename:
+		return "rename"
+	case OverwriteError:
+		return "error"
+	case OverwriteReplace:
+		return "overwrite"
+	case OverwriteResume:
+		return "resume"
+	}
+	return fmt.Sprintf("OverwritePolicy(%d)", int(p))
+}
+
+// ParseOverwritePolicy converts a textual policy ("rename", "error", "overwrite", "resume") into
+// an OverwritePolicy
+func ParseOverwritePolicy(s string) (OverwritePolicy, error) {
+	switch s {
+	case "", "rename":
+		return OverwriteRename, nil
+	case "error":
+		return OverwriteError, nil
+	case "overwrite", "replace":
+		return OverwriteReplace, nil
+	case "resume":
+		return OverwriteResume, nil
+	}
+	return 0, fmt.Errorf("unknown overwrite policy %q", s)
+}
+
+// SetOverwritePolicy sets what to do when the output already exists, OverwriteRename by default.
+// The policy applies as well to the files written beside the output: the other tracks, the parts
+// of a split output and the sidecars.
+func (h *hlsDownloader) SetOverwritePolicy(policy OverwritePolicy) error {
+	if h == nil {
+		return errors.New("attempt to set overwrite policy on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if policy < OverwriteRename || policy > OverwriteResume {
+		return fmt.Errorf("invalid overwrite policy %d", int(policy))
+	}
+	h.overwritePolicy = policy
+	// the output picked by Validate depends on the policy
+	h.validated = false
+	return nil
+}
+
+// resumeEnabled reports whether the download resumes the previous run, see SetResume and
+// OverwriteResume
+func (h *hlsDownloader) resumeEnabled() bool {
+	return h.resume || h.overwritePolicy == OverwriteResume
+}
+
+// availablePath applies the policy to path, returning the path to write to
+func availablePath(path string, policy OverwritePolicy, log levelLogger) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return path, nil
+	}
+	switch policy {
+	case OverwriteError:
+		return "", fmt.Errorf("%w: %s", ErrOutputExists, path)
+	case OverwriteReplace:
+		log.infof("File %s already exists, replacing it\n", path)
+		return path, nil
+	case OverwriteResume:
+		return path, nil
+	}
+	extension := filepath.Ext(path)
+	base := strings.TrimSuffix(path, extension)
+	for i := 1; ; i++ {
+		renamed := fmt.Sprintf("%s_%d%s", base, i, extension)
+		if _, err := os.Stat(renamed); err != nil {
+			log.infof("File %s already exists, saving as %s instead\n", path, renamed)
+			return renamed, nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package HLSDownloader
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// An interrupted segment transfer is resumed by the next attempt from the bytes already received,
+// with a Range request guarded by If-Range so that a resource changed meanwhile is sent whole.
+
+// resumable reports whether the transfer can be resumed: some bytes were received and the
+// resource is identified by a validator, or the segment is a byte range of it
+func (s *segmentSink) resumable() bool {
+	return s.written > 0 && (s.validator != "" || s.segment.Limit > 0)
+}
+
+// dropPartial drops the partial transfer of a segment that is not attempted again
+func (h *hlsDownloader) dropPartial(segment *segment) {
+	if segment.partial != nil {
+		segment.partial.discard()
+		segment.partial = nil
+	}
+}
+
+// responseValidator returns the strong ETag or else the Last-Modified date of a response
+func responseValidator(res *http.Response) string {
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return res.Header.Get("Last-Modified")
+}
+
+// setResumeRange requests the rest of a segment whose first bytes were already received
+func setResumeRange(req *http.Request, segment *segment, sink *segmentSink) {
+	start := segment.Offset + sink.written
+	cloneRequestHeader(req)
+	if segment.Limit > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, segment.Offset+segment.Limit-1))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	if sink.validator != "" {
+		req.Header.Set("If-Range", sink.validator)
+	}
+}
+
+// contentRangeStart returns the first byte of a partial response, -1 when it is not known
+func contentRangeStart(res *http.Response) int64 {
+	value := strings.TrimPrefix(res.Header.Get("Content-Range"), "bytes ")
+	first, _, ok := strings.Cut(value, "-")
+	if !ok {
+		return -1
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
@@ -0,0 +1,57 @@
+package HLSDownloader
+
+// Pause stops the workers from starting new segment downloads until Resume is called.
+// Segments being downloaded are completed and the downloaded ones are kept, live playlists
+// keep being refreshed so a long pause can miss the segments leaving the window.
+func (h *hlsDownloader) Pause() {
+	if h == nil {
+		return
+	}
+	h.pauseMu.Lock()
+	defer h.pauseMu.Unlock()
+	if h.resumed == nil {
+		h.resumed = make(chan struct{})
+		h.log().infof("Download paused\n")
+	}
+}
+
+// Resume lets the workers of a paused download start new segment downloads again
+func (h *hlsDownloader) Resume() {
+	if h == nil {
+		return
+	}
+	h.pauseMu.Lock()
+	defer h.pauseMu.Unlock()
+	if h.resumed != nil {
+		close(h.resumed)
+		h.resumed = nil
+		h.log().infof("Download resumed\n")
+	}
+}
+
+// Paused reports whether the download is paused
+func (h *hlsDownloader) Paused() bool {
+	if h == nil {
+		return false
+	}
+	h.pauseMu.Lock()
+	defer h.pauseMu.Unlock()
+	return h.resumed != nil
+}
+
+// waitResumed blocks while the download is paused, it returns false when the download
+// is aborted meanwhile
+func (h *hlsDownloader) waitResumed(wc *workerController) bool {
+	h.pauseMu.Lock()
+	resumed := h.resumed
+	h.pauseMu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-wc.abort:
+		return false
+	}
+}
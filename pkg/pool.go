@@ -0,0 +1,62 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+)
+
+// The buffers of the segment transfers and decryption are reused across segments and workers,
+// a download of thousands of segments would otherwise allocate a few of them per segment
+
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		chunk := make([]byte, cbcChunkSize)
+		return &chunk
+	},
+}
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, cbcChunkSize)
+	},
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooledBuffer bounds the buffers kept in the pool, an unusually large segment does not
+// keep its memory for the rest of the download
+const maxPooledBuffer = 16 << 20
+
+func getChunk() *[]byte {
+	return chunkPool.Get().(*[]byte)
+}
+
+func putChunk(chunk *[]byte) {
+	chunkPool.Put(chunk)
+}
+
+func getReader() *bufio.Reader {
+	return readerPool.Get().(*bufio.Reader)
+}
+
+func putReader(r *bufio.Reader) {
+	r.Reset(nil)
+	readerPool.Put(r)
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
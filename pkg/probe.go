@@ -0,0 +1,118 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafov/m3u8"
+)
+
+// ProbeInfo describes a playlist without downloading it, see Probe
+type ProbeInfo struct {
+	URL string `json:"url"`
+	// Type is "master" or "media", the type of the playlist at URL
+	Type string `json:"type"`
+	// Variants are the variants of a master playlist, Variant the one a download selects
+	Variants []Variant `json:"variants,omitempty"`
+	Variant  *Variant  `json:"variant,omitempty"`
+	// PlaylistType, Duration, Segments and Encryption describe the main track
+	PlaylistType string  `json:"playlistType"`
+	Duration     float64 `json:"duration"`
+	Segments     int     `json:"segments"`
+	Encryption   string  `json:"encryption"`
+	// EstimatedSize is the estimated size of every track, zero when unknown, e.g. for live playlists
+	EstimatedSize int64 `json:"estimatedSize,omitempty"`
+	// Tracks are the media playlists a download fetches, the main one first
+	Tracks []TrackInfo `json:"tracks"`
+}
+
+// TrackInfo describes a media playlist of a ProbeInfo, named like the tracks of the Report
+type TrackInfo struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// PlaylistType is "vod" for a complete playlist, "event" or "live" for one still growing
+	PlaylistType string `json:"playlistType"`
+	// Duration is the sum of the EXTINF durations of the segments listed, in seconds
+	Duration float64 `json:"duration"`
+	Segments int     `json:"segments"`
+	// Encryption is the method of the first encrypted segment, NONE when none is
+	Encryption    string `json:"encryption"`
+	EstimatedSize int64  `json:"estimatedSize,omitempty"`
+}
+
+// Probe fetches the playlists of the download without downloading any segment or key, with the
+// same settings, and describes them. The size is estimated like by the disk space check.
+func (h *hlsDownloader) Probe() (*ProbeInfo, error) {
+	return h.ProbeContext(context.Background())
+}
+
+// ProbeContext probes like Probe, aborting as soon as ctx is done
+func (h *hlsDownloader) ProbeContext(ctx context.Context) (*ProbeInfo, error) {
+	if h == nil {
+		return nil, errors.New("instance is nil")
+	}
+	if ctx == nil {
+		return nil, errors.New("context is nil")
+	}
+	if err := h.start(); err != nil {
+		return nil, err
+	}
+	defer h.finish()
+	h.ctx = withRequestHooks(ctx, h.requestHooks)
+	h.jar = h.newCookieJar()
+	h.fetcher = h.newFetcher()
+	h.keys = nil
+	h.selectedVariant = nil
+
+	p, listType, data, baseURL, err := h.loadPlaylist()
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := h.playlistTracks(p, listType, data, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	info := &ProbeInfo{URL: h.url, Type: "media", Variant: h.selectedVariant}
+	if master, ok := p.(*m3u8.MasterPlaylist); ok {
+		info.Type = "master"
+		for _, variant := range master.Variants {
+			info.Variants = append(info.Variants, newVariant(variant))
+		}
+	}
+	for _, t := range tracks {
+		ti := TrackInfo{
+			Name:         t.name,
+			URL:          t.url,
+			PlaylistType: playlistType(t),
+			Segments:     len(t.segments),
+			Encryption:   "NONE",
+		}
+		for _, segment := range t.segments {
+			ti.Duration += segment.Duration
+			if ti.Encryption == "NONE" && segment.Key != nil && segment.Key.Method != "" {
+				ti.Encryption = segment.Key.Method
+			}
+		}
+		if ti.PlaylistType == "vod" {
+			ti.EstimatedSize = h.estimateSize(t)
+		}
+		info.EstimatedSize += ti.EstimatedSize
+		info.Tracks = append(info.Tracks, ti)
+	}
+	mainTrack := info.Tracks[0]
+	info.PlaylistType, info.Duration, info.Segments, info.Encryption = mainTrack.PlaylistType, mainTrack.Duration, mainTrack.Segments, mainTrack.Encryption
+	return info, nil
+}
+
+// playlistType tells whether the playlist of the track is complete, or still growing
+func playlistType(t *track) string {
+	switch {
+	case t.playlist.Closed:
+		return "vod"
+	case t.playlist.MediaType == m3u8.EVENT:
+		return "event"
+	case t.playlist.MediaType == m3u8.VOD:
+		return "vod"
+	}
+	return "live"
+}
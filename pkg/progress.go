@@ -0,0 +1,45 @@
+package HLSDownloader
+
+import "errors"
+
+// Progress receives the progress of a download, see SetProgress. The tracks of a download, e.g.
+// an alternate audio rendition, are downloaded in parallel and may call it concurrently.
+type Progress interface {
+	// SetTotal is called once the segments are listed, and again whenever a live playlist lists
+	// new ones. bytes is the estimated size of the download, zero when unknown.
+	SetTotal(segments int, bytes int64)
+	// SegmentDone is called for every segment downloaded, or skipped with zero bytes
+	SegmentDone(seqID uint64, bytes int64)
+	// Finished is called once every segment is downloaded
+	Finished()
+}
+
+// SetProgress sets the receiver of the progress of the download, nil removes it
+func (h *hlsDownloader) SetProgress(progress Progress) error {
+	if h == nil {
+		return errors.New("attempt to set progress on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.progress = progress
+	return nil
+}
+
+// barProgress reports the progress to the BarUpdater of SetBar, which only counts segments
+type barProgress struct {
+	bar BarUpdater
+}
+
+func (p barProgress) SetTotal(segments int, bytes int64) {
+	p.bar.SetTotal(segments)
+}
+
+func (p barProgress) SegmentDone(seqID uint64, bytes int64) {
+	p.bar.Increment()
+}
+
+func (p barProgress) Finished() {
+	p.bar.Complete()
+}
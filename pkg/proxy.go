@@ -0,0 +1,50 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// SetProxy sends the requests through the proxy at proxyURL: an http://, https:// or socks5://
+// URL, with the credentials of the proxy as its user info when needed. Empty restores the
+// default, the proxy of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. Like the
+// timeouts, the proxy applies to a copy of the transport of the client, not to a custom
+// RoundTripper, and a Manager refuses the download.
+func (h *hlsDownloader) SetProxy(proxyURL string) error {
+	if h == nil {
+		return errors.New("attempt to set proxy on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if proxyURL == "" {
+		h.proxy = nil
+		h.resetTransport()
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("proxy url has no host")
+	}
+	h.proxy = u
+	h.resetTransport()
+	return nil
+}
+
+// applyProxy sends the requests of the transport through the proxy of the download
+func (h *hlsDownloader) applyProxy(transport *http.Transport) {
+	if h.proxy != nil {
+		transport.Proxy = http.ProxyURL(h.proxy)
+	}
+}
@@ -0,0 +1,105 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"net/url"
+)
+
+// SetPropagateQuery copies the given query parameters of the playlist URL, e.g. the
+// signed token of a CDN, to every variant, rendition, segment, key and init segment
+// request. "*" copies the whole query and no names disables the propagation.
+func (h *hlsDownloader) SetPropagateQuery(names ...string) error {
+	if h == nil {
+		return errors.New("attempt to set propagate query on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.propagateQuery = names
+	return nil
+}
+
+// propagatedQuery returns the query parameters of the playlist URL copied to child requests
+func (h *hlsDownloader) propagatedQuery() url.Values {
+	if len(h.propagateQuery) == 0 {
+		return nil
+	}
+	u, err := url.Parse(h.url)
+	if err != nil {
+		return nil
+	}
+	query := u.Query()
+	for _, name := range h.propagateQuery {
+		if name == "*" {
+			return query
+		}
+	}
+	selected := url.Values{}
+	for _, name := range h.propagateQuery {
+		if values, ok := query[name]; ok {
+			selected[name] = values
+		}
+	}
+	return selected
+}
+
+// withQuery adds the propagated parameters the URI does not carry already
+func withQuery(uri string, query url.Values) string {
+	if len(query) == 0 {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return uri
+	}
+	values := u.Query()
+	changed := false
+	for name, v := range query {
+		if _, ok := values[name]; !ok {
+			values[name] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return uri
+	}
+	u.RawQuery = values.Encode()
+	return u.String()
+}
+
+// applyQuery propagates the playlist URL query to the segments, keys, init segments
+// and partial segments of a media playlist
+func (h *hlsDownloader) applyQuery(mediaList *mediaPlaylist, segments []*segment) {
+	query := h.propagatedQuery()
+	if len(query) == 0 {
+		return
+	}
+	for _, segment := range segments {
+		segment.URI = withQuery(segment.URI, query)
+		if segment.Key != nil {
+			segment.Key.URI = withQuery(segment.Key.URI, query)
+		}
+		if segment.Map != nil {
+			segment.Map.URI = withQuery(segment.Map.URI, query)
+		}
+	}
+	if ll := mediaList.lowLatency; ll != nil {
+		for _, part := range ll.parts {
+			part.uri = withQuery(part.uri, query)
+		}
+		if ll.hint != nil {
+			ll.hint.uri = withQuery(ll.hint.uri, query)
+		}
+	}
+}
+
+// loadMediaPlaylist fetches a media playlist of the stream and propagates the playlist URL query to it
+func (h *hlsDownloader) loadMediaPlaylist(URL string, baseURL *url.URL) (*mediaPlaylist, []*segment, error) {
+	mediaList, segments, err := parseHLSSegments(h.ctx, URL, baseURL, h.header, h.fetcher, h.variables, h.strict, h.log())
+	if err != nil {
+		return nil, nil, err
+	}
+	h.applyQuery(mediaList, segments)
+	return mediaList, segments, nil
+}
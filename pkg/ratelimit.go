@@ -0,0 +1,158 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SetRateLimit caps the bandwidth of the whole download, shared by every worker, to
+// bytesPerSecond on average. Zero removes the limit.
+func (h *hlsDownloader) SetRateLimit(bytesPerSecond int64) error {
+	if h == nil {
+		return errors.New("attempt to set rate limit on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if bytesPerSecond < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	h.rateLimit = bytesPerSecond
+	return nil
+}
+
+// SetRequestDelay makes every worker wait a random delay between minDelay and maxDelay before each
+// segment request but its first, pacing the requests like a player does. Zero disables it.
+func (h *hlsDownloader) SetRequestDelay(minDelay time.Duration, maxDelay time.Duration) error {
+	if h == nil {
+		return errors.New("attempt to set request delay on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if minDelay < 0 || maxDelay < minDelay {
+		return errors.New("request delay must be a non negative range")
+	}
+	h.requestDelayMin = minDelay
+	h.requestDelayMax = maxDelay
+	return nil
+}
+
+// requestDelay returns a random delay between the request delay bounds
+func (h *hlsDownloader) requestDelay() time.Duration {
+	delay := h.requestDelayMin
+	if spread := h.requestDelayMax - h.requestDelayMin; spread > 0 {
+		delay += time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+	return delay
+}
+
+// ParseRate converts a textual rate in bytes per second into a number, with an optional
+// binary K, M or G suffix, e.g. "500K" or "2M"
+func ParseRate(s string) (int64, error) {
+	rate, err := ParseSize(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// ParseSize converts a textual size in bytes into a number, with an optional binary
+// K, M or G suffix, e.g. "512K" or "1G"
+func ParseSize(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := 1.0
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// rateLimiter is a token bucket shared by the workers, the transfers wait for the tokens
+// of the bytes they read
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// chunk bounds a single read, so that a wait never lasts much longer than a fraction of a second
+	chunk int
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	rate := float64(bytesPerSecond)
+	chunk := int(bytesPerSecond / 4)
+	if chunk < 512 {
+		chunk = 512
+	} else if chunk > 32*1024 {
+		chunk = 32 * 1024
+	}
+	return &rateLimiter{rate: rate, burst: rate, tokens: rate, last: time.Now(), chunk: chunk}
+}
+
+// wait takes the tokens of n bytes, blocking until the bucket holds them
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(time.Duration(deficit / l.rate * float64(time.Second))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader reads through the rate limiter
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.chunk {
+		p = p[:r.limiter.chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
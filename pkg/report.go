@@ -0,0 +1,171 @@
+package HLSDownloader
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+const gapTagName = "#EXT-X-GAP"
+
+// gapTag decodes EXT-X-GAP, which marks a segment that must not be loaded
+type gapTag struct{}
+
+// customDecoders decode the segment tags the m3u8 parser does not know about
+var customDecoders = []m3u8.CustomDecoder{gapTag{}, bitrateTag{}}
+
+func (gapTag) TagName() string { return gapTagName }
+
+func (gapTag) Decode(line string) (m3u8.CustomTag, error) { return gapTag{}, nil }
+
+func (gapTag) SegmentTag() bool { return true }
+
+func (gapTag) Encode() *bytes.Buffer { return bytes.NewBufferString(gapTagName) }
+
+func (gapTag) String() string { return gapTagName }
+
+// Reasons a segment is missing from the output
+const (
+	SkipGap     = "gap"
+	SkipMissing = "missing"
+	SkipFailed  = "failed"
+)
+
+// SkippedRange is a run of consecutive segments of a track left out of the output
+type SkippedRange struct {
+	Track  string
+	From   uint64
+	To     uint64
+	Reason string
+}
+
+// Report describes what the last download left out of the output, the ad breaks it detected,
+// the ranges of the tracks kept by SetClip and the outputs whose CEA-708 captions were not extracted
+type Report struct {
+	Skipped  []SkippedRange
+	AdBreaks []AdBreak
+	Clips    []ClippedRange
+	// CEA708 lists the outputs carrying CEA-708 (DTVCC) closed captions, which SetClosedCaptions
+	// does not decode
+	CEA708 []string
+}
+
+// statusError is returned when a server answers with an unexpected status code
+type statusError struct {
+	code   int
+	status string
+	// retryAfter is the wait the server asked for with a Retry-After header
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
+
+func newStatusError(res *http.Response) error {
+	return &statusError{
+		code:       res.StatusCode,
+		status:     res.Status,
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// isMissing reports whether the error means the resource does not exist on the server
+func isMissing(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusNotFound || se.code == http.StatusGone
+	}
+	return false
+}
+
+// SetTolerateMissing makes segments the server answers with 404 or 410 to be skipped
+// and recorded in the report instead of aborting the download
+func (h *hlsDownloader) SetTolerateMissing(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set tolerate missing on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.tolerateMissing = enabled
+	return nil
+}
+
+// SetGapFiller sets data written to the output in place of every skipped segment,
+// e.g. a pre-encoded black or silent segment. By default nothing is written.
+func (h *hlsDownloader) SetGapFiller(filler []byte) error {
+	if h == nil {
+		return errors.New("attempt to set gap filler on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.gapFiller = filler
+	return nil
+}
+
+func (h *hlsDownloader) recordSkipped(t *track, segment *segment) {
+	h.reportMu.Lock()
+	defer h.reportMu.Unlock()
+	h.log().debugf("Skipping segment %d (%s): %s\n", segment.SeqId, t.name, segment.skipReason)
+	h.skipped = append(h.skipped, SkippedRange{Track: t.name, From: segment.SeqId, To: segment.SeqId, Reason: segment.skipReason})
+}
+
+// Report returns what the last download left out of the output, consecutive
+// skipped segments of a track with the same reason are merged into one range
+func (h *hlsDownloader) Report() Report {
+	if h == nil {
+		return Report{}
+	}
+	h.reportMu.Lock()
+	skipped := append([]SkippedRange(nil), h.skipped...)
+	adBreaks := append([]AdBreak(nil), h.adBreaks...)
+	clips := append([]ClippedRange(nil), h.clips...)
+	cea708 := append([]string(nil), h.cea708...)
+	h.reportMu.Unlock()
+
+	sort.SliceStable(skipped, func(i, j int) bool {
+		if skipped[i].Track != skipped[j].Track {
+			return skipped[i].Track < skipped[j].Track
+		}
+		return skipped[i].From < skipped[j].From
+	})
+	report := Report{Clips: clips, CEA708: cea708}
+	for _, r := range skipped {
+		n := len(report.Skipped)
+		if n > 0 {
+			last := &report.Skipped[n-1]
+			if last.Track == r.Track && last.Reason == r.Reason && last.To+1 == r.From {
+				last.To = r.To
+				continue
+			}
+		}
+		report.Skipped = append(report.Skipped, r)
+	}
+
+	sort.SliceStable(adBreaks, func(i, j int) bool {
+		if adBreaks[i].Track != adBreaks[j].Track {
+			return adBreaks[i].Track < adBreaks[j].Track
+		}
+		return adBreaks[i].From < adBreaks[j].From
+	})
+	for _, b := range adBreaks {
+		n := len(report.AdBreaks)
+		if n > 0 {
+			last := &report.AdBreaks[n-1]
+			if last.Track == b.Track && last.ID == b.ID && last.To+1 == b.From {
+				last.To = b.To
+				continue
+			}
+		}
+		report.AdBreaks = append(report.AdBreaks, b)
+	}
+	return report
+}
@@ -0,0 +1,130 @@
+package HLSDownloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ReportFileVersion is the version of the report file format written by this package
+const ReportFileVersion = 1
+
+// ReportFile is the content of the JSON report written beside the output of a completed
+// download, see SetReportFile. It tells where every segment of the outputs came from.
+type ReportFile struct {
+	Version  int            `json:"version"`
+	URL      string         `json:"url"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Outputs  []string       `json:"outputs"`
+	Tracks   []*TrackReport `json:"tracks"`
+}
+
+// TrackReport describes the segments of a track, named like the tracks of the Report
+type TrackReport struct {
+	Name     string           `json:"name"`
+	URL      string           `json:"url"`
+	Segments []*SegmentReport `json:"segments"`
+}
+
+// SegmentReport describes a segment joined into the output or left out of it. Bytes and SHA256
+// are those of the segment as served, before decryption. Started, Elapsed and Attempts describe
+// its transfer, Attempts counting every request including the retried ones and the mirrors;
+// they are missing for the segments downloaded by a previous run of a resumed download.
+type SegmentReport struct {
+	SeqID      uint64        `json:"seq"`
+	URI        string        `json:"uri"`
+	Duration   float64       `json:"duration"`
+	Bytes      int64         `json:"bytes,omitempty"`
+	SHA256     string        `json:"sha256,omitempty"`
+	Started    *time.Time    `json:"started,omitempty"`
+	Elapsed    float64       `json:"elapsed,omitempty"`
+	Attempts   int           `json:"attempts,omitempty"`
+	Key        *KeyReference `json:"key,omitempty"`
+	SkipReason string        `json:"skipReason,omitempty"`
+}
+
+// SetReportFile writes a JSON report of every completed download into a <output>.report.json
+// sidecar file, e.g. to keep the provenance of the downloaded assets, see ReportFile
+func (h *hlsDownloader) SetReportFile(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set report file on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.reportFile = enabled
+	return nil
+}
+
+// reportSegment adds the segment to the report of the track, before its content is released
+func (h *hlsDownloader) reportSegment(t *track, segment *segment) error {
+	if !h.reportFile {
+		return nil
+	}
+	r := &SegmentReport{
+		SeqID:      segment.SeqId,
+		URI:        segment.URI,
+		Duration:   segment.Duration,
+		Key:        keyReference(segment),
+		SkipReason: segment.skipReason,
+		Attempts:   segment.attempts,
+	}
+	if !segment.fetchStart.IsZero() {
+		started := segment.fetchStart
+		r.Started = &started
+		r.Elapsed = segment.fetchTime.Seconds()
+	}
+	if segment.skipReason == "" {
+		file, err := openSegment(segment)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		r.Bytes, err = io.Copy(hash, file)
+		if err != nil {
+			return err
+		}
+		r.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	}
+	t.reportSegments = append(t.reportSegments, r)
+	return nil
+}
+
+// writeReportFile writes the report of the download, whose path is returned
+func (h *hlsDownloader) writeReportFile(tracks []*track) (string, error) {
+	report := ReportFile{
+		Version:  ReportFileVersion,
+		URL:      h.url,
+		Finished: time.Now(),
+		Outputs:  append([]string{}, h.outputs...),
+	}
+	if s := h.stats.Load(); s != nil {
+		report.Started = s.start
+	}
+	for _, t := range tracks {
+		segments := t.reportSegments
+		if segments == nil {
+			segments = []*SegmentReport{}
+		}
+		report.Tracks = append(report.Tracks, &TrackReport{Name: t.name, URL: t.url, Segments: segments})
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path, err := h.sidecarPath(h.output, ".report", ".json")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,63 @@
+package HLSDownloader
+
+import "time"
+
+// Result describes what a download wrote, see Download
+type Result struct {
+	// Output is the main output, Outputs every file written, see Outputs
+	Output  string
+	Outputs []string
+	// Segments is how many segments of every track were joined into the outputs, Bytes their size
+	// as served
+	Segments int
+	Bytes    int64
+	// Duration is the media duration of the segments of the main track joined into the output,
+	// from their EXTINF durations
+	Duration time.Duration
+	// Bitrate is the average bitrate of the outputs in bits per second, from Bytes and Duration
+	Bitrate float64
+	// Skipped is how many segments were left out of the outputs, Failed how many of them because
+	// they could not be downloaded, see Report
+	Skipped int
+	Failed  int
+	Elapsed time.Duration
+	// Variant is the variant selected in a master playlist, nil for a media playlist
+	Variant *Variant
+}
+
+// recordJoined counts a segment joined into the output of the track, before its content is released
+func (h *hlsDownloader) recordJoined(t *track, segment *segment) error {
+	size := segmentSize(segment)
+	t.joinedSegments++
+	t.joinedBytes += size
+	t.joinedDuration += segment.Duration
+	return h.reportSegment(t, segment)
+}
+
+// result describes the last download, whose main output is output
+func (h *hlsDownloader) result(output string) Result {
+	r := Result{Output: output, Variant: h.selectedVariant}
+	r.Outputs = append(r.Outputs, h.outputs...)
+	for i, t := range h.tracks {
+		r.Segments += t.joinedSegments
+		r.Bytes += t.joinedBytes
+		if i == 0 {
+			r.Duration = seconds(t.joinedDuration)
+		}
+	}
+	if r.Duration > 0 {
+		r.Bitrate = float64(r.Bytes) * 8 / r.Duration.Seconds()
+	}
+	h.reportMu.Lock()
+	for _, skipped := range h.skipped {
+		r.Skipped++
+		if skipped.Reason == SkipFailed {
+			r.Failed++
+		}
+	}
+	h.reportMu.Unlock()
+	if s := h.stats.Load(); s != nil {
+		r.Elapsed = s.snapshot(0).Elapsed
+	}
+	return r
+}
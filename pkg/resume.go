@@ -0,0 +1,124 @@
+package HLSDownloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// SetResume keeps the job state file and the downloaded segments when the download fails
+// or is aborted, so that downloading the same URL into the same output again only fetches
+// the missing segments. Live playlists are not resumed.
+func (h *hlsDownloader) SetResume(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set resume on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.resume = enabled
+	return nil
+}
+
+// resumable reports whether the running download keeps its segments for a later run
+func (h *hlsDownloader) resumable() bool {
+	return h.resumeEnabled() && h.state != nil
+}
+
+// defaultStatePath names the job state file after the URL and the output requested
+func (h *hlsDownloader) defaultStatePath() string {
+	output, err := filepath.Abs(h.requestedOutput)
+	if err != nil {
+		output = h.requestedOutput
+	}
+	sum := sha256.Sum256([]byte(h.url + "\x00" + output))
+	return filepath.Join(os.TempDir(), "hlsdownloader-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// openJobState starts the job state of the download, restoring the progress of the
+// previous run when resuming
+func (h *hlsDownloader) openJobState(tracks []*track) (*jobState, error) {
+	path := h.stateFile
+	if path == "" {
+		path = h.defaultStatePath()
+	}
+	var previous *JobState
+	if h.resumeEnabled() && h.live {
+		h.log().warnf("Live playlists can not be resumed, downloading from the start\n")
+	} else if h.resumeEnabled() {
+		var err error
+		previous, err = ReadJobState(path)
+		if err != nil && !os.IsNotExist(err) {
+			h.log().warnf("Ignoring job state: %s\n", err.Error())
+		}
+	}
+
+	s := newJobState(path, h.url)
+	s.keep = h.stateFile != ""
+	for _, t := range tracks {
+		for _, segment := range t.segments {
+			s.segment(t, segment)
+		}
+		if previous != nil {
+			h.resumeTrack(s, previous.Tracks[t.name], t)
+		}
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sameResource reports whether two URIs point to the same resource, their query
+// (e.g. an expiring token) may differ between runs
+func sameResource(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host && ua.Path == ub.Path
+}
+
+// resumeTrack restores the output and temp dir of the track from its previous state, along
+// with the segments that were completely downloaded and are still listed by the playlist
+func (h *hlsDownloader) resumeTrack(s *jobState, previous *TrackState, t *track) {
+	if previous == nil || !sameResource(previous.URL, t.url) {
+		return
+	}
+	if info, err := os.Stat(previous.TmpDir); err != nil || !info.IsDir() {
+		return
+	}
+	ts := s.track(t)
+	resumed := 0
+	for _, prev := range previous.Segments {
+		if prev.Status != SegmentDownloaded {
+			continue
+		}
+		ss := ts.find(prev.SeqID)
+		if ss == nil || !sameResource(prev.URI, ss.URI) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(previous.TmpDir, segmentFileName(prev.SeqID)))
+		if err != nil || info.Size() != prev.Bytes {
+			continue
+		}
+		ss.Status = SegmentDownloaded
+		ss.Bytes = prev.Bytes
+		resumed++
+	}
+	ts.Output = previous.Output
+	ts.TmpDir = previous.TmpDir
+	t.output = previous.Output
+	t.tmpDir = previous.TmpDir
+	h.log().infof("Resuming %s into %s: %d segments already downloaded\n", t.name, t.output, resumed)
+}
+
+func segmentFileName(seqID uint64) string {
+	return fmt.Sprintf("seg%d.ts", seqID)
+}
@@ -0,0 +1,135 @@
+package HLSDownloader
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxRetries is how many times a segment is retried after a transient error
+	maxRetries = 3
+	// maxRateLimitRetries is how many times a segment is retried while the server rate limits
+	maxRateLimitRetries = 10
+	baseRetryDelay      = time.Second
+	maxRetryDelay       = 30 * time.Second
+	// maxRetryAfter caps the wait a Retry-After header can ask for
+	maxRetryAfter = 5 * time.Minute
+)
+
+// errEmptySegment is returned when a segment is received without any content
+var errEmptySegment = errors.New("segment is empty")
+
+// isRetryable reports whether the error of a request is transient, e.g. a dropped or timed
+// out connection, a truncated body or a server that is momentarily failing or rate limiting
+func isRetryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		switch se.code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	// a body shorter than announced or empty, or a connection closed before the response
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || errors.Is(err, errStalled) || errors.Is(err, errSegmentTimeout) || errors.Is(err, errEmptySegment) || errors.Is(err, errCorruptSegment) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &recordHeaderErr) {
+		return true
+	}
+	// client, dial and TLS handshake timeouts
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection reset by peer") || strings.Contains(err.Error(), "tls: handshake failure")
+}
+
+// rateLimited reports whether the server asked to slow down (429 or 503), along with the
+// wait it asked for, zero when it did not say
+func rateLimited(err error) (time.Duration, bool) {
+	var se *statusError
+	if errors.As(err, &se) && (se.code == http.StatusTooManyRequests || se.code == http.StatusServiceUnavailable) {
+		return se.retryAfter, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	var wait time.Duration
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = date.Sub(now)
+	}
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+// retryDelay is the wait before the given attempt, growing exponentially with a random jitter
+// so that the workers failing together do not retry together
+func retryDelay(attempt int) time.Duration {
+	delay := maxRetryDelay
+	if attempt < 16 {
+		if d := baseRetryDelay << (attempt - 1); d < maxRetryDelay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// backoff holds every worker back while the server rate limits the download
+type backoff struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// delay holds the workers back for at least the given wait
+func (b *backoff) delay(wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(wait); until.After(b.until) {
+		b.until = until
+	}
+}
+
+// wait blocks until the workers are no longer held back, it returns false when the
+// download is aborted meanwhile
+func (b *backoff) wait(abort <-chan struct{}) bool {
+	b.mu.Lock()
+	wait := time.Until(b.until)
+	b.mu.Unlock()
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-abort:
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Signer signs the URL of a request right before it is sent, e.g. with a CloudFront canned
+// policy, an Akamai edge authorization token or an HMAC of the path in the query, so that every
+// request, retries included, carries a short-lived token. It is called concurrently by the workers.
+type Signer interface {
+	Sign(ctx context.Context, URL string) (string, error)
+}
+
+// SignerFunc adapts a function to a Signer
+type SignerFunc func(ctx context.Context, URL string) (string, error)
+
+func (f SignerFunc) Sign(ctx context.Context, URL string) (string, error) {
+	return f(ctx, URL)
+}
+
+// SetSigner signs the URL of every playlist, segment and key request with signer, once the
+// request hooks changed it. Nil removes it.
+func (h *hlsDownloader) SetSigner(signer Signer) error {
+	if h == nil {
+		return errors.New("attempt to set signer on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.signer = signer
+	return nil
+}
+
+// withSigner returns fetcher signing the URLs of the requests with the signer of the download
+func (h *hlsDownloader) withSigner(fetcher Fetcher) Fetcher {
+	if h.signer == nil {
+		return fetcher
+	}
+	return signerFetcher{fetcher: fetcher, signer: h.signer}
+}
+
+type signerFetcher struct {
+	fetcher Fetcher
+	signer  Signer
+}
+
+func (f signerFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return f.fetcher.Do(ctx, req)
+	}
+	signed, err := f.signer.Sign(ctx, req.URL.String())
+	if err != nil {
+		return nil, fmt.Errorf("signer: %w", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		return nil, fmt.Errorf("signer: invalid url: %w", err)
+	}
+	req.URL, req.Host = u, u.Host
+	return f.fetcher.Do(ctx, req)
+}
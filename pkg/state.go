@@ -0,0 +1,333 @@
+package HLSDownloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobStateVersion is the version of the job state file format written by this package.
+// It is increased whenever a change of the format would break the readers of older files.
+const JobStateVersion = 1
+
+// SegmentStatus is the progress of a segment in the job state file
+type SegmentStatus string
+
+const (
+	// SegmentPending segments are not downloaded yet
+	SegmentPending SegmentStatus = "pending"
+	// SegmentDownloaded segments are fully downloaded into the temp dir of their track
+	SegmentDownloaded SegmentStatus = "downloaded"
+	// SegmentSkipped segments are left out of the output, see SkipReason
+	SegmentSkipped SegmentStatus = "skipped"
+	// SegmentFailed segments could not be downloaded, see Error
+	SegmentFailed SegmentStatus = "failed"
+)
+
+// JobState is the content of the job state file, a JSON document written atomically while
+// a resumable download runs. It backs SetResume and lets other tools follow the progress.
+type JobState struct {
+	Version  int                    `json:"version"`
+	URL      string                 `json:"url"`
+	Started  time.Time              `json:"started"`
+	Updated  time.Time              `json:"updated"`
+	Complete bool                   `json:"complete"`
+	Tracks   map[string]*TrackState `json:"tracks"`
+}
+
+// TrackState is the progress of a track, named like the tracks of the Report
+type TrackState struct {
+	URL    string `json:"url"`
+	Output string `json:"output"`
+	TmpDir string `json:"tmpDir,omitempty"`
+	// Segments is the snapshot of the media playlist, sorted by sequence number
+	Segments []*SegmentState `json:"segments"`
+}
+
+// SegmentState is the progress of a segment
+type SegmentState struct {
+	SeqID      uint64        `json:"seq"`
+	URI        string        `json:"uri"`
+	Status     SegmentStatus `json:"status"`
+	Bytes      int64         `json:"bytes,omitempty"`
+	Key        *KeyReference `json:"key,omitempty"`
+	SkipReason string        `json:"skipReason,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// KeyReference points to the key material of an encrypted segment, the key itself is never
+// written. Keys embedded as data: URIs are only referenced as "data:".
+type KeyReference struct {
+	Method    string `json:"method"`
+	URI       string `json:"uri,omitempty"`
+	IV        string `json:"iv,omitempty"`
+	KeyFormat string `json:"keyFormat,omitempty"`
+}
+
+// ReadJobState reads a job state file, files written by another version of the format are rejected
+func ReadJobState(path string) (*JobState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state JobState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid job state %s: %w", path, err)
+	}
+	if state.Version != JobStateVersion {
+		return nil, fmt.Errorf("unsupported job state version %d in %s", state.Version, path)
+	}
+	if state.Tracks == nil {
+		state.Tracks = make(map[string]*TrackState)
+	}
+	return &state, nil
+}
+
+// SetStateFile sets where the job state file is written, by default it is written into the
+// temp directory only for resumable downloads and removed once they complete. A state file
+// set here is written for every download and kept, marked complete, at the end.
+func (h *hlsDownloader) SetStateFile(path string) error {
+	if h == nil {
+		return errors.New("attempt to set state file on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.stateFile = path
+	return nil
+}
+
+// StateFile returns the path of the job state file of the last download, if any
+func (h *hlsDownloader) StateFile() string {
+	if h == nil || h.state == nil {
+		return ""
+	}
+	return h.state.path
+}
+
+// the changes of the segments are saved in batches, every saveEvery changes or saveInterval,
+// a failed segment and the end of the download save the pending ones right away
+const (
+	saveEvery    = 16
+	saveInterval = 2 * time.Second
+)
+
+// jobState is the job state of a running download
+type jobState struct {
+	mu   sync.Mutex
+	path string
+	// keep leaves the file in place once the download completes
+	keep  bool
+	state *JobState
+	// pending counts the changes not saved yet, saved is when the file was last written
+	pending int
+	saved   time.Time
+}
+
+func newJobState(path string, URL string) *jobState {
+	now := time.Now()
+	return &jobState{path: path, state: &JobState{
+		Version: JobStateVersion,
+		URL:     URL,
+		Started: now,
+		Updated: now,
+		Tracks:  make(map[string]*TrackState),
+	}}
+}
+
+// save writes the job state atomically, a crash never leaves a truncated file
+func (s *jobState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write()
+}
+
+// flush saves the changes not saved yet, if any
+func (s *jobState) flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == 0 {
+		return nil
+	}
+	return s.write()
+}
+
+// write saves the job state into a temp file synced to the disk before it replaces the file,
+// so that neither a crash nor a power loss leaves a truncated file
+func (s *jobState) write() error {
+	s.state.Updated = time.Now()
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.pending, s.saved = 0, s.state.Updated
+	return nil
+}
+
+// finish marks the job complete, the file is removed unless it was requested explicitly
+func (s *jobState) finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.keep {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	s.state.Complete = true
+	return s.write()
+}
+
+func keyReference(segment *segment) *KeyReference {
+	if segment.Key == nil {
+		return nil
+	}
+	ref := &KeyReference{
+		Method:    segment.Key.Method,
+		URI:       segment.Key.URI,
+		IV:        segment.Key.IV,
+		KeyFormat: segment.Key.Keyformat,
+	}
+	if isDataURI(ref.URI) {
+		ref.URI = "data:"
+	}
+	return ref
+}
+
+// track returns the state of the track, adding it when missing
+func (s *jobState) track(t *track) *TrackState {
+	ts := s.state.Tracks[t.name]
+	if ts == nil {
+		ts = &TrackState{URL: t.url, Output: t.output}
+		s.state.Tracks[t.name] = ts
+	}
+	return ts
+}
+
+// search returns the index of the segment in the sorted snapshot, or where it belongs
+func (ts *TrackState) search(seqID uint64) int {
+	return sort.Search(len(ts.Segments), func(i int) bool {
+		return ts.Segments[i].SeqID >= seqID
+	})
+}
+
+// find returns the state of a segment of the snapshot, nil when it is not listed
+func (ts *TrackState) find(seqID uint64) *SegmentState {
+	if i := ts.search(seqID); i < len(ts.Segments) && ts.Segments[i].SeqID == seqID {
+		return ts.Segments[i]
+	}
+	return nil
+}
+
+// segment returns the state of the segment, adding it to the snapshot of the playlist when missing
+func (s *jobState) segment(t *track, segment *segment) *SegmentState {
+	ts := s.track(t)
+	i := ts.search(segment.SeqId)
+	if i < len(ts.Segments) && ts.Segments[i].SeqID == segment.SeqId {
+		return ts.Segments[i]
+	}
+	ss := &SegmentState{SeqID: segment.SeqId, URI: segment.URI, Status: SegmentPending, Key: keyReference(segment)}
+	ts.Segments = append(ts.Segments, nil)
+	copy(ts.Segments[i+1:], ts.Segments[i:])
+	ts.Segments[i] = ss
+	return ss
+}
+
+// update applies the change to the state of the segment, saving the job state once enough
+// changes are pending or now is true. Nothing is recorded when the download has no job state.
+func (s *jobState) update(t *track, segment *segment, now bool, change func(*SegmentState)) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.track(t).TmpDir = t.tmpDir
+	change(s.segment(t, segment))
+	s.pending++
+	if !now && s.pending < saveEvery && time.Since(s.saved) < saveInterval {
+		return nil
+	}
+	return s.write()
+}
+
+func (s *jobState) downloaded(t *track, segment *segment, bytes int64) error {
+	return s.update(t, segment, false, func(ss *SegmentState) {
+		ss.Status = SegmentDownloaded
+		ss.Bytes = bytes
+		ss.Error = ""
+	})
+}
+
+func (s *jobState) skipped(t *track, segment *segment) error {
+	return s.update(t, segment, false, func(ss *SegmentState) {
+		ss.Status = SegmentSkipped
+		ss.SkipReason = segment.skipReason
+	})
+}
+
+func (s *jobState) failed(t *track, segment *segment, err error) error {
+	return s.update(t, segment, true, func(ss *SegmentState) {
+		ss.Status = SegmentFailed
+		ss.Error = err.Error()
+	})
+}
+
+// downloadedBytes returns the size of the segment when it was downloaded, by this or a previous run
+func (s *jobState) downloadedBytes(t *track, segment *segment) (int64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.state.Tracks[t.name]
+	if ts == nil {
+		return 0, false
+	}
+	ss := ts.find(segment.SeqId)
+	if ss == nil || ss.Status != SegmentDownloaded {
+		return 0, false
+	}
+	return ss.Bytes, true
+}
+
+// recordState logs the job state files that can not be written, the download goes on without them
+func (h *hlsDownloader) recordState(err error) {
+	if err != nil {
+		h.log().errorf("Failed to save job state: %s\n", err.Error())
+	}
+}
+
+// recordDownloaded records a downloaded segment along with its size
+func (h *hlsDownloader) recordDownloaded(t *track, segment *segment) {
+	if h.state == nil {
+		return
+	}
+	h.recordState(h.state.downloaded(t, segment, segmentSize(segment)))
+}
@@ -0,0 +1,177 @@
+package HLSDownloader
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// speedWindow is how many seconds the current speed is averaged over
+const speedWindow = 5
+
+// Stats describes the progress of the running download, or of the last one once it ended
+type Stats struct {
+	// Segments is how many segments were downloaded or skipped, out of TotalSegments, which
+	// grows while a live playlist is recorded
+	Segments      int64
+	TotalSegments int64
+	// Bytes is how many bytes of segments were received, including the retried transfers
+	Bytes   int64
+	Elapsed time.Duration
+	// AverageSpeed is the bytes received per second since the start, Speed over the last seconds
+	// of a running download
+	AverageSpeed float64
+	Speed        float64
+	// Workers is the share of the elapsed time every worker spent downloading a segment
+	Workers []float64
+	// ETA is the estimated time remaining, zero when unknown, e.g. for live playlists
+	ETA time.Duration
+}
+
+// Stats returns the progress of the running download, it can be called from any goroutine
+func (h *hlsDownloader) Stats() Stats {
+	if h == nil {
+		return Stats{}
+	}
+	s := h.stats.Load()
+	if s == nil {
+		return Stats{}
+	}
+	return s.snapshot(atomic.LoadInt64(&h.totalSegments))
+}
+
+// statsCollector gathers the stats of a download, updated by the workers
+type statsCollector struct {
+	start time.Time
+	live  bool
+	bytes atomic.Int64
+	done  atomic.Int64
+
+	mu  sync.Mutex
+	end time.Time
+	// busy is the time every worker slot was held for a segment request, since when it is held
+	busy  []time.Duration
+	since []time.Time
+	// buckets hold the bytes received during each of the last seconds, second being the latest
+	buckets [speedWindow + 1]int64
+	second  int64
+}
+
+func newStatsCollector(workers int, live bool) *statsCollector {
+	now := time.Now()
+	return &statsCollector{start: now, live: live, busy: make([]time.Duration, workers), since: make([]time.Time, workers), second: now.Unix()}
+}
+
+// received counts n bytes of segments received
+func (s *statsCollector) received(n int) {
+	s.bytes.Add(int64(n))
+	s.mu.Lock()
+	now := time.Now().Unix()
+	s.advance(now)
+	s.buckets[now%int64(len(s.buckets))] += int64(n)
+	s.mu.Unlock()
+}
+
+// advance clears the buckets of the seconds elapsed since the latest one
+func (s *statsCollector) advance(now int64) {
+	for second := s.second + 1; second <= now && second-s.second <= int64(len(s.buckets)); second++ {
+		s.buckets[second%int64(len(s.buckets))] = 0
+	}
+	if now > s.second {
+		s.second = now
+	}
+}
+
+// acquired marks a worker slot busy until it is released
+func (s *statsCollector) acquired(slot int) {
+	s.mu.Lock()
+	s.since[slot] = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *statsCollector) released(slot int) {
+	s.mu.Lock()
+	s.busy[slot] += time.Since(s.since[slot])
+	s.since[slot] = time.Time{}
+	s.mu.Unlock()
+}
+
+func (s *statsCollector) finish() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *statsCollector) snapshot(total int64) Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if !s.end.IsZero() {
+		now = s.end
+	}
+	stats := Stats{
+		Segments:      s.done.Load(),
+		TotalSegments: total,
+		Bytes:         s.bytes.Load(),
+		Elapsed:       now.Sub(s.start),
+		Workers:       make([]float64, len(s.busy)),
+	}
+	if stats.Elapsed > 0 {
+		stats.AverageSpeed = float64(stats.Bytes) / stats.Elapsed.Seconds()
+		for i, busy := range s.busy {
+			if !s.since[i].IsZero() {
+				busy += now.Sub(s.since[i])
+			}
+			stats.Workers[i] = busy.Seconds() / stats.Elapsed.Seconds()
+		}
+	}
+
+	// the current second is not over, the speed is averaged over the ones before it
+	if s.end.IsZero() {
+		s.advance(now.Unix())
+		var window int64
+		for second := s.second - speedWindow; second < s.second; second++ {
+			window += s.buckets[second%int64(len(s.buckets))]
+		}
+		seconds := stats.Elapsed.Seconds()
+		if seconds > speedWindow {
+			seconds = speedWindow
+		}
+		if seconds >= 1 {
+			stats.Speed = float64(window) / seconds
+		} else {
+			stats.Speed = stats.AverageSpeed
+		}
+	}
+
+	remaining := stats.TotalSegments - stats.Segments
+	if !s.live && s.end.IsZero() && remaining > 0 && stats.Segments > 0 && stats.Speed > 0 {
+		perSegment := float64(stats.Bytes) / float64(stats.Segments)
+		stats.ETA = time.Duration(float64(remaining) * perSegment / stats.Speed * float64(time.Second))
+	}
+	return stats
+}
+
+// averageSegment returns the average bytes received per segment so far, zero before the first one
+func (s *statsCollector) averageSegment() int64 {
+	done := s.done.Load()
+	if done == 0 {
+		return 0
+	}
+	return s.bytes.Load() / done
+}
+
+// countingReader counts the bytes read in the stats
+type countingReader struct {
+	r     io.Reader
+	stats *statsCollector
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.stats.received(n)
+	}
+	return n, err
+}
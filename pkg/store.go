@@ -0,0 +1,210 @@
+package HLSDownloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SegmentStore keeps the downloaded segments of a track until they are joined into the output,
+// by sequence number, e.g. in memory, in an object storage or encrypted at rest. It is called
+// concurrently by the workers. The segments are stored in files of a temp dir by default, see
+// NewDiskStore.
+type SegmentStore interface {
+	// Put stores the content of the segment read from r as it is downloaded, replacing a previous
+	// one. When the transfer fails, r returns its error, which Put returns.
+	Put(seqID uint64, r io.Reader) error
+	// Get opens the content of a stored segment
+	Get(seqID uint64) (io.ReadCloser, error)
+	// Delete removes a stored segment once joined or when the download fails
+	Delete(seqID uint64) error
+}
+
+// SetSegmentStore stores the downloaded segments with the stores returned by newStore, called
+// once per track with its name (main, audio, ...) when its download starts. The store replaces the
+// memory buffer, resumable downloads always keep their segments on disk. Nil restores the temp dir.
+func (h *hlsDownloader) SetSegmentStore(newStore func(track string) (SegmentStore, error)) error {
+	if h == nil {
+		return errors.New("attempt to set segment store on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.segmentStore = newStore
+	return nil
+}
+
+// diskStore stores the segments in files of a directory
+type diskStore struct {
+	dir string
+}
+
+// NewDiskStore returns a SegmentStore keeping the segments in files of dir, named like the ones of
+// the temp dir, e.g. to wrap it into a store encrypting them
+func NewDiskStore(dir string) (SegmentStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return diskStore{dir: dir}, nil
+}
+
+func (s diskStore) Put(seqID uint64, r io.Reader) error {
+	file, err := os.Create(filepath.Join(s.dir, segmentFileName(seqID)))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s diskStore) Get(seqID uint64) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, segmentFileName(seqID)))
+}
+
+func (s diskStore) Delete(seqID uint64) error {
+	err := os.Remove(filepath.Join(s.dir, segmentFileName(seqID)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// memoryStore keeps the segments in memory while the memory buffer has room, the others spill
+// to the disk store of the temp dir, created the first time one does, see SetMemoryBuffer
+type memoryStore struct {
+	memory *memoryBuffer
+	// disk opens the store of the segments that spill
+	disk func() (SegmentStore, error)
+
+	mu      sync.Mutex
+	data    map[uint64][]byte
+	spilled SegmentStore
+}
+
+func (s *memoryStore) Put(seqID uint64, r io.Reader) error {
+	s.Delete(seqID)
+	var buf bytes.Buffer
+	chunk := getChunk()
+	defer putChunk(chunk)
+	for {
+		n, err := r.Read(*chunk)
+		if n > 0 {
+			if !s.memory.reserve(n) {
+				s.memory.release(buf.Len())
+				return s.spill(seqID, io.MultiReader(&buf, bytes.NewReader((*chunk)[:n]), r))
+			}
+			buf.Write((*chunk)[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.memory.release(buf.Len())
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[seqID] = buf.Bytes()
+	return nil
+}
+
+// spill puts the segment into the disk store
+func (s *memoryStore) spill(seqID uint64, r io.Reader) error {
+	s.mu.Lock()
+	if s.spilled == nil {
+		store, err := s.disk()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.spilled = store
+	}
+	store := s.spilled
+	s.mu.Unlock()
+	return store.Put(seqID, r)
+}
+
+func (s *memoryStore) Get(seqID uint64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	data, ok := s.data[seqID]
+	store := s.spilled
+	s.mu.Unlock()
+	if ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if store == nil {
+		return nil, fmt.Errorf("segment %d is not stored", seqID)
+	}
+	return store.Get(seqID)
+}
+
+func (s *memoryStore) Delete(seqID uint64) error {
+	s.mu.Lock()
+	data, ok := s.data[seqID]
+	delete(s.data, seqID)
+	store := s.spilled
+	s.mu.Unlock()
+	if ok {
+		s.memory.release(len(data))
+		return nil
+	}
+	if store == nil {
+		return nil
+	}
+	return store.Delete(seqID)
+}
+
+// openStore opens the segment store of the track: the store set with SetSegmentStore, the memory
+// buffer or else the disk store of the temp dir
+func (h *hlsDownloader) openStore(t *track) error {
+	if h.segmentStore != nil && !h.resumable() {
+		store, err := h.segmentStore(t.name)
+		if err != nil {
+			return err
+		}
+		if store == nil {
+			return errors.New("segment store is nil")
+		}
+		t.store = store
+		return nil
+	}
+	disk := func() (SegmentStore, error) {
+		dir, err := h.tmpDir(t)
+		if err != nil {
+			return nil, err
+		}
+		return NewDiskStore(dir)
+	}
+	// segments buffered in memory only need the temp dir once they spill to disk
+	if h.memory != nil {
+		t.store = &memoryStore{memory: h.memory, disk: disk, data: make(map[uint64][]byte)}
+		return nil
+	}
+	store, err := disk()
+	if err != nil {
+		return err
+	}
+	t.store = store
+	return nil
+}
+
+// dropStored deletes the segments left in the store of the track by a failed download
+func (h *hlsDownloader) dropStored(t *track) {
+	for _, segment := range t.segments {
+		if segment.store == nil {
+			continue
+		}
+		if err := h.releaseSegment(segment); err != nil {
+			h.log().warnf("Failed to delete segment %d of %s: %s\n", segment.SeqId, t.name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// DownloadTo downloads the main track like Download, writing the joined and decrypted stream
+// to w as it is downloaded instead of creating the output file, e.g. to pipe it into a player
+// or upload it. Alternate audio and subtitle renditions are left out.
+func (h *hlsDownloader) DownloadTo(w io.Writer) error {
+	return h.DownloadToContext(context.Background(), w)
+}
+
+// DownloadToContext downloads like DownloadTo, aborting as soon as ctx is done
+func (h *hlsDownloader) DownloadToContext(ctx context.Context, w io.Writer) error {
+	if h == nil {
+		return errors.New("instance is nil")
+	}
+	if w == nil {
+		return errors.New("writer is nil")
+	}
+	_, err := h.downloadContext(ctx, w)
+	return err
+}
+
+// checkStream rejects the options that need the output files when the download is streamed,
+// and keeps the main track only
+func (h *hlsDownloader) checkStream(tracks []*track) ([]*track, error) {
+	if h.stream == nil {
+		return tracks, nil
+	}
+	switch {
+	case h.archive:
+		return nil, errors.New("an archive can not be streamed")
+	case h.splitOnDiscontinuity:
+		return nil, errors.New("a stream can not be split on discontinuities")
+	case h.muxAudio:
+		return nil, errors.New("alternate audio can not be muxed into a stream")
+	case h.closedCaptions || h.timedMetadata || h.metadataHandler != nil:
+		return nil, errors.New("closed captions and timed metadata can not be extracted from a stream")
+	case h.reportFile:
+		return nil, errors.New("a report file can not be written beside a stream")
+	}
+	for _, t := range tracks[1:] {
+		h.log().warnf("Streaming the main track only, leaving out %s\n", t.name)
+	}
+	return tracks[:1], nil
+}
@@ -0,0 +1,328 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SubtitleFormat is the format of the subtitle sidecar file
+type SubtitleFormat int
+
+const (
+	// WebVTT writes the subtitles as a .vtt file (default)
+	WebVTT SubtitleFormat = iota
+	// SRT writes the subtitles as a .srt file
+	SRT
+)
+
+// ParseSubtitleFormat converts a textual format ("vtt", "srt") into a SubtitleFormat
+func ParseSubtitleFormat(s string) (SubtitleFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "vtt", "webvtt":
+		return WebVTT, nil
+	case "srt":
+		return SRT, nil
+	}
+	return 0, fmt.Errorf("unknown subtitle format %q", s)
+}
+
+func (f SubtitleFormat) extension() string {
+	if f == SRT {
+		return ".srt"
+	}
+	return ".vtt"
+}
+
+const mpegtsClock = 90000
+
+type vttCue struct {
+	start    time.Duration
+	end      time.Duration
+	settings string
+	text     string
+}
+
+type vttSegment struct {
+	header []string
+	cues   []vttCue
+	mpegts int64
+	local  time.Duration
+	hasMap bool
+}
+
+// parseVTTTimestamp parses "hh:mm:ss.ttt" or "mm:ss.ttt"
+func parseVTTTimestamp(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var hours int64
+	if len(parts) == 3 {
+		h, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		hours = h
+		parts = parts[1:]
+	}
+	minutes, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	seconds, err := strconv.ParseFloat(strings.Replace(parts[1], ",", ".", 1), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	return d + time.Duration(seconds*float64(time.Second)+0.5), nil
+}
+
+func formatCueTimestamp(d time.Duration, separator string) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+// parseTimestampMap parses the X-TIMESTAMP-MAP header, e.g. "X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000"
+func parseTimestampMap(line string, seg *vttSegment) {
+	value := strings.TrimPrefix(line, "X-TIMESTAMP-MAP=")
+	for _, attr := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(attr, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "MPEGTS":
+			if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				seg.mpegts = n
+				seg.hasMap = true
+			}
+		case "LOCAL":
+			if d, err := parseVTTTimestamp(v); err == nil {
+				seg.local = d
+			}
+		}
+	}
+}
+
+func parseVTT(data []byte) (*vttSegment, error) {
+	seg := &vttSegment{}
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var block []string
+	first := true
+	flush := func() error {
+		defer func() { block = nil }()
+		if len(block) == 0 {
+			return nil
+		}
+		if first {
+			first = false
+			if !strings.HasPrefix(block[0], "WEBVTT") {
+				return errors.New("subtitle segment is not WebVTT")
+			}
+			for _, line := range block[1:] {
+				if strings.HasPrefix(line, "X-TIMESTAMP-MAP=") {
+					parseTimestampMap(line, seg)
+				}
+			}
+			return nil
+		}
+		if strings.HasPrefix(block[0], "NOTE") {
+			return nil
+		}
+		if strings.HasPrefix(block[0], "STYLE") || strings.HasPrefix(block[0], "REGION") {
+			seg.header = append(seg.header, strings.Join(block, "\n"))
+			return nil
+		}
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			timing = 1
+		}
+		if timing >= len(block) || !strings.Contains(block[timing], "-->") {
+			return nil
+		}
+		startText, rest, _ := strings.Cut(block[timing], "-->")
+		rest = strings.TrimSpace(rest)
+		endText, settings, _ := strings.Cut(rest, " ")
+		start, err := parseVTTTimestamp(startText)
+		if err != nil {
+			return err
+		}
+		end, err := parseVTTTimestamp(endText)
+		if err != nil {
+			return err
+		}
+		seg.cues = append(seg.cues, vttCue{
+			start:    start,
+			end:      end,
+			settings: strings.TrimSpace(settings),
+			text:     strings.Join(block[timing+1:], "\n"),
+		})
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// mergeVTT concatenates the cues of every segment, moving them onto a common
+// timeline based on each segment X-TIMESTAMP-MAP relative to the first one
+func mergeVTT(segments []*vttSegment) ([]string, []vttCue) {
+	var header []string
+	var cues []vttCue
+	seen := make(map[string]bool)
+	var base int64
+	baseSet := false
+	for i, seg := range segments {
+		if i == 0 {
+			header = seg.header
+		}
+		var offset time.Duration
+		if seg.hasMap {
+			if !baseSet {
+				base = seg.mpegts
+				baseSet = true
+			}
+			offset = time.Duration(seg.mpegts-base)*time.Second/mpegtsClock - seg.local
+		}
+		for _, cue := range seg.cues {
+			cue.start += offset
+			cue.end += offset
+			key := fmt.Sprintf("%d|%d|%s", cue.start, cue.end, cue.text)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			cues = append(cues, cue)
+		}
+	}
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].start < cues[j].start
+	})
+	return header, cues
+}
+
+func writeVTT(w *bufio.Writer, header []string, cues []vttCue) {
+	w.WriteString("WEBVTT\n\n")
+	for _, block := range header {
+		w.WriteString(block + "\n\n")
+	}
+	for _, cue := range cues {
+		w.WriteString(formatCueTimestamp(cue.start, ".") + " --> " + formatCueTimestamp(cue.end, "."))
+		if cue.settings != "" {
+			w.WriteString(" " + cue.settings)
+		}
+		w.WriteString("\n" + cue.text + "\n\n")
+	}
+}
+
+func writeSRT(w *bufio.Writer, cues []vttCue) {
+	for i, cue := range cues {
+		fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", i+1, formatCueTimestamp(cue.start, ","), formatCueTimestamp(cue.end, ","), cue.text)
+	}
+}
+
+// writeSubtitles writes the joined cues to a .part file renamed to the output once complete,
+// so that a failed or aborted download does not leave a truncated subtitle file
+func (h *hlsDownloader) writeSubtitles(output string, header []string, cues []vttCue) (err error) {
+	file, err := os.Create(output + partSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	w := bufio.NewWriter(file)
+	if h.subtitleFormat == SRT {
+		writeSRT(w, cues)
+	} else {
+		writeVTT(w, header, cues)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), output)
+}
+
+func (h *hlsDownloader) joinSubtitles(t *track, segments []*segment) (string, error) {
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].SeqId < segments[j].SeqId
+	})
+
+	var parsed []*vttSegment
+	for _, segment := range segments {
+		h.recordAdBreak(t, segment)
+		if segment.skipReason != "" {
+			h.recordSkipped(t, segment)
+			if err := h.reportSegment(t, segment); err != nil {
+				return "", err
+			}
+			continue
+		}
+		data, err := readSegment(segment)
+		if err != nil {
+			return "", err
+		}
+		vtt, err := parseVTT(data)
+		if err != nil {
+			return "", fmt.Errorf("segment %d: %w", segment.SeqId, err)
+		}
+		parsed = append(parsed, vtt)
+		if err := h.recordJoined(t, segment); err != nil {
+			return "", err
+		}
+		if err := h.keepSegment(t, segment); err != nil {
+			return "", err
+		}
+		if err := h.releaseSegment(segment); err != nil {
+			return "", err
+		}
+	}
+	header, cues := mergeVTT(parsed)
+
+	// the overwrite policy is checked again, a file may have appeared since the track was set up
+	output, err := availablePath(t.output, h.overwritePolicy, h.log())
+	if err != nil {
+		return "", err
+	}
+	t.output = output
+	if err := h.writeSubtitles(t.output, header, cues); err != nil {
+		return "", err
+	}
+	t.outputs = append(t.outputs, t.output)
+	h.log().infof("Joined %d subtitle cues into %s", len(cues), t.output)
+	return t.output, nil
+}
@@ -0,0 +1,114 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// errStalled is returned when a segment transfer makes no progress for the stall timeout
+	errStalled = errors.New("segment transfer stalled")
+	// errSegmentTimeout is returned when a segment is not downloaded within the segment timeout
+	errSegmentTimeout = errors.New("segment download timed out")
+)
+
+// Timeouts bounds the requests of a download, a zero value disables the timeout
+type Timeouts struct {
+	// Connect bounds establishing a connection
+	Connect time.Duration
+	// ResponseHeader bounds waiting for the response headers once the request is sent
+	ResponseHeader time.Duration
+	// Segment bounds the whole download of a segment
+	Segment time.Duration
+	// Stall aborts a segment transfer receiving no data for that long, the segment is retried
+	Stall time.Duration
+}
+
+// SetTimeouts sets the timeouts of the requests. Connect and ResponseHeader apply to a copy of
+// the transport of the client, they are ignored when the client has a custom RoundTripper.
+func (h *hlsDownloader) SetTimeouts(timeouts Timeouts) error {
+	if h == nil {
+		return errors.New("attempt to set timeouts on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if timeouts.Connect < 0 || timeouts.ResponseHeader < 0 || timeouts.Segment < 0 || timeouts.Stall < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	h.timeouts = timeouts
+	h.resetTransport()
+	return nil
+}
+
+// applyTimeouts sets the TLS handshake and response header timeouts on the transport, the
+// connect timeout is set on its dialer along with the keep-alive, see applyTransportOptions
+func (h *hlsDownloader) applyTimeouts(transport *http.Transport) {
+	if h.timeouts.Connect > 0 {
+		transport.TLSHandshakeTimeout = h.timeouts.Connect
+	}
+	if h.timeouts.ResponseHeader > 0 {
+		transport.ResponseHeaderTimeout = h.timeouts.ResponseHeader
+	}
+}
+
+// segmentContext returns the context of a segment download, bounded by the segment timeout
+// and cancelled with errStalled by the stall detector
+func (h *hlsDownloader) segmentContext() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(h.ctx)
+	if h.timeouts.Segment > 0 {
+		timer := time.AfterFunc(h.timeouts.Segment, func() {
+			cancel(errSegmentTimeout)
+		})
+		return ctx, func(cause error) {
+			timer.Stop()
+			cancel(cause)
+		}
+	}
+	return ctx, cancel
+}
+
+// stallReader cancels the transfer when no data is read for the stall timeout
+type stallReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelCauseFunc) *stallReader {
+	return &stallReader{
+		r:       r,
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			cancel(errStalled)
+		}),
+	}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+func (s *stallReader) stop() {
+	s.timer.Stop()
+}
+
+// segmentError replaces the error of a segment download cancelled by its own timeouts with
+// their cause, which is retried unlike the cancellation of the whole download
+func segmentError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, errStalled) || errors.Is(cause, errSegmentTimeout) {
+		return cause
+	}
+	return err
+}
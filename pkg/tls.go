@@ -0,0 +1,115 @@
+package HLSDownloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TLSOptions configures the TLS connections of the client, e.g. for a corporate CDN or a lab
+// server. A zero value keeps the configuration of its transport.
+type TLSOptions struct {
+	// Config is the configuration the other options complete, a copy is used
+	Config *tls.Config
+	// InsecureSkipVerify accepts any certificate and host name, for testing only
+	InsecureSkipVerify bool
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the system ones
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and its key, sent to the servers
+	// requiring mutual TLS
+	CertFile string
+	KeyFile  string
+	// MinVersion is the lowest TLS version accepted, e.g. tls.VersionTLS12, see ParseTLSVersion
+	MinVersion uint16
+}
+
+// SetTLSOptions configures the TLS connections of the client, the files are read right away.
+// Like the timeouts, the options apply to a copy of the transport of the client, not to a custom
+// RoundTripper nor to the HTTP/3 transport, and a Manager refuses the download.
+func (h *hlsDownloader) SetTLSOptions(options TLSOptions) error {
+	if h == nil {
+		return errors.New("attempt to set tls options on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	config, err := options.config()
+	if err != nil {
+		return err
+	}
+	h.tlsConfig = config
+	h.resetTransport()
+	return nil
+}
+
+// config returns the TLS configuration of the options, nil for a zero value
+func (options TLSOptions) config() (*tls.Config, error) {
+	if options == (TLSOptions{}) {
+		return nil, nil
+	}
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	config := &tls.Config{}
+	if options.Config != nil {
+		config = options.Config.Clone()
+	}
+	if options.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	if options.CAFile != "" {
+		data, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		pool := config.RootCAs
+		if pool == nil {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", options.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if options.MinVersion != 0 {
+		config.MinVersion = options.MinVersion
+	}
+	return config, nil
+}
+
+// applyTLS sets the TLS configuration of the download on the transport
+func (h *hlsDownloader) applyTLS(transport *http.Transport) {
+	if h.tlsConfig != nil {
+		transport.TLSClientConfig = h.tlsConfig.Clone()
+	}
+}
+
+// ParseTLSVersion converts a textual TLS version ("1.0", "1.1", "1.2", "1.3") into its
+// tls.VersionTLS constant
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q", s)
+}
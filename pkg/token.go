@@ -0,0 +1,92 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// TokenSource returns the bearer token of the requests, e.g. an OAuth access token. It is called
+// for the first request and again whenever a request is answered with 401 Unauthorized, so that
+// it returns a fresh token once the previous one expired.
+type TokenSource func(ctx context.Context) (string, error)
+
+// SetTokenSource authenticates every request with the bearer token of source, sending the
+// requests answered with 401 Unauthorized again with a new token, so that long downloads survive
+// the expiry of their token. An Authorization header of SetHeader or of a request hook takes
+// precedence, the token takes precedence over SetBasicAuth and SetDigestAuth. Nil removes it.
+func (h *hlsDownloader) SetTokenSource(source TokenSource) error {
+	if h == nil {
+		return errors.New("attempt to set token source on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.tokenSource = source
+	return nil
+}
+
+// withToken returns fetcher authenticating the requests with the token of the download
+func (h *hlsDownloader) withToken(fetcher Fetcher) Fetcher {
+	if h.tokenSource == nil {
+		return fetcher
+	}
+	return &tokenFetcher{fetcher: fetcher, source: h.tokenSource}
+}
+
+type tokenFetcher struct {
+	fetcher Fetcher
+	source  TokenSource
+
+	// mu guards the current token, which the workers share
+	mu    sync.Mutex
+	token string
+}
+
+func (f *tokenFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return f.fetcher.Do(ctx, req)
+	}
+	token, err := f.current(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	cloneRequestHeader(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := f.fetcher.Do(ctx, req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	token, err = f.current(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return f.fetcher.Do(ctx, req)
+}
+
+// current returns the token, asking the source for a new one when there is none yet or when it
+// is still the expired one. The workers rejected with the same token share the new one.
+func (f *tokenFetcher) current(ctx context.Context, expired string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.token != "" && f.token != expired {
+		return f.token, nil
+	}
+	token, err := f.source(ctx)
+	if err != nil {
+		return "", fmt.Errorf("token source: %w", err)
+	}
+	if token == "" {
+		return "", errors.New("token source returned an empty token")
+	}
+	f.token = token
+	return token, nil
+}
@@ -0,0 +1,299 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+// track is a single media playlist downloaded into its own output file
+type track struct {
+	name      string
+	subtitles bool
+	url       string
+	output    string
+	tmpDir    string
+	segments  []*segment
+	// tmpDirMu guards the creation of the temp dir by the workers spilling buffered segments
+	tmpDirMu sync.Mutex
+	// store keeps the downloaded segments until they are joined, see openStore
+	store SegmentStore
+
+	playlist *mediaPlaylist
+	// bandwidth is the BANDWIDTH of the variant of the track, zero when unknown
+	bandwidth uint32
+	file      *os.File
+	// out receives the joined segments, the output file or the stream of DownloadTo
+	out     io.Writer
+	outputs []string
+	written int
+	initMap *m3u8.Map
+	cenc    *cencDecrypter
+	archive *archive
+	lastSeq uint64
+	started bool
+	waiting bool
+	// failures counts the segments skipped in a row because they could not be downloaded
+	failures int
+	// joinedSegments, joinedBytes and joinedDuration describe the segments joined into the
+	// outputs, see Result
+	joinedSegments int
+	joinedBytes    int64
+	joinedDuration float64
+	// reportSegments describe the segments of the track in the report file, see SetReportFile
+	reportSegments []*SegmentReport
+
+	discontinuity bool
+	windowDone    bool
+
+	partsActive bool
+	partMSN     uint64
+	partsDone   int
+	hinted      *hintedPart
+}
+
+// masterAlternatives collects every EXT-X-MEDIA entry of the master playlist,
+// the parser only attaches them to the variant that follows them.
+func masterAlternatives(master *m3u8.MasterPlaylist) []*m3u8.Alternative {
+	var alternatives []*m3u8.Alternative
+	for _, v := range master.Variants {
+		if v == nil {
+			continue
+		}
+		alternatives = append(alternatives, v.Alternatives...)
+	}
+	return alternatives
+}
+
+// selectAlternative picks the rendition of the given type and group, preferring
+// the requested language, then the DEFAULT one, then the first listed.
+func selectAlternative(alternatives []*m3u8.Alternative, mediaType string, group string, language string) *m3u8.Alternative {
+	var selected *m3u8.Alternative
+	for _, alt := range alternatives {
+		if alt == nil || alt.Type != mediaType || alt.GroupId != group {
+			continue
+		}
+		if language != "" && strings.EqualFold(alt.Language, language) {
+			return alt
+		}
+		if selected == nil || (alt.Default && !selected.Default) {
+			selected = alt
+		}
+	}
+	return selected
+}
+
+// sidecarPath returns the output path with the suffix added before the extension, applying
+// the overwrite policy if that file already exists
+func (h *hlsDownloader) sidecarPath(output string, suffix string, extension string) (string, error) {
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+	return availablePath(base+suffix+extension, h.overwritePolicy, h.log())
+}
+
+// variantTrack loads the media playlist of a variant of the master playlist
+func (h *hlsDownloader) variantTrack(name string, variant *m3u8.Variant, baseURL *url.URL, output string) (*track, error) {
+	variantURI, err := baseURL.Parse(variant.URI)
+	if err != nil {
+		return nil, err
+	}
+	variantURL := withQuery(variantURI.String(), h.propagatedQuery())
+	h.log().infof("Selected variant %s (bandwidth %d, resolution %s)\n", variantURL, variant.Bandwidth, variant.Resolution)
+	mediaList, segments, err := h.loadMediaPlaylist(variantURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &track{name: name, url: variantURL, output: output, segments: segments, playlist: mediaList, bandwidth: variant.Bandwidth}, nil
+}
+
+// variantLabel names a variant by its height and bandwidth, e.g. "1080p_5000k"
+func variantLabel(variant *m3u8.Variant) string {
+	label := fmt.Sprintf("%dk", variant.Bandwidth/1000)
+	if v := newVariant(variant); v.Height > 0 {
+		label = fmt.Sprintf("%dp_%s", v.Height, label)
+	}
+	return label
+}
+
+// allVariantTracks returns a track for every variant the variant filter accepts,
+// each written into its own <output>_<label> file
+func (h *hlsDownloader) allVariantTracks(variants []*m3u8.Variant, baseURL *url.URL) ([]*track, error) {
+	var tracks []*track
+	labels := make(map[string]int)
+	for _, v := range variants {
+		if v == nil || v.Iframe || (h.variantFilter != nil && !h.variantFilter(newVariant(v))) {
+			continue
+		}
+		label := variantLabel(v)
+		labels[label]++
+		if labels[label] > 1 {
+			label = fmt.Sprintf("%s_%d", label, labels[label])
+		}
+		output, err := h.sidecarPath(h.output, "_"+label, h.extension)
+		if err != nil {
+			return nil, err
+		}
+		t, err := h.variantTrack(label, v, baseURL, output)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("no variant of the master playlist matches the variant filter")
+	}
+	return tracks, nil
+}
+
+func (h *hlsDownloader) resolveTracks() ([]*track, error) {
+	p, t, data, baseURL, err := h.loadPlaylist()
+	if err != nil {
+		return nil, err
+	}
+	return h.playlistTracks(p, t, data, baseURL)
+}
+
+// loadPlaylist fetches and decodes the playlist of the download, it also returns the URL its
+// relative URIs are resolved against
+func (h *hlsDownloader) loadPlaylist() (m3u8.Playlist, m3u8.ListType, []byte, *url.URL, error) {
+	var p m3u8.Playlist
+	var t m3u8.ListType
+	var baseURL *url.URL
+	var err error
+	data := h.playlistData
+	if data != nil {
+		baseURL, err = url.Parse(h.url)
+		if err != nil {
+			return nil, 0, nil, nil, errors.New("invalid url")
+		}
+		data, err = resolveVariables(data, h.url, nil)
+		if err == nil {
+			p, t, err = decodePlaylist(h.url, data, h.strict, h.log())
+		}
+	} else {
+		p, t, data, baseURL, err = getM3u8ListType(h.ctx, h.url, h.header, h.fetcher, nil, h.strict, h.log())
+	}
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	if h.baseURL != nil {
+		baseURL = h.baseURL
+	}
+	return p, t, data, baseURL, nil
+}
+
+// playlistTracks returns the tracks of the decoded playlist: the media playlist itself, or the
+// variants and renditions selected in a master playlist
+func (h *hlsDownloader) playlistTracks(p m3u8.Playlist, t m3u8.ListType, data []byte, baseURL *url.URL) ([]*track, error) {
+	var err error
+	if t == m3u8.MEDIA {
+		mediaList, segments, err := decodeMediaPlaylist(baseURL, p.(*m3u8.MediaPlaylist), data)
+		if err != nil {
+			return nil, err
+		}
+		h.applyQuery(mediaList, segments)
+		return []*track{{name: "main", url: h.url, output: h.output, segments: segments, playlist: mediaList}}, nil
+	}
+	if t != m3u8.MASTER {
+		return nil, ErrNotMediaPlaylist
+	}
+
+	master := p.(*m3u8.MasterPlaylist)
+	// media playlists can IMPORT the variables of the master playlist
+	h.variables, err = defineVariables(data, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// probing fetches no key
+	if h.keys != nil {
+		h.prefetchSessionKeys(baseURL, data)
+	}
+	variant, err := selectVariant(master.Variants, h.variantPolicy, h.iframes, h.variantFilter)
+	if err != nil {
+		return nil, err
+	}
+	selected := newVariant(variant)
+	h.selectedVariant = &selected
+	var tracks []*track
+	if h.allVariants && !h.iframes {
+		tracks, err = h.allVariantTracks(master.Variants, baseURL)
+	} else {
+		var main *track
+		main, err = h.variantTrack("main", variant, baseURL, h.output)
+		tracks = []*track{main}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if h.iframes {
+		// trick play playlists carry no audio nor subtitles
+		return tracks, nil
+	}
+
+	if h.alternateAudio && variant.Audio != "" {
+		audio := selectAlternative(masterAlternatives(master), "AUDIO", variant.Audio, h.audioLanguage)
+		if audio != nil && audio.URI != "" {
+			audioURI, err := baseURL.Parse(audio.URI)
+			if err != nil {
+				return nil, err
+			}
+			audioURL := withQuery(audioURI.String(), h.propagatedQuery())
+			h.log().infof("Selected audio rendition %s (group %s, language %s)\n", audioURL, audio.GroupId, audio.Language)
+			mediaList, segments, err := h.loadMediaPlaylist(audioURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			output, err := h.sidecarPath(h.output, "_audio", h.extension)
+			if err != nil {
+				return nil, err
+			}
+			tracks = append(tracks, &track{
+				name:     "audio",
+				url:      audioURL,
+				output:   output,
+				segments: segments,
+				playlist: mediaList,
+			})
+		}
+	}
+
+	if h.subtitles && variant.Subtitles != "" {
+		subtitles := selectAlternative(masterAlternatives(master), "SUBTITLES", variant.Subtitles, h.subtitleLanguage)
+		if subtitles != nil && subtitles.URI != "" {
+			subtitlesURI, err := baseURL.Parse(subtitles.URI)
+			if err != nil {
+				return nil, err
+			}
+			subtitlesURL := withQuery(subtitlesURI.String(), h.propagatedQuery())
+			h.log().infof("Selected subtitles rendition %s (group %s, language %s)\n", subtitlesURL, subtitles.GroupId, subtitles.Language)
+			mediaList, segments, err := h.loadMediaPlaylist(subtitlesURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			suffix := "_subtitles"
+			if subtitles.Language != "" {
+				suffix = "." + subtitles.Language
+			}
+			output, err := h.sidecarPath(h.output, suffix, h.subtitleFormat.extension())
+			if err != nil {
+				return nil, err
+			}
+			tracks = append(tracks, &track{
+				name:      "subtitles",
+				subtitles: true,
+				url:       subtitlesURL,
+				output:    output,
+				segments:  segments,
+				playlist:  mediaList,
+			})
+		}
+	}
+	return tracks, nil
+}
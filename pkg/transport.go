@@ -0,0 +1,143 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultKeepAlive is the TCP keep-alive period of http.DefaultTransport
+const defaultKeepAlive = 30 * time.Second
+
+// TransportOptions tunes the connections of the client, a zero value keeps the setting
+// of its transport
+type TransportOptions struct {
+	// MaxIdleConnsPerHost is how many idle connections are kept per host, at least the
+	// number of workers when unset so that every worker reuses its connection
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps the connections per host, dialing, active and idle ones
+	MaxConnsPerHost int
+	// ForceAttemptHTTP2 attempts HTTP/2 even with a custom dialer or TLS configuration
+	ForceAttemptHTTP2 bool
+	// KeepAlive is the period of the TCP keep-alive probes of the connections
+	KeepAlive time.Duration
+	// IdleConnTimeout closes the connections idle for that long
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives uses a new connection for every request
+	DisableKeepAlives bool
+}
+
+// SetTransportOptions tunes the connections of the client. Like the connect and response header
+// timeouts, the options apply to a copy of its transport and are ignored when the client has a
+// custom RoundTripper.
+func (h *hlsDownloader) SetTransportOptions(options TransportOptions) error {
+	if h == nil {
+		return errors.New("attempt to set transport options on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if options.MaxIdleConnsPerHost < 0 || options.MaxConnsPerHost < 0 || options.KeepAlive < 0 || options.IdleConnTimeout < 0 {
+		return errors.New("transport options must not be negative")
+	}
+	h.transportOptions = options
+	h.resetTransport()
+	return nil
+}
+
+// configureClient returns a copy of the client whose transport has the timeouts and the transport
+// options, with at least one idle connection per worker, the client itself when it has a custom
+// RoundTripper. The configured transport is kept for the next downloads, so that they reuse its
+// connections.
+func (h *hlsDownloader) configureClient(client *http.Client) *http.Client {
+	roundTripper := client.Transport
+	if roundTripper == nil {
+		roundTripper = http.DefaultTransport
+	}
+	transport, ok := roundTripper.(*http.Transport)
+	if !ok {
+		if settings := h.transportSettings(); len(settings) > 0 {
+			h.log().warnf("Client has a custom transport, not applying: %s\n", strings.Join(settings, ", "))
+		}
+		return client
+	}
+	if h.transport == nil || h.transportBase != transport {
+		h.resetTransport()
+		h.transportBase = transport
+		h.transport = transport.Clone()
+		h.applyTimeouts(h.transport)
+		h.applyTransportOptions(h.transport)
+		h.applyProxy(h.transport)
+		h.applyTLS(h.transport)
+	}
+	c := *client
+	c.Transport = h.transport
+	return &c
+}
+
+// transportSettings names the settings applied to the transport of the client which are set
+func (h *hlsDownloader) transportSettings() []string {
+	var settings []string
+	if h.timeouts.Connect > 0 || h.timeouts.ResponseHeader > 0 {
+		settings = append(settings, "timeouts")
+	}
+	if h.transportOptions != (TransportOptions{}) {
+		settings = append(settings, "transport options")
+	}
+	if h.dns.enabled() {
+		settings = append(settings, "dns options")
+	}
+	if h.proxy != nil {
+		settings = append(settings, "proxy")
+	}
+	if h.tlsConfig != nil {
+		settings = append(settings, "tls options")
+	}
+	return settings
+}
+
+// resetTransport drops the configured transport once a setting it is built from changes, closing
+// its idle connections
+func (h *hlsDownloader) resetTransport() {
+	if h.transport != nil {
+		h.transport.CloseIdleConnections()
+	}
+	h.transport, h.transportBase = nil, nil
+}
+
+func (h *hlsDownloader) applyTransportOptions(transport *http.Transport) {
+	options := h.transportOptions
+	idle := options.MaxIdleConnsPerHost
+	if idle == 0 && transport.MaxIdleConnsPerHost < h.workers {
+		idle = h.workers
+	}
+	if idle > 0 {
+		transport.MaxIdleConnsPerHost = idle
+		if transport.MaxIdleConns != 0 && transport.MaxIdleConns < idle {
+			transport.MaxIdleConns = idle
+		}
+	}
+	if options.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = options.MaxConnsPerHost
+	}
+	if options.ForceAttemptHTTP2 {
+		transport.ForceAttemptHTTP2 = true
+	}
+	if options.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+	if options.DisableKeepAlives {
+		transport.DisableKeepAlives = true
+	}
+	if h.timeouts.Connect > 0 || options.KeepAlive > 0 || h.dns.enabled() {
+		keepAlive := options.KeepAlive
+		if keepAlive == 0 {
+			keepAlive = defaultKeepAlive
+		}
+		dialer := &net.Dialer{Timeout: h.timeouts.Connect, KeepAlive: keepAlive}
+		transport.DialContext = h.dialContext(dialer)
+	}
+}
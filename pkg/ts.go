@@ -0,0 +1,217 @@
+package HLSDownloader
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	// stream types of the PMT
+	streamTypeH264     = 0x1B
+	streamTypeHEVC     = 0x24
+	streamTypeMetadata = 0x15
+)
+
+var errNotTransportStream = errors.New("not a MPEG transport stream")
+
+// pesPacket is a reassembled PES packet of an elementary stream
+type pesPacket struct {
+	pid        uint16
+	streamType byte
+	pts        int64
+	hasPTS     bool
+	data       []byte
+}
+
+// tsDemuxer reassembles the PES packets of a MPEG transport stream,
+// elementary streams are discovered through the PAT and PMT
+type tsDemuxer struct {
+	pmtPIDs     map[uint16]bool
+	streamTypes map[uint16]byte
+	pending     map[uint16][]byte
+	// lastPTS unwraps the 33 bits PTS of every stream
+	lastPTS map[uint16]int64
+	wraps   map[uint16]int64
+}
+
+func newTSDemuxer() *tsDemuxer {
+	return &tsDemuxer{
+		pmtPIDs:     make(map[uint16]bool),
+		streamTypes: make(map[uint16]byte),
+		pending:     make(map[uint16][]byte),
+		lastPTS:     make(map[uint16]int64),
+		wraps:       make(map[uint16]int64),
+	}
+}
+
+// demuxTS calls fn with every PES packet of the elementary streams accepted by
+// wanted, in stream order
+func demuxTS(r io.Reader, wanted func(streamType byte) bool, fn func(*pesPacket) error) error {
+	d := newTSDemuxer()
+	br := bufio.NewReaderSize(r, 64*tsPacketSize)
+	packet := make([]byte, tsPacketSize)
+	first := true
+	for {
+		_, err := io.ReadFull(br, packet)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if packet[0] != tsSyncByte {
+			if first {
+				return errNotTransportStream
+			}
+			// lost sync, look for the next sync byte
+			if err := resync(br, packet); err != nil {
+				break
+			}
+		}
+		first = false
+		if err := d.packet(packet, wanted, fn); err != nil {
+			return err
+		}
+	}
+	for pid, data := range d.pending {
+		if err := d.flush(pid, data, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resync(br *bufio.Reader, packet []byte) error {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == tsSyncByte {
+			packet[0] = b
+			_, err = io.ReadFull(br, packet[1:])
+			return err
+		}
+	}
+}
+
+func (d *tsDemuxer) packet(packet []byte, wanted func(streamType byte) bool, fn func(*pesPacket) error) error {
+	unitStart := packet[1]&0x40 != 0
+	pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+	adaptation := (packet[3] >> 4) & 0x3
+	payload := packet[4:]
+	if adaptation == 2 || adaptation == 0 {
+		return nil
+	}
+	if adaptation == 3 {
+		length := int(payload[0])
+		if length+1 >= len(payload) {
+			return nil
+		}
+		payload = payload[length+1:]
+	}
+
+	switch {
+	case pid == 0:
+		if unitStart {
+			d.parsePAT(payload)
+		}
+	case d.pmtPIDs[pid]:
+		if unitStart {
+			d.parsePMT(payload)
+		}
+	default:
+		streamType, ok := d.streamTypes[pid]
+		if !ok || !wanted(streamType) {
+			return nil
+		}
+		if unitStart {
+			if data, ok := d.pending[pid]; ok {
+				if err := d.flush(pid, data, fn); err != nil {
+					return err
+				}
+			}
+			d.pending[pid] = append([]byte(nil), payload...)
+		} else if data, ok := d.pending[pid]; ok {
+			d.pending[pid] = append(data, payload...)
+		}
+	}
+	return nil
+}
+
+// section skips the pointer field and returns the section up to its CRC
+func section(payload []byte) []byte {
+	pointer := int(payload[0])
+	if pointer+1 >= len(payload) {
+		return nil
+	}
+	payload = payload[pointer+1:]
+	if len(payload) < 3 {
+		return nil
+	}
+	length := int(payload[1]&0x0F)<<8 | int(payload[2])
+	if 3+length > len(payload) || length < 4 {
+		return nil
+	}
+	return payload[:3+length-4]
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte) {
+	s := section(payload)
+	if len(s) < 8 {
+		return
+	}
+	for i := 8; i+4 <= len(s); i += 4 {
+		program := uint16(s[i])<<8 | uint16(s[i+1])
+		pid := uint16(s[i+2]&0x1F)<<8 | uint16(s[i+3])
+		if program != 0 {
+			d.pmtPIDs[pid] = true
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte) {
+	s := section(payload)
+	if len(s) < 12 {
+		return
+	}
+	infoLength := int(s[10]&0x0F)<<8 | int(s[11])
+	for i := 12 + infoLength; i+5 <= len(s); {
+		streamType := s[i]
+		pid := uint16(s[i+1]&0x1F)<<8 | uint16(s[i+2])
+		d.streamTypes[pid] = streamType
+		i += 5 + (int(s[i+3]&0x0F)<<8 | int(s[i+4]))
+	}
+}
+
+func parsePTS(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func (d *tsDemuxer) flush(pid uint16, data []byte, fn func(*pesPacket) error) error {
+	delete(d.pending, pid)
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil
+	}
+	pes := &pesPacket{pid: pid, streamType: d.streamTypes[pid]}
+	headerLength := int(data[8])
+	if 9+headerLength > len(data) {
+		return nil
+	}
+	if data[7]&0x80 != 0 && headerLength >= 5 {
+		pts := parsePTS(data[9:14])
+		last, seen := d.lastPTS[pid]
+		if seen && pts+d.wraps[pid] < last-1<<32 {
+			d.wraps[pid] += 1 << 33
+		}
+		pes.pts = pts + d.wraps[pid]
+		pes.hasPTS = true
+		d.lastPTS[pid] = pes.pts
+	}
+	pes.data = data[9+headerLength:]
+	return fn(pes)
+}
@@ -0,0 +1,48 @@
+package HLSDownloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// DefaultUserAgent is the User-Agent of the requests unless SetUserAgent changes it, some origins
+// reject the one of the Go HTTP client
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// SetUserAgent sets the User-Agent of the playlist, segment and key requests, DefaultUserAgent
+// by default, empty restores it. A User-Agent in the header of SetHeader or set by a request hook
+// takes precedence.
+func (h *hlsDownloader) SetUserAgent(userAgent string) error {
+	if h == nil {
+		return errors.New("attempt to set user agent on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.userAgent = userAgent
+	return nil
+}
+
+// withUserAgent returns fetcher setting the User-Agent of the download on the requests without one
+func (h *hlsDownloader) withUserAgent(fetcher Fetcher) Fetcher {
+	userAgent := h.userAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	return userAgentFetcher{fetcher: fetcher, userAgent: userAgent}
+}
+
+type userAgentFetcher struct {
+	fetcher   Fetcher
+	userAgent string
+}
+
+func (f userAgentFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		cloneRequestHeader(req)
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	return f.fetcher.Do(ctx, req)
+}
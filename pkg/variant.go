@@ -0,0 +1,163 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// VariantPolicy defines which variant is picked from a master playlist
+// when no explicit variant has been selected.
+type VariantPolicy int
+
+const (
+	// HighestBandwidth picks the variant with the highest bandwidth (default)
+	HighestBandwidth VariantPolicy = iota
+	// LowestBandwidth picks the variant with the lowest bandwidth
+	LowestBandwidth
+)
+
+func (p VariantPolicy) String() string {
+	switch p {
+	case HighestBandwidth:
+		return "highest"
+	case LowestBandwidth:
+		return "lowest"
+	}
+	return fmt.Sprintf("VariantPolicy(%d)", int(p))
+}
+
+// ParseVariantPolicy converts a textual policy ("highest", "lowest") into a VariantPolicy
+func ParseVariantPolicy(s string) (VariantPolicy, error) {
+	switch s {
+	case "", "highest", "best":
+		return HighestBandwidth, nil
+	case "lowest", "worst":
+		return LowestBandwidth, nil
+	}
+	return 0, fmt.Errorf("unknown variant policy %q", s)
+}
+
+// Variant describes a variant of a master playlist to a variant filter, a Result and a ProbeInfo
+type Variant struct {
+	URI              string   `json:"uri"`
+	Bandwidth        uint32   `json:"bandwidth"`
+	AverageBandwidth uint32   `json:"averageBandwidth,omitempty"`
+	Width            int      `json:"width,omitempty"`
+	Height           int      `json:"height,omitempty"`
+	Codecs           []string `json:"codecs,omitempty"`
+	FrameRate        float64  `json:"frameRate,omitempty"`
+	Audio            string   `json:"audio,omitempty"`
+	Subtitles        string   `json:"subtitles,omitempty"`
+	Iframe           bool     `json:"iframe,omitempty"`
+}
+
+func newVariant(v *m3u8.Variant) Variant {
+	variant := Variant{
+		URI:              v.URI,
+		Bandwidth:        v.Bandwidth,
+		AverageBandwidth: v.AverageBandwidth,
+		FrameRate:        v.FrameRate,
+		Audio:            v.Audio,
+		Subtitles:        v.Subtitles,
+		Iframe:           v.Iframe,
+	}
+	fmt.Sscanf(v.Resolution, "%dx%d", &variant.Width, &variant.Height)
+	for _, codec := range strings.Split(v.Codecs, ",") {
+		if codec = strings.TrimSpace(codec); codec != "" {
+			variant.Codecs = append(variant.Codecs, codec)
+		}
+	}
+	return variant
+}
+
+// VariantCriteria constrains the selected variant, zero fields are ignored.
+// Its Match method can be passed to SetVariantFilter.
+type VariantCriteria struct {
+	MinHeight    int
+	MaxHeight    int
+	MinBandwidth uint32
+	MaxBandwidth uint32
+	// Codecs lists codec prefixes (e.g. "avc1", "hvc1", "mp4a") the variant must all carry
+	Codecs []string
+}
+
+// Match reports whether the variant meets the criteria. Variants without a
+// RESOLUTION are not excluded by the height limits.
+func (c VariantCriteria) Match(v Variant) bool {
+	if v.Height > 0 && ((c.MinHeight > 0 && v.Height < c.MinHeight) || (c.MaxHeight > 0 && v.Height > c.MaxHeight)) {
+		return false
+	}
+	if c.MinBandwidth > 0 && v.Bandwidth < c.MinBandwidth {
+		return false
+	}
+	if c.MaxBandwidth > 0 && v.Bandwidth > c.MaxBandwidth {
+		return false
+	}
+	for _, wanted := range c.Codecs {
+		found := false
+		for _, codec := range v.Codecs {
+			if strings.HasPrefix(codec, wanted) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func variantPixels(v *m3u8.Variant) int {
+	var width, height int
+	if _, err := fmt.Sscanf(v.Resolution, "%dx%d", &width, &height); err != nil {
+		return 0
+	}
+	return width * height
+}
+
+// better reports whether a should be preferred over b according to the policy
+func (p VariantPolicy) better(a, b *m3u8.Variant) bool {
+	if a.Bandwidth != b.Bandwidth {
+		if p == LowestBandwidth {
+			return a.Bandwidth < b.Bandwidth
+		}
+		return a.Bandwidth > b.Bandwidth
+	}
+	if p == LowestBandwidth {
+		return variantPixels(a) < variantPixels(b)
+	}
+	return variantPixels(a) > variantPixels(b)
+}
+
+// selectVariant picks a regular variant or, when iframe is set, an I-frame only
+// variant (EXT-X-I-FRAME-STREAM-INF) according to the policy among the ones the filter accepts
+func selectVariant(variants []*m3u8.Variant, policy VariantPolicy, iframe bool, filter func(Variant) bool) (*m3u8.Variant, error) {
+	var selected *m3u8.Variant
+	filtered := false
+	for _, v := range variants {
+		if v == nil || v.Iframe != iframe {
+			continue
+		}
+		if filter != nil && !filter(newVariant(v)) {
+			filtered = true
+			continue
+		}
+		if selected == nil || policy.better(v, selected) {
+			selected = v
+		}
+	}
+	if selected == nil {
+		if filtered {
+			return nil, errors.New("no variant of the master playlist matches the variant filter")
+		}
+		if iframe {
+			return nil, errors.New("master playlist has no I-frame variants")
+		}
+		return nil, errors.New("master playlist has no variants")
+	}
+	return selected, nil
+}
@@ -0,0 +1,115 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errCorruptSegment is returned when a downloaded segment fails its verification, it is downloaded again
+var errCorruptSegment = errors.New("corrupt segment")
+
+// SegmentInfo describes a segment to a segment verifier or filter
+type SegmentInfo struct {
+	SeqID uint64
+	URI   string
+	// FMP4 is set for fragmented MP4 (CMAF) segments, transport streams and packed audio otherwise
+	FMP4 bool
+	// Track is the name of the track listing the segment, e.g. "main" or "audio"
+	Track    string
+	Duration time.Duration
+	// ProgramDateTime is the EXT-X-PROGRAM-DATE-TIME of the segment, zero when unknown
+	ProgramDateTime time.Time
+}
+
+// segmentInfo describes the segment of the track
+func segmentInfo(t *track, segment *segment) SegmentInfo {
+	return SegmentInfo{
+		SeqID:           segment.SeqId,
+		URI:             segment.URI,
+		FMP4:            segment.isFMP4(),
+		Track:           t.name,
+		Duration:        time.Duration(segment.Duration * float64(time.Second)),
+		ProgramDateTime: segment.ProgramDateTime,
+	}
+}
+
+// SegmentVerifier checks the content of a downloaded segment, AES-128 segments are decrypted
+// first. An error makes the segment downloaded again, like a transient network error.
+type SegmentVerifier func(info SegmentInfo, data []byte) error
+
+// SetSegmentVerifier sets the callback verifying every downloaded segment before it is joined
+func (h *hlsDownloader) SetSegmentVerifier(verifier SegmentVerifier) error {
+	if h == nil {
+		return errors.New("attempt to set segment verifier on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.segmentVerifier = verifier
+	return nil
+}
+
+// SetVerifyTS enables the built-in sanity check of the transport stream segments, see VerifyTS
+func (h *hlsDownloader) SetVerifyTS(enabled bool) error {
+	if h == nil {
+		return errors.New("attempt to set verify ts on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	h.verifyTS = enabled
+	return nil
+}
+
+// VerifyTS checks that data is made of whole transport stream packets, each one starting with
+// the sync byte
+func VerifyTS(data []byte) error {
+	if len(data) < tsPacketSize {
+		return fmt.Errorf("%d bytes are less than a packet", len(data))
+	}
+	if len(data)%tsPacketSize != 0 {
+		return fmt.Errorf("%d bytes are not a whole number of packets", len(data))
+	}
+	for i := 0; i < len(data); i += tsPacketSize {
+		if data[i] != tsSyncByte {
+			return fmt.Errorf("packet %d has no sync byte", i/tsPacketSize)
+		}
+	}
+	return nil
+}
+
+// verifySegment runs the checks of a downloaded segment, a corrupt segment is dropped so that
+// it is downloaded again
+func (h *hlsDownloader) verifySegment(t *track, segment *segment) error {
+	if !h.verifyTS && h.segmentVerifier == nil {
+		return nil
+	}
+	size, err := h.reserveDecryption(segment)
+	if err != nil {
+		return err
+	}
+	defer h.decryptMemory.release(size)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err = decrypt(buf, segment, h.keys, !h.keepPadding, h.log())
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if h.verifyTS && !segment.isFMP4() && !isPackedAudio(data) {
+		err = VerifyTS(data)
+	}
+	if err == nil && h.segmentVerifier != nil {
+		err = h.segmentVerifier(segmentInfo(t, segment), data)
+	}
+	if err == nil {
+		return nil
+	}
+	if rerr := h.releaseSegment(segment); rerr != nil {
+		return rerr
+	}
+	return fmt.Errorf("%w %d: %v", errCorruptSegment, segment.SeqId, err)
+}
@@ -0,0 +1,153 @@
+package HLSDownloader
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// readAheadPerWorker is how many segments every worker may download past the next one to append
+// by default, see SetReadAhead
+const readAheadPerWorker = 2
+
+// SetReadAhead bounds how many segments past the next one to append to the output are downloaded
+// ahead, so that a slow segment does not let the temp dir fill up with the whole asset while the
+// workers go on. It defaults to twice the workers, zero restores the default.
+func (h *hlsDownloader) SetReadAhead(segments int) error {
+	if h == nil {
+		return errors.New("attempt to set read ahead on nil instance")
+	}
+	if err := h.lockSettings(); err != nil {
+		return err
+	}
+	defer h.settingsMu.Unlock()
+	if segments < 0 {
+		return errors.New("read ahead must not be negative")
+	}
+	h.readAhead = segments
+	return nil
+}
+
+// readAheadSegments returns the read ahead of the download, at least one segment per worker.
+// Under a memory limit, it is reduced to the segments of average size fitting in the memory buffer.
+func (h *hlsDownloader) readAheadSegments() int {
+	window := h.readAhead
+	if window == 0 {
+		window = h.workers * readAheadPerWorker
+	}
+	if h.memoryLimit > 0 && h.memory != nil {
+		if average := h.stats.Load().averageSegment(); average > 0 && h.memory.limit/average < int64(window) {
+			window = int(h.memory.limit / average)
+		}
+	}
+	if window < h.workers {
+		return h.workers
+	}
+	return window
+}
+
+// segmentWriter appends the segments of a batch to the track output in playlist order, each
+// one as soon as it and every segment before it are downloaded, while the workers download
+// the next ones. The segment files are removed once appended, so that the temp dir only holds
+// the segments waiting for an earlier one.
+type segmentWriter struct {
+	// ready receives the sequence number of every downloaded or skipped segment of the batch
+	ready chan uint64
+	quit  chan struct{}
+	// done is closed once every segment is appended or the writer failed, see err
+	done chan struct{}
+	err  error
+	// appended is how many segments of the batch were appended, progress is signaled after
+	// every segment appended
+	appended atomic.Int64
+	progress chan struct{}
+	// partial is set before an interrupted batch is finished, the segments never reported
+	// then end the output instead of failing it
+	partial bool
+}
+
+// startSegmentWriter sorts the segments of the batch and starts appending them
+func (h *hlsDownloader) startSegmentWriter(t *track) *segmentWriter {
+	sort.Slice(t.segments, func(i, j int) bool {
+		return t.segments[i].SeqId < t.segments[j].SeqId
+	})
+	w := &segmentWriter{
+		// every segment is reported once, sending never blocks
+		ready:    make(chan uint64, len(t.segments)),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		progress: make(chan struct{}, 1),
+	}
+	go func() {
+		defer close(w.done)
+		w.err = h.writeSegments(t, w)
+	}()
+	return w
+}
+
+func (h *hlsDownloader) writeSegments(t *track, w *segmentWriter) error {
+	if t.out == nil {
+		if err := h.nextOutputFile(t); err != nil {
+			return err
+		}
+	}
+	ready := make(map[uint64]bool)
+	next := 0
+	for next < len(t.segments) {
+		select {
+		case seqId, ok := <-w.ready:
+			if !ok {
+				if w.partial {
+					return nil
+				}
+				return fmt.Errorf("segment %d was never downloaded", t.segments[next].SeqId)
+			}
+			ready[seqId] = true
+		case <-w.quit:
+			return nil
+		}
+		for next < len(t.segments) && ready[t.segments[next].SeqId] {
+			if err := h.joinSegment(t, t.segments[next]); err != nil {
+				return err
+			}
+			delete(ready, t.segments[next].SeqId)
+			next++
+			w.appended.Store(int64(next))
+			select {
+			case w.progress <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// waitWindow waits until the segment at index i of the batch is within the read ahead of the
+// next segment to append. It returns false when abort is closed meanwhile.
+func (w *segmentWriter) waitWindow(i int, window int, abort <-chan struct{}) bool {
+	for int64(i) >= w.appended.Load()+int64(window) {
+		select {
+		case <-w.progress:
+		case <-w.done:
+			return true
+		case <-abort:
+			return false
+		}
+	}
+	return true
+}
+
+// wait waits for the remaining segments to be appended, once every segment was reported
+func (w *segmentWriter) wait() error {
+	close(w.ready)
+	<-w.done
+	return w.err
+}
+
+// stop makes the writer give up the remaining segments and waits for it, the track output
+// is no longer written once it returns
+func (w *segmentWriter) stop() {
+	close(w.quit)
+	<-w.done
+}